@@ -0,0 +1,377 @@
+package guardrail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ApplicationKeyPrefix marks keys issued by GuardRail so they are easy to
+// recognize in code, configuration and secret scanners
+const ApplicationKeyPrefix = "grk_"
+
+const (
+	// applicationKeyBytes is the amount of randomness in a generated key
+	applicationKeyBytes = 32
+	// applicationKeyIDLength is how much of the key is kept in clear text
+	// as a public identifier (prefix plus the first random characters)
+	applicationKeyIDLength = len(ApplicationKeyPrefix) + 8
+	// applicationKeyCacheTTL bounds how long a validated key is cached in Redis
+	applicationKeyCacheTTL = 1 * time.Hour
+	// applicationKeyTouchInterval throttles last_used_at updates
+	applicationKeyTouchInterval = 1 * time.Minute
+)
+
+var (
+	// ErrInvalidApplicationKey is returned when a key is unknown, revoked or expired
+	ErrInvalidApplicationKey = errors.New("invalid application key")
+	// ErrApplicationKeyNotFound is returned when a managed key does not exist
+	ErrApplicationKeyNotFound = errors.New("application key not found")
+)
+
+// ApplicationToken represents an application key issued to a tenant.
+// Only a SHA-256 hash of the key is stored; the plaintext is returned once at issuance.
+type ApplicationToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	TenantID  uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name      string
+	KeyPrefix string `gorm:"type:varchar(32);uniqueIndex;not null"` // Public identifier, safe to display
+	KeyHash   string `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	// Secret for signed requests, encrypted with the token ID as associated
+	// data. Empty for keys issued before signing secrets were stored.
+	SigningSecret string     `json:"-"`
+	IsActive      bool       `gorm:"default:true"`
+	ExpiresAt     *time.Time `gorm:"index"`
+	LastUsedAt    *time.Time
+	RevokedAt     *time.Time
+	RotatedFromID *uuid.UUID `gorm:"type:uuid"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName specifies the table name for ApplicationToken model
+func (ApplicationToken) TableName() string {
+	return "application_tokens"
+}
+
+// BeforeCreate assigns the token ID
+func (t *ApplicationToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// IsUsable reports whether the key is active, not revoked and not expired
+func (t ApplicationToken) IsUsable(now time.Time) bool {
+	if !t.IsActive || t.RevokedAt != nil {
+		return false
+	}
+	return t.ExpiresAt == nil || now.Before(*t.ExpiresAt)
+}
+
+// IssuedApplicationKey is returned when a key is created or rotated.
+// Key holds the plaintext value, which cannot be recovered later.
+type IssuedApplicationKey struct {
+	Key   string           `json:"key"`
+	Token ApplicationToken `json:"token"`
+}
+
+// cachedApplicationKey is the Redis representation of a validated key
+type cachedApplicationKey struct {
+	ID        string     `json:"id"`
+	TenantID  string     `json:"tenant_id"`
+	KeyPrefix string     `json:"key_prefix"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateApplicationKey issues a new application key for a tenant.
+// A nil expiresAt creates a key that never expires.
+func (ts *TenantService) CreateApplicationKey(tenantID, name string, expiresAt *time.Time) (*IssuedApplicationKey, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+
+	return ts.issueApplicationKey(ts.gr.db, tenant.ID, strings.TrimSpace(name), expiresAt, nil)
+}
+
+// ListApplicationKeys returns all keys of a tenant, including revoked and expired ones
+func (ts *TenantService) ListApplicationKeys(tenantID string) ([]ApplicationToken, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var tokens []ApplicationToken
+	if err := ts.gr.db.Where("tenant_id = ?", id).Order("created_at").Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// RotateApplicationKey issues a replacement for an existing key. The old key
+// keeps working for the overlap period so clients can be redeployed; an
+// overlap of zero revokes it immediately.
+func (ts *TenantService) RotateApplicationKey(keyID string, overlap time.Duration) (*IssuedApplicationKey, error) {
+	old, err := ts.getApplicationKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !old.IsUsable(now) {
+		return nil, fmt.Errorf("cannot rotate a revoked or expired application key")
+	}
+
+	var issued *IssuedApplicationKey
+	err = ts.gr.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		issued, err = ts.issueApplicationKey(tx, old.TenantID, old.Name, old.ExpiresAt, &old.ID)
+		if err != nil {
+			return err
+		}
+
+		if overlap <= 0 {
+			return tx.Model(old).Updates(map[string]interface{}{
+				"is_active":  false,
+				"revoked_at": &now,
+			}).Error
+		}
+
+		graceEnd := now.Add(overlap)
+		if old.ExpiresAt == nil || graceEnd.Before(*old.ExpiresAt) {
+			return tx.Model(old).Update("expires_at", &graceEnd).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate application key: %w", err)
+	}
+
+	ts.gr.invalidateApplicationKey(old.KeyHash)
+	return issued, nil
+}
+
+// RevokeApplicationKey permanently disables a key. Cached validations are
+// dropped so the key stops working immediately.
+func (ts *TenantService) RevokeApplicationKey(keyID string) error {
+	token, err := ts.getApplicationKey(keyID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = ts.gr.db.Model(token).Updates(map[string]interface{}{
+		"is_active":  false,
+		"revoked_at": &now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to revoke application key: %w", err)
+	}
+
+	ts.gr.invalidateApplicationKey(token.KeyHash)
+	return nil
+}
+
+func (ts *TenantService) getApplicationKey(keyID string) (*ApplicationToken, error) {
+	id, err := uuid.Parse(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid application key id: %w", err)
+	}
+
+	var token ApplicationToken
+	if err := ts.gr.db.Where("id = ?", id).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrApplicationKeyNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &token, nil
+}
+
+func (ts *TenantService) issueApplicationKey(db *gorm.DB, tenantID uuid.UUID, name string, expiresAt *time.Time, rotatedFrom *uuid.UUID) (*IssuedApplicationKey, error) {
+	key, err := generateApplicationKey()
+	if err != nil {
+		return nil, err
+	}
+
+	token := ApplicationToken{
+		ID:            uuid.New(),
+		TenantID:      tenantID,
+		Name:          name,
+		KeyPrefix:     key[:applicationKeyIDLength],
+		KeyHash:       hashApplicationKey(key),
+		IsActive:      true,
+		ExpiresAt:     expiresAt,
+		RotatedFromID: rotatedFrom,
+	}
+	if token.SigningSecret, err = ts.gr.encryptSecret(requestSigningSecret(key), token.ID.String()); err != nil {
+		return nil, fmt.Errorf("failed to encrypt signing secret: %w", err)
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return nil, fmt.Errorf("failed to create application key: %w", err)
+	}
+
+	return &IssuedApplicationKey{Key: key, Token: token}, nil
+}
+
+// validateApplicationKey resolves a plaintext key to its cached metadata
+func (gr *GuardRail) validateApplicationKey(key string) (*cachedApplicationKey, error) {
+	return gr.validateApplicationKeyHash(hashApplicationKey(key))
+}
+
+// validateApplicationKeyHash resolves a key hash to its cached metadata
+func (gr *GuardRail) validateApplicationKeyHash(hash string) (*cachedApplicationKey, error) {
+	ctx := context.Background()
+	cacheKey := "application_key:" + hash
+	now := time.Now()
+
+	var entry *cachedApplicationKey
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var cached cachedApplicationKey
+			if json.Unmarshal([]byte(val), &cached) == nil {
+				entry = &cached
+			}
+		}
+	}
+
+	if entry == nil {
+		var token ApplicationToken
+		err := gr.db.Where("key_hash = ?", hash).First(&token).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrInvalidApplicationKey
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if !token.IsUsable(now) {
+			return nil, ErrInvalidApplicationKey
+		}
+
+		entry = &cachedApplicationKey{
+			ID:        token.ID.String(),
+			TenantID:  token.TenantID.String(),
+			KeyPrefix: token.KeyPrefix,
+			ExpiresAt: token.ExpiresAt,
+		}
+
+		// Cache the result if Redis is available, never beyond the key's expiry
+		if gr.redis != nil {
+			ttl := applicationKeyCacheTTL
+			if entry.ExpiresAt != nil && time.Until(*entry.ExpiresAt) < ttl {
+				ttl = time.Until(*entry.ExpiresAt)
+			}
+			if data, err := json.Marshal(entry); err == nil && ttl > 0 {
+				gr.redis.Set(ctx, cacheKey, data, ttl)
+			}
+		}
+	}
+
+	if entry.ExpiresAt != nil && !now.Before(*entry.ExpiresAt) {
+		return nil, ErrInvalidApplicationKey
+	}
+
+	gr.touchApplicationKey(entry.ID, now)
+	return entry, nil
+}
+
+// touchApplicationKey records key usage, at most once per touch interval
+func (gr *GuardRail) touchApplicationKey(id string, now time.Time) {
+	if gr.redis != nil {
+		ok, err := gr.redis.SetNX(context.Background(), "application_key_used:"+id, 1, applicationKeyTouchInterval).Result()
+		if err == nil && !ok {
+			return
+		}
+	}
+
+	gr.db.Model(&ApplicationToken{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-applicationKeyTouchInterval)).
+		Update("last_used_at", now)
+}
+
+// invalidateApplicationKey drops the cached validation of a key
+func (gr *GuardRail) invalidateApplicationKey(keyHash string) {
+	if gr.redis != nil {
+		gr.redis.Del(context.Background(), "application_key:"+keyHash)
+	}
+}
+
+// migrateLegacyApplicationTokens converts tables that stored keys in a
+// plaintext "token" column to the hashed layout
+func migrateLegacyApplicationTokens(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&ApplicationToken{}) || !m.HasColumn(&ApplicationToken{}, "token") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		m := tx.Migrator()
+		for _, column := range []string{"key_prefix", "key_hash"} {
+			if !m.HasColumn(&ApplicationToken{}, column) {
+				if err := tx.Exec("ALTER TABLE application_tokens ADD COLUMN " + column + " varchar(64)").Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		var rows []struct {
+			ID    string
+			Token string
+		}
+		if err := tx.Table("application_tokens").Select("id", "token").Where("key_hash IS NULL OR key_hash = ''").Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			hash := hashApplicationKey(row.Token)
+			err := tx.Table("application_tokens").Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"key_hash":   hash,
+				"key_prefix": "legacy_" + hash[:12],
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if m.HasIndex(&ApplicationToken{}, "idx_application_tokens_token") {
+			if err := m.DropIndex(&ApplicationToken{}, "idx_application_tokens_token"); err != nil {
+				return err
+			}
+		}
+		return tx.Exec("ALTER TABLE application_tokens DROP COLUMN token").Error
+	})
+}
+
+// generateApplicationKey returns a new random key carrying ApplicationKeyPrefix
+func generateApplicationKey() (string, error) {
+	buf := make([]byte, applicationKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate application key: %w", err)
+	}
+	return ApplicationKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashApplicationKey returns the hex-encoded SHA-256 digest stored for a key.
+// Keys carry 256 bits of randomness, so a fast hash is sufficient.
+func hashApplicationKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
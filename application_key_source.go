@@ -0,0 +1,214 @@
+package guardrail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// ApplicationKeySource is a place ApplicationKeyMiddleware looks for a key
+type ApplicationKeySource string
+
+const (
+	// AppKeySourceHeader reads the key from the X-Application-Key header
+	AppKeySourceHeader ApplicationKeySource = "header"
+	// AppKeySourceBasic reads the key from HTTP Basic credentials (key as username)
+	AppKeySourceBasic ApplicationKeySource = "basic"
+	// AppKeySourceQuery reads the key from the application_key query parameter.
+	// Keys sent this way end up in access logs, so it is not enabled by default.
+	AppKeySourceQuery ApplicationKeySource = "query"
+	// AppKeySourceSignature verifies an HMAC signature instead of a bearer key
+	AppKeySourceSignature ApplicationKeySource = "signature"
+)
+
+// Headers read by the application key sources
+const (
+	HeaderApplicationKey     = "X-Application-Key"
+	HeaderApplicationKeyID   = "X-Application-Key-Id"
+	HeaderSignature          = "X-Signature"
+	HeaderSignatureTimestamp = "X-Signature-Timestamp"
+)
+
+var (
+	// ErrMissingApplicationKey is returned when no configured source carries a key
+	ErrMissingApplicationKey = errors.New("application key is required")
+	// ErrInvalidSignature is returned when a signed request fails verification
+	ErrInvalidSignature = errors.New("invalid request signature")
+)
+
+// SignRequest computes the X-Signature header value for a request.
+// path is the request URI including the query string. The signing secret is
+// derived from the application key, so the key itself never leaves the client.
+func SignRequest(applicationKey, method, path string, body []byte, timestamp time.Time) string {
+	return signRequest(requestSigningSecret(applicationKey), method, path, body, timestamp.Unix())
+}
+
+// requestSigningSecret derives the HMAC key for signed requests. It must not
+// be computable from the stored KeyHash, so it is not a plain hash of the key.
+func requestSigningSecret(applicationKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(applicationKey))
+	mac.Write([]byte("guardrail request signing"))
+	return mac.Sum(nil)
+}
+
+func signRequest(secret []byte, method, path string, body []byte, timestamp int64) string {
+	bodyDigest := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		hex.EncodeToString(bodyDigest[:]),
+		strconv.FormatInt(timestamp, 10),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticateApplicationKey checks the configured sources in order. The
+// first source that carries credentials decides the outcome.
+func (gr *GuardRail) authenticateApplicationKey(c *fiber.Ctx) (*cachedApplicationKey, error) {
+	for _, source := range gr.config.ApplicationKeySources {
+		switch source {
+		case AppKeySourceHeader:
+			if key := c.Get(HeaderApplicationKey); key != "" {
+				return gr.validateApplicationKey(key)
+			}
+		case AppKeySourceBasic:
+			if key, ok := basicAuthUsername(c.Get(fiber.HeaderAuthorization)); ok {
+				return gr.validateApplicationKey(key)
+			}
+		case AppKeySourceQuery:
+			if key := c.Query("application_key"); key != "" {
+				return gr.validateApplicationKey(key)
+			}
+		case AppKeySourceSignature:
+			if keyID := c.Get(HeaderApplicationKeyID); keyID != "" {
+				return gr.verifySignedRequest(c, keyID)
+			}
+		}
+	}
+
+	return nil, ErrMissingApplicationKey
+}
+
+// verifySignedRequest validates the signature headers of a request
+func (gr *GuardRail) verifySignedRequest(c *fiber.Ctx, keyID string) (*cachedApplicationKey, error) {
+	signature := c.Get(HeaderSignature)
+	timestamp, err := strconv.ParseInt(c.Get(HeaderSignatureTimestamp), 10, 64)
+	if signature == "" || err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	// Reject requests outside the allowed clock skew
+	skew := time.Since(time.Unix(timestamp, 0))
+	if math.Abs(float64(skew)) > float64(gr.config.SignatureMaxSkew) {
+		return nil, ErrInvalidSignature
+	}
+
+	signing, err := gr.applicationKeySigningByPrefix(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if signing.Secret == "" {
+		return nil, ErrInvalidSignature
+	}
+	secret, err := gr.decryptSecret(signing.Secret, signing.ID)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	expected := signRequest(secret, c.Method(), c.OriginalURL(), c.Body(), timestamp)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, ErrInvalidSignature
+	}
+
+	appKey, err := gr.validateApplicationKeyHash(signing.KeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject exact replays within the window if Redis is available
+	if gr.redis != nil {
+		ctx := context.Background()
+		fresh, err := gr.redis.SetNX(ctx, "signature:"+expected, 1, 2*gr.config.SignatureMaxSkew).Result()
+		if err == nil && !fresh {
+			return nil, ErrInvalidSignature
+		}
+	}
+
+	return appKey, nil
+}
+
+// applicationKeySigning is what verifying a signed request needs of a key
+type applicationKeySigning struct {
+	ID      string `json:"id"`
+	KeyHash string `json:"key_hash"`
+	// Encrypted, see ApplicationToken.SigningSecret
+	Secret string `json:"secret"`
+}
+
+// applicationKeySigningByPrefix looks up the signing secret of a key by its
+// public identifier. It never changes, so it is cached; validity is checked separately.
+func (gr *GuardRail) applicationKeySigningByPrefix(prefix string) (*applicationKeySigning, error) {
+	ctx := context.Background()
+	cacheKey := "application_key_signing:" + prefix
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var cached applicationKeySigning
+			if json.Unmarshal([]byte(val), &cached) == nil {
+				return &cached, nil
+			}
+		}
+	}
+
+	var token ApplicationToken
+	if err := gr.db.Select("id", "key_hash", "signing_secret").Where("key_prefix = ?", prefix).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidSignature
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	signing := &applicationKeySigning{ID: token.ID.String(), KeyHash: token.KeyHash, Secret: token.SigningSecret}
+
+	if gr.redis != nil {
+		if data, err := json.Marshal(signing); err == nil {
+			gr.redis.Set(ctx, cacheKey, data, applicationKeyCacheTTL)
+		}
+	}
+
+	return signing, nil
+}
+
+// basicAuthUsername extracts the username from HTTP Basic credentials,
+// falling back to the password for clients that send ":key"
+func basicAuthUsername(header string) (string, bool) {
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	username, password, _ := strings.Cut(string(decoded), ":")
+	if username == "" {
+		username = password
+	}
+	return username, username != ""
+}
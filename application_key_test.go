@@ -0,0 +1,240 @@
+package guardrail_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestApplicationKeyLifecycle(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true})
+	ts := gr.NewTenantService()
+
+	tenant, err := ts.CreateTenant("Acme")
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("application_key").(string))
+	})
+	status := func(key string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(guardrail.HeaderApplicationKey, key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	issued, err := ts.CreateApplicationKey(tenant.ID.String(), "backend", nil)
+	if err != nil {
+		t.Fatalf("CreateApplicationKey failed: %v", err)
+	}
+
+	t.Run("StoredHashed", func(t *testing.T) {
+		if !strings.HasPrefix(issued.Key, guardrail.ApplicationKeyPrefix) {
+			t.Errorf("Expected key to start with %q, got %q", guardrail.ApplicationKeyPrefix, issued.Key)
+		}
+		var count int64
+		db.Model(&guardrail.ApplicationToken{}).Where("key_hash = ?", issued.Key).Count(&count)
+		if count != 0 || issued.Token.KeyHash == issued.Key {
+			t.Error("Expected plaintext key not to be stored")
+		}
+	})
+
+	t.Run("LastUsed", func(t *testing.T) {
+		if code := status(issued.Key); code != fiber.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		var token guardrail.ApplicationToken
+		db.First(&token, "id = ?", issued.Token.ID)
+		if token.LastUsedAt == nil {
+			t.Error("Expected last_used_at to be recorded")
+		}
+	})
+
+	t.Run("RotateWithOverlap", func(t *testing.T) {
+		rotated, err := ts.RotateApplicationKey(issued.Token.ID.String(), time.Hour)
+		if err != nil {
+			t.Fatalf("RotateApplicationKey failed: %v", err)
+		}
+		if code := status(issued.Key); code != fiber.StatusOK {
+			t.Errorf("Expected old key to work during overlap, got %d", code)
+		}
+		if code := status(rotated.Key); code != fiber.StatusOK {
+			t.Errorf("Expected new key to work, got %d", code)
+		}
+
+		if err := ts.RevokeApplicationKey(rotated.Token.ID.String()); err != nil {
+			t.Fatalf("RevokeApplicationKey failed: %v", err)
+		}
+		if code := status(rotated.Key); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected revoked key to be rejected, got %d", code)
+		}
+	})
+
+	t.Run("RotateWithoutOverlap", func(t *testing.T) {
+		key, _ := ts.CreateApplicationKey(tenant.ID.String(), "worker", nil)
+		rotated, err := ts.RotateApplicationKey(key.Token.ID.String(), 0)
+		if err != nil {
+			t.Fatalf("RotateApplicationKey failed: %v", err)
+		}
+		if code := status(key.Key); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected old key to be revoked, got %d", code)
+		}
+		if code := status(rotated.Key); code != fiber.StatusOK {
+			t.Errorf("Expected new key to work, got %d", code)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		key, _ := ts.CreateApplicationKey(tenant.ID.String(), "short-lived", nil)
+		db.Model(&guardrail.ApplicationToken{}).Where("id = ?", key.Token.ID).Update("expires_at", time.Now().Add(-time.Minute))
+		if code := status(key.Key); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected expired key to be rejected, got %d", code)
+		}
+	})
+}
+
+func TestLegacyApplicationTokenMigration(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true})
+
+	tenant, err := gr.NewTenantService().CreateTenant("Legacy")
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+
+	// Recreate the pre-hashing table layout with a plaintext key
+	db.Exec("DROP TABLE application_tokens")
+	db.Exec("CREATE TABLE application_tokens (id uuid PRIMARY KEY, tenant_id uuid NOT NULL, name text, token text NOT NULL, is_active numeric DEFAULT true, created_at datetime, updated_at datetime, deleted_at datetime)")
+	db.Exec("CREATE UNIQUE INDEX idx_application_tokens_token ON application_tokens(token)")
+	db.Exec("INSERT INTO application_tokens (id, tenant_id, token, is_active) VALUES (?, ?, ?, true)", "6f1c3ab2-4c1e-4d1a-9e3a-2b1b9c7d0e11", tenant.ID, "legacy-plaintext-key")
+
+	if err := gr.AutoMigrate(); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+	if db.Migrator().HasColumn(&guardrail.ApplicationToken{}, "token") {
+		t.Error("Expected plaintext token column to be dropped")
+	}
+
+	app := fiber.New()
+	app.Get("/", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(guardrail.HeaderApplicationKey, "legacy-plaintext-key")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected migrated legacy key to work, got %d", resp.StatusCode)
+	}
+}
+
+func TestApplicationKeySources(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		EnableMultiTenant: true,
+		ApplicationKeySources: []guardrail.ApplicationKeySource{
+			guardrail.AppKeySourceSignature,
+			guardrail.AppKeySourceHeader,
+			guardrail.AppKeySourceBasic,
+		},
+	})
+	ts := gr.NewTenantService()
+
+	tenant, _ := ts.CreateTenant("Acme")
+	issued, err := ts.CreateApplicationKey(tenant.ID.String(), "backend", nil)
+	if err != nil {
+		t.Fatalf("CreateApplicationKey failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Post("/orders", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	send := func(path string, body []byte, headers map[string]string) int {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	signed := func(path string, body []byte, ts time.Time) map[string]string {
+		return map[string]string{
+			guardrail.HeaderApplicationKeyID:   issued.Token.KeyPrefix,
+			guardrail.HeaderSignatureTimestamp: strconv.FormatInt(ts.Unix(), 10),
+			guardrail.HeaderSignature:          guardrail.SignRequest(issued.Key, "POST", path, body, ts),
+		}
+	}
+
+	body := []byte(`{"item":"widget"}`)
+
+	t.Run("Header", func(t *testing.T) {
+		if code := send("/orders", body, map[string]string{guardrail.HeaderApplicationKey: issued.Key}); code != fiber.StatusOK {
+			t.Errorf("Expected 200, got %d", code)
+		}
+	})
+
+	t.Run("Basic", func(t *testing.T) {
+		creds := base64.StdEncoding.EncodeToString([]byte(issued.Key + ":"))
+		if code := send("/orders", body, map[string]string{"Authorization": "Basic " + creds}); code != fiber.StatusOK {
+			t.Errorf("Expected 200, got %d", code)
+		}
+	})
+
+	t.Run("QueryDisabled", func(t *testing.T) {
+		if code := send("/orders?application_key="+issued.Key, body, nil); code != fiber.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 when query source is not configured, got %d", code)
+		}
+	})
+
+	t.Run("Signature", func(t *testing.T) {
+		if code := send("/orders?page=1", body, signed("/orders?page=1", body, time.Now())); code != fiber.StatusOK {
+			t.Errorf("Expected 200 for valid signature, got %d", code)
+		}
+	})
+
+	t.Run("TamperedBody", func(t *testing.T) {
+		headers := signed("/orders", body, time.Now())
+		if code := send("/orders", []byte(`{"item":"gold"}`), headers); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected 401 for tampered body, got %d", code)
+		}
+	})
+
+	t.Run("StoredHash", func(t *testing.T) {
+		// Whoever reads the key table must not be able to sign requests
+		now := time.Now()
+		secret, _ := hex.DecodeString(issued.Token.KeyHash)
+		bodyDigest := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("POST\n/orders\n" + hex.EncodeToString(bodyDigest[:]) + "\n" + strconv.FormatInt(now.Unix(), 10)))
+		headers := signed("/orders", body, now)
+		headers[guardrail.HeaderSignature] = hex.EncodeToString(mac.Sum(nil))
+		if code := send("/orders", body, headers); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected 401 for a signature made with the stored hash, got %d", code)
+		}
+	})
+
+	t.Run("StaleTimestamp", func(t *testing.T) {
+		stale := time.Now().Add(-10 * time.Minute)
+		if code := send("/orders", body, signed("/orders", body, stale)); code != fiber.StatusUnauthorized {
+			t.Errorf("Expected 401 for stale timestamp, got %d", code)
+		}
+	})
+}
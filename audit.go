@@ -0,0 +1,60 @@
+package guardrail
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditEvent describes a security-relevant action taken through GuardRail
+type AuditEvent struct {
+	Time     time.Time
+	Action   string
+	TenantID string
+	UserID   string
+	Reason   string
+	Metadata map[string]string
+}
+
+// Audit actions emitted by GuardRail
+const (
+	AuditTenantScopeBypass      = "tenant_scope.bypass"
+	AuditPasswordReset          = "password.reset"
+	AuditPasswordChanged        = "password.changed"
+	AuditEmailChanged           = "email.changed"
+	AuditEmailChangeUndone      = "email.change_undone"
+	AuditUsersImported          = "users.imported"
+	AuditAccountLocked          = "account.locked"
+	AuditAccountUnlocked        = "account.unlocked"
+	AuditMFAEnrolled            = "mfa.enrolled"
+	AuditMFADisabled            = "mfa.disabled"
+	AuditPasskeyAdded           = "passkey.added"
+	AuditPasskeyRemoved         = "passkey.removed"
+	AuditPasskeyCloned          = "passkey.cloned"
+	AuditRecoveryCodesGenerated = "recovery_codes.generated"
+	AuditRecoveryCodeUsed       = "recovery_code.used"
+)
+
+// audit hands an event to the configured AuditHook
+func (gr *GuardRail) audit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	gr.config.AuditHook(event)
+}
+
+// logAuditEvent is the default AuditHook
+func logAuditEvent(event AuditEvent) {
+	keys := make([]string, 0, len(event.Metadata))
+	for k := range event.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, k+"="+event.Metadata[k])
+	}
+	log.Printf("Audit: %s tenant=%q user=%q reason=%q %s", event.Action, event.TenantID, event.UserID, event.Reason, strings.Join(fields, " "))
+}
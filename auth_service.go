@@ -1,15 +1,12 @@
 package guardrail
 
 import (
-	"crypto/rand"
-	"crypto/subtle"
-	"encoding/base64"
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/argon2"
 	"gorm.io/gorm"
 )
 
@@ -26,11 +23,12 @@ func (gr *GuardRail) NewAuthService() *AuthService {
 // RegisterRequest represents a user registration request
 type RegisterRequest struct {
 	Email     string `json:"email" validate:"required,email"`
-	Password  string `json:"password" validate:"required,min=8"`
+	Password  string `json:"password" validate:"required"` // Checked against the tenant's PasswordPolicy
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
-	Role      string `json:"role"`      // Optional, defaults to "user"
 	TenantID  string `json:"tenant_id"` // Required if multi-tenant is enabled
+	// Client IP, set by the handler (e.g. c.IP()). Required for tenants with an IP allowlist.
+	IPAddress string `json:"-"`
 }
 
 // LoginRequest represents a user login request
@@ -38,33 +36,61 @@ type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
 	Role     string `json:"role"`      // Optional, for RBAC systems
-	TenantID string `json:"tenant_id"` // Required if multi-tenant is enabled
+	TenantID string `json:"tenant_id"` // Optional with global email uniqueness, defaults to the home tenant
+	// Client IP, set by the handler (e.g. c.IP()). Required for tenants with an IP allowlist.
+	IPAddress string `json:"-"`
+}
+
+// SwitchTenantRequest asks for tokens scoped to another tenant
+type SwitchTenantRequest struct {
+	// The current access token, e.g. from the Authorization header
+	AccessToken string `json:"-"`
+	TenantID    string `json:"tenant_id"`
+	// Client IP, set by the handler (e.g. c.IP()). Required for tenants with an IP allowlist.
+	IPAddress string `json:"-"`
 }
 
 // AuthResponse represents the response after login/registration
 type AuthResponse struct {
-	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	UserID       string    `json:"user_id"`
-	Role         string    `json:"role,omitempty"`
-	TenantID     string    `json:"tenant_id,omitempty"`
+	AccessToken  string         `json:"access_token"`
+	RefreshToken string         `json:"refresh_token"`
+	ExpiresAt    time.Time      `json:"expires_at"`
+	UserID       string         `json:"user_id"`
+	Role         string         `json:"role,omitempty"`
+	Roles        []string       `json:"roles,omitempty"`
+	TenantID     string         `json:"tenant_id,omitempty"`
+	Tenants      []TenantAccess `json:"tenants,omitempty"` // Tenants the user can switch to
+	// Set by Register instead of issuing tokens when RequireEmailVerification is on
+	EmailVerificationRequired bool `json:"email_verification_required,omitempty"`
+	// Set by Login instead of issuing tokens when the user has a second
+	// factor; pass MFAToken and a code to VerifyMFA
+	MFARequired bool        `json:"mfa_required,omitempty"`
+	MFAToken    string      `json:"mfa_token,omitempty"`
+	MFAMethods  []MFAMethod `json:"mfa_methods,omitempty"`
+	// Set along with MFARequired when the tenant requires MFA and the user
+	// has none yet; pass MFAToken to EnrollTOTPForLogin, then to VerifyMFA
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
 }
 
 // User represents a user in the database
 type User struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	Email     string    `gorm:"uniqueIndex;not null"`
-	Password  string    `gorm:"not null"` // Hashed password
-	Salt      string    `gorm:"not null"`
+	// The default is parenthesized so SQLite accepts it too
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:(gen_random_uuid())"`
+	Email     string    `gorm:"not null"` // Unique per EmailUniqueness scope, see migrateUserEmailIndex
+	Password  string    `gorm:"not null"` // PHC-format hash, see hashPassword
+	Salt      string    `gorm:"not null"` // Only set for hashes from before the PHC format
 	FirstName string
 	LastName  string
 	Role      string    `gorm:"default:'user'"`
 	TenantID  uuid.UUID `gorm:"type:uuid;index"`
 	IsActive  bool      `gorm:"default:true"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// When the user confirmed their email address, nil until then
+	EmailVerifiedAt *time.Time
+	// Incremented to revoke every token issued so far, see revokeSessions
+	SessionVersion int `gorm:"not null;default:0"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	DeletedAt      gorm.DeletedAt `gorm:"index"`
 }
 
 // TableName specifies the table name for User model
@@ -72,99 +98,358 @@ func (User) TableName() string {
 	return "users"
 }
 
-// Register creates a new user account
+// BeforeCreate assigns the user ID, also on databases without gen_random_uuid
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	return nil
+}
+
+// Register creates a new user account with the "user" role; anything more
+// is granted afterwards, e.g. with TenantService.UpdateMemberRoles. In
+// multi-tenant mode it only works for tenants that allow self-registration;
+// everyone else joins through an invitation, see InvitationService.
 func (as *AuthService) Register(req RegisterRequest) (*AuthResponse, error) {
 	// Validate tenant_id if multi-tenant is enabled
 	if as.gr.config.EnableMultiTenant && req.TenantID == "" {
 		return nil, fmt.Errorf("tenant_id is required")
 	}
 
-	// Set default role if not provided
-	if req.Role == "" {
-		req.Role = "user"
+	var tenantUUID uuid.UUID
+	if req.TenantID != "" {
+		var err error
+		tenantUUID, err = uuid.Parse(req.TenantID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenant_id: %w", err)
+		}
 	}
 
-	// Check if user already exists
-	var existingUser User
-	err := as.gr.db.Where("email = ?", req.Email).First(&existingUser).Error
-	if err == nil {
-		return nil, fmt.Errorf("user with this email already exists")
-	} else if err != gorm.ErrRecordNotFound {
-		return nil, fmt.Errorf("database error: %w", err)
+	if as.gr.config.EnableMultiTenant {
+		if err := as.gr.checkTenantActive(tenantUUID.String()); err != nil {
+			return nil, err
+		}
 	}
 
-	// Hash password
-	salt := generateSalt()
-	hashedPassword := hashPassword(req.Password, salt)
+	// Apply the tenant's registration and password rules
+	settings, err := as.gr.effectiveSettings(tenantUUID)
+	if err != nil {
+		return nil, err
+	}
+	if as.gr.config.EnableMultiTenant && !settings.AllowSelfRegistration {
+		return nil, ErrSelfRegistrationDisabled
+	}
+	if !settings.AllowsLoginMethod(LoginMethodPassword) {
+		return nil, ErrLoginMethodNotAllowed
+	}
+	if !settings.AllowsIP(req.IPAddress) {
+		return nil, ErrIPNotAllowed
+	}
+	if err := as.gr.checkPassword(settings.PasswordPolicy, User{Email: req.Email, FirstName: req.FirstName, LastName: req.LastName}, req.Password); err != nil {
+		return nil, err
+	}
+
+	// Check if user already exists within the uniqueness scope
+	taken, err := as.gr.emailTaken(as.gr.db, req.Email, tenantUUID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
 
 	// Create user
 	user := User{
-		ID:        uuid.New(),
 		Email:     req.Email,
-		Password:  hashedPassword,
-		Salt:      salt,
 		FirstName: req.FirstName,
 		LastName:  req.LastName,
-		Role:      req.Role,
-		IsActive:  true,
+		TenantID:  tenantUUID,
+	}
+	if err := as.gr.db.Transaction(func(tx *gorm.DB) error {
+		return as.createAccount(tx, &user, req.Password, []string{"user"})
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	if req.TenantID != "" {
-		tenantUUID, err := uuid.Parse(req.TenantID)
-		if err != nil {
-			return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	// The account exists either way; the user can ask for another email
+	if err := as.sendVerificationEmail(user); err != nil {
+		logNotifyError(err)
+	}
+	if as.gr.config.RequireEmailVerification {
+		response := &AuthResponse{UserID: user.ID.String(), Role: user.Role, EmailVerificationRequired: true}
+		if as.gr.config.EnableMultiTenant {
+			response.TenantID = tenantUUID.String()
 		}
-		user.TenantID = tenantUUID
+		return response, nil
 	}
 
-	// Save to database
-	if err := as.gr.db.Create(&user).Error; err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+	// The new user logs in like everyone else, e.g. enrolling a second
+	// factor first if the tenant requires one
+	return as.startSession(user, tenantUUID, LoginMethodPassword, req.IPAddress, "", []string{amrPassword})
+}
+
+// createAccount hashes the password and stores a new active user, along
+// with the membership of their home tenant in multi-tenant mode
+func (as *AuthService) createAccount(tx *gorm.DB, user *User, password string, roles []string) error {
+	hash, err := as.gr.hashPassword(password)
+	if err != nil {
+		return err
 	}
+	user.Password = hash
+	user.Salt = ""
+	return as.insertAccount(tx, user, roles)
+}
 
-	// Generate tokens
-	return as.generateAuthResponse(user)
+// insertAccount stores a new active user whose password hash is already set
+func (as *AuthService) insertAccount(tx *gorm.DB, user *User, roles []string) error {
+	user.ID = uuid.New()
+	user.Email = normalizeEmail(user.Email)
+	user.Role = primaryRole(roles)
+	user.IsActive = true
+
+	if err := tx.Create(user).Error; err != nil {
+		return err
+	}
+	if as.gr.config.EnableMultiTenant {
+		return tx.Create(&Membership{
+			UserID:   user.ID,
+			TenantID: user.TenantID,
+			Roles:    roles,
+			Status:   MembershipStatusActive,
+		}).Error
+	}
+	return nil
 }
 
-// Login authenticates a user and returns tokens
+// Login authenticates a user and returns tokens. In multi-tenant mode the
+// tokens are scoped to the requested tenant (or the user's home tenant) and
+// the response lists every tenant the user can switch to.
 func (as *AuthService) Login(req LoginRequest) (*AuthResponse, error) {
-	// Validate tenant_id if multi-tenant is enabled
-	if as.gr.config.EnableMultiTenant && req.TenantID == "" {
+	// Email alone only identifies a user when emails are globally unique
+	if as.gr.tenantScoped() && req.TenantID == "" {
 		return nil, fmt.Errorf("tenant_id is required")
 	}
 
-	// Find user by email
-	var user User
-	query := as.gr.db.Where("email = ? AND is_active = true", req.Email)
-
+	var tenantUUID uuid.UUID
 	if req.TenantID != "" {
-		tenantUUID, err := uuid.Parse(req.TenantID)
+		var err error
+		tenantUUID, err = uuid.Parse(req.TenantID)
 		if err != nil {
 			return nil, fmt.Errorf("invalid tenant_id: %w", err)
 		}
-		query = query.Where("tenant_id = ?", tenantUUID)
 	}
 
-	err := query.First(&user).Error
+	// Find user by email, within the requested tenant if emails are tenant-scoped
+	lookupTenant := uuid.Nil
+	if as.gr.tenantScoped() {
+		lookupTenant = tenantUUID
+	}
+	lockoutKey := accountLockoutKey(req.Email, lookupTenant)
+	if err := as.gr.checkLockout(lockoutKey, req.IPAddress); err != nil {
+		return nil, err
+	}
+	user, err := as.gr.userByEmail(as.gr.db.Where("is_active = true"), req.Email, lookupTenant)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
+			if err := as.gr.loginFailed(nil, lockoutKey, req.IPAddress); err != nil {
+				return nil, err
+			}
 			return nil, fmt.Errorf("invalid email or password")
 		}
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
-	// Verify password
-	if !verifyPassword(req.Password, user.Password, user.Salt) {
+	// Verify password, moving outdated hashes to the current parameters
+	ok, needsRehash := as.gr.verifyPassword(req.Password, user.Password, user.Salt)
+	if !ok {
+		if err := as.gr.loginFailed(user, lockoutKey, req.IPAddress); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("invalid email or password")
 	}
+	if err := as.gr.clearLoginFailures(lockoutKey); err != nil {
+		return nil, fmt.Errorf("failed to reset login failures: %w", err)
+	}
+	if needsRehash {
+		as.gr.upgradePasswordHash(user, req.Password)
+	}
 
-	// Check role if RBAC is enabled and role is specified
-	if as.gr.config.EnableRBAC && req.Role != "" && user.Role != req.Role {
+	if as.gr.config.EnableMultiTenant && tenantUUID == uuid.Nil {
+		tenantUUID = user.TenantID
+	}
+
+	response, err := as.startSession(*user, tenantUUID, LoginMethodPassword, req.IPAddress, req.Role, []string{amrPassword})
+	if err != nil {
+		return nil, err
+	}
+
+	// Check role if RBAC is enabled and role is specified; VerifyMFA does it
+	// after the second factor
+	if as.gr.config.EnableRBAC && req.Role != "" && !response.MFARequired && !containsString(response.Roles, req.Role) {
 		return nil, fmt.Errorf("invalid role for this user")
 	}
 
-	// Generate tokens
-	return as.generateAuthResponse(user)
+	return response, nil
+}
+
+// startSession applies the tenant's login rules to a user whose credentials
+// were just verified and issues tokens, or an MFA challenge if the user has a
+// second factor. The rules are only applied at this point so they reveal
+// nothing about which accounts exist. role is the role requested at login
+// and amr the authentication methods used so far.
+func (as *AuthService) startSession(user User, tenantID uuid.UUID, method LoginMethod, ip, role string, amr []string) (*AuthResponse, error) {
+	if as.gr.config.EnableMultiTenant {
+		if err := as.gr.checkTenantActive(tenantID.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := as.gr.effectiveSettings(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.AllowsLoginMethod(method) {
+		return nil, ErrLoginMethodNotAllowed
+	}
+	if !settings.AllowsIP(ip) {
+		return nil, ErrIPNotAllowed
+	}
+	if as.gr.config.RequireEmailVerification && user.EmailVerifiedAt == nil {
+		return nil, ErrEmailNotVerified
+	}
+
+	// A passkey that verified the user is already multi-factor
+	if !containsString(amr, amrMultiFactor) {
+		methods, err := as.gr.mfaMethods(user)
+		if err != nil {
+			return nil, err
+		}
+		if len(methods) > 0 || settings.RequireMFA {
+			return as.mfaChallenge(user, tenantID, role, amr, methods)
+		}
+	}
+
+	return as.issueSession(user, tenantID, time.Now(), amr)
+}
+
+// issueSession issues tokens for a session that started at authTime along
+// with the tenants the user can switch to. amr lists the authentication
+// methods used.
+func (as *AuthService) issueSession(user User, tenantID uuid.UUID, authTime time.Time, amr []string) (*AuthResponse, error) {
+	response, err := as.generateAuthResponse(user, tenantID, authTime, amr)
+	if err != nil {
+		return nil, err
+	}
+	if as.gr.config.EnableMultiTenant {
+		if response.Tenants, err = as.gr.availableTenants(user); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// SwitchTenant issues tokens scoped to another tenant the user belongs to.
+// The session carries over with its login time and methods, which have to
+// satisfy the login rules of the new tenant.
+func (as *AuthService) SwitchTenant(req SwitchTenantRequest) (*AuthResponse, error) {
+	if !as.gr.config.EnableMultiTenant {
+		return nil, fmt.Errorf("multi-tenant support is not enabled")
+	}
+
+	claims, err := as.gr.verifyJWT(req.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access token: %w", err)
+	}
+	if claims["type"] != "access" {
+		return nil, fmt.Errorf("invalid access token: wrong token type")
+	}
+	userID, _ := claims["user_id"].(string)
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id in token: %w", err)
+	}
+	tid, err := uuid.Parse(req.TenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	if err := as.gr.checkTenantActive(tid.String()); err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := as.gr.db.Where("id = ? AND is_active = true", uid).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("user not found or inactive: %w", err)
+	}
+
+	authTime, amr := sessionOrigin(claims)
+	settings, err := as.gr.effectiveSettings(tid)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.AllowsLoginMethod(loginMethodFor(amr)) {
+		return nil, ErrLoginMethodNotAllowed
+	}
+	if !settings.AllowsIP(req.IPAddress) {
+		return nil, ErrIPNotAllowed
+	}
+	if settings.RequireMFA && !containsString(amr, amrMultiFactor) {
+		return nil, ErrMFARequired
+	}
+
+	return as.issueSession(user, tid, authTime, amr)
+}
+
+// sessionOrigin returns when and how the session of a token logged in
+func sessionOrigin(claims jwt.MapClaims) (time.Time, []string) {
+	authTime := time.Now()
+	if at, ok := claims["auth_time"].(float64); ok {
+		authTime = time.Unix(int64(at), 0)
+	} else if iat, ok := claims["iat"].(float64); ok {
+		authTime = time.Unix(int64(iat), 0)
+	}
+
+	var amr []string
+	if list, ok := claims["amr"].([]interface{}); ok {
+		for _, m := range list {
+			if method, ok := m.(string); ok {
+				amr = append(amr, method)
+			}
+		}
+	}
+	return authTime, amr
+}
+
+type sessionContextKey struct{}
+
+// requestSession is the login behind the access token of a request
+type requestSession struct {
+	UserID   string
+	AuthTime time.Time
+	AMR      []string
+}
+
+// withSession returns a context carrying the login of an access token, so
+// sessions issued in its place keep its auth_time and amr
+func withSession(ctx context.Context, claims jwt.MapClaims) context.Context {
+	userID, _ := claims["user_id"].(string)
+	authTime, amr := sessionOrigin(claims)
+	return context.WithValue(ctx, sessionContextKey{}, requestSession{UserID: userID, AuthTime: authTime, AMR: amr})
+}
+
+// sessionFromContext returns the login set by withSession
+func sessionFromContext(ctx context.Context) (requestSession, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(requestSession)
+	return session, ok
+}
+
+// loginMethodFor returns the login method of a session from its first
+// factor. Sessions from before amr was recorded logged in with a password.
+func loginMethodFor(amr []string) LoginMethod {
+	if len(amr) > 0 && amr[0] == amrHardwareKey {
+		return LoginMethodPasskey
+	}
+	return LoginMethodPassword
 }
 
 // RefreshToken generates a new access token from a refresh token
@@ -175,6 +460,11 @@ func (as *AuthService) RefreshToken(refreshToken string) (*AuthResponse, error)
 		return nil, fmt.Errorf("invalid refresh token: %w", err)
 	}
 
+	// Access tokens cannot be exchanged for new tokens
+	if claims["type"] != "refresh" {
+		return nil, fmt.Errorf("invalid refresh token: wrong token type")
+	}
+
 	// Extract user_id from claims
 	userIDStr, ok := claims["user_id"].(string)
 	if !ok {
@@ -192,8 +482,19 @@ func (as *AuthService) RefreshToken(refreshToken string) (*AuthResponse, error)
 		return nil, fmt.Errorf("user not found or inactive: %w", err)
 	}
 
+	// Stay in the tenant the token was issued for; membership is checked again
+	tenantUUID := user.TenantID
+	if tenantID, ok := claims["tenant_id"].(string); ok && as.gr.config.EnableMultiTenant {
+		if tenantUUID, err = uuid.Parse(tenantID); err != nil {
+			return nil, fmt.Errorf("invalid tenant_id in token: %w", err)
+		}
+	}
+
+	// The session keeps the time and methods of the original login
+	authTime, amr := sessionOrigin(claims)
+
 	// Generate new tokens
-	return as.generateAuthResponse(user)
+	return as.generateAuthResponse(user, tenantUUID, authTime, amr)
 }
 
 // Logout invalidates a token by adding it to the blacklist
@@ -207,44 +508,88 @@ func (as *AuthService) Logout(token string) error {
 	return as.gr.redis.Set(ctx, "blacklist:"+token, "logged_out", 24*time.Hour).Err()
 }
 
-// generateAuthResponse creates tokens and returns auth response
-func (as *AuthService) generateAuthResponse(user User) (*AuthResponse, error) {
+// generateAuthResponse creates tokens scoped to a tenant and returns auth
+// response. In multi-tenant mode the user's roles come from their membership
+// in that tenant. authTime is when the user logged in; no token outlives the
+// session lifetime counted from it. amr lists the authentication methods
+// used at login, nil if unknown.
+func (as *AuthService) generateAuthResponse(user User, tenantID uuid.UUID, authTime time.Time, amr []string) (*AuthResponse, error) {
 	now := time.Now()
-	accessExpiry := now.Add(as.gr.config.AccessTokenExpiry)
-	refreshExpiry := now.Add(as.gr.config.RefreshTokenExpiry)
+	roles := []string{user.Role}
 
-	// Create access token claims
-	accessClaims := jwt.MapClaims{
-		"user_id": user.ID.String(),
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     accessExpiry.Unix(),
-		"iat":     now.Unix(),
-		"type":    "access",
+	settings, err := as.gr.effectiveSettings(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	var sessionEnd time.Time
+	if settings.SessionLifetime > 0 {
+		sessionEnd = authTime.Add(settings.SessionLifetime)
+		if !now.Before(sessionEnd) {
+			return nil, ErrSessionExpired
+		}
 	}
 
+	// Resolve tenant roles and overrides for lifetimes and signing keys
+	var tokenConfig *tenantTokenConfig
 	if as.gr.config.EnableMultiTenant {
-		accessClaims["tenant_id"] = user.TenantID.String()
+		var err error
+		if roles, err = as.gr.tenantRoles(user, tenantID); err != nil {
+			return nil, err
+		}
+		tokenConfig, err = as.gr.tenantTokenConfig(tenantID.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve tenant token settings: %w", err)
+		}
+	} else {
+		tokenConfig = &tenantTokenConfig{
+			AccessTokenExpiry:  as.gr.config.AccessTokenExpiry,
+			RefreshTokenExpiry: as.gr.config.RefreshTokenExpiry,
+		}
+	}
+
+	accessExpiry := clampExpiry(now.Add(tokenConfig.AccessTokenExpiry), sessionEnd)
+	refreshExpiry := clampExpiry(now.Add(tokenConfig.RefreshTokenExpiry), sessionEnd)
+
+	// Create access token claims
+	accessClaims := jwt.MapClaims{
+		"user_id":   user.ID.String(),
+		"email":     user.Email,
+		"role":      primaryRole(roles),
+		"roles":     roles,
+		"exp":       accessExpiry.Unix(),
+		"iat":       now.Unix(),
+		"auth_time": authTime.Unix(),
+		"sv":        user.SessionVersion,
+		"type":      "access",
 	}
 
 	// Create refresh token claims
 	refreshClaims := jwt.MapClaims{
-		"user_id": user.ID.String(),
-		"exp":     refreshExpiry.Unix(),
-		"iat":     now.Unix(),
-		"type":    "refresh",
+		"user_id":   user.ID.String(),
+		"exp":       refreshExpiry.Unix(),
+		"iat":       now.Unix(),
+		"auth_time": authTime.Unix(),
+		"sv":        user.SessionVersion,
+		"type":      "refresh",
 	}
 
-	// Generate tokens
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
+	if as.gr.config.EnableMultiTenant {
+		accessClaims["tenant_id"] = tenantID.String()
+		refreshClaims["tenant_id"] = tenantID.String()
+	}
+	if len(amr) > 0 {
+		accessClaims["amr"] = amr
+		accessClaims["acr"] = acrFor(amr)
+		refreshClaims["amr"] = amr
+	}
 
-	accessTokenString, err := accessToken.SignedString(as.gr.jwtSecret)
+	// Generate tokens
+	accessTokenString, err := as.gr.signToken(accessClaims, tokenConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign access token: %w", err)
 	}
 
-	refreshTokenString, err := refreshToken.SignedString(as.gr.jwtSecret)
+	refreshTokenString, err := as.gr.signToken(refreshClaims, tokenConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
 	}
@@ -254,34 +599,38 @@ func (as *AuthService) generateAuthResponse(user User) (*AuthResponse, error) {
 		RefreshToken: refreshTokenString,
 		ExpiresAt:    accessExpiry,
 		UserID:       user.ID.String(),
-		Role:         user.Role,
+		Role:         primaryRole(roles),
+		Roles:        roles,
 	}
 
 	if as.gr.config.EnableMultiTenant {
-		response.TenantID = user.TenantID.String()
+		response.TenantID = tenantID.String()
 	}
 
 	return response, nil
 }
 
-// Password hashing functions using Argon2
-const (
-	saltLength = 16
-)
-
-func generateSalt() string {
-	salt := make([]byte, saltLength)
-	rand.Read(salt)
-	return base64.RawStdEncoding.EncodeToString(salt)
+// clampExpiry caps a token expiry at the end of the session, if there is one
+func clampExpiry(expiry, sessionEnd time.Time) time.Time {
+	if !sessionEnd.IsZero() && sessionEnd.Before(expiry) {
+		return sessionEnd
+	}
+	return expiry
 }
 
-func hashPassword(password, salt string) string {
-	saltBytes, _ := base64.RawStdEncoding.DecodeString(salt)
-	hash := argon2.IDKey([]byte(password), saltBytes, 1, 64*1024, 4, 32)
-	return base64.RawStdEncoding.EncodeToString(hash)
+// primaryRole returns the first role, which is what the single "role" claim carries
+func primaryRole(roles []string) string {
+	if len(roles) == 0 {
+		return ""
+	}
+	return roles[0]
 }
 
-func verifyPassword(password, hashedPassword, salt string) bool {
-	newHash := hashPassword(password, salt)
-	return subtle.ConstantTimeCompare([]byte(newHash), []byte(hashedPassword)) == 1
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
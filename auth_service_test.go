@@ -0,0 +1,118 @@
+package guardrail_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestEmailUniquenessScope(t *testing.T) {
+	t.Run("Global", func(t *testing.T) {
+		gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+		ts := gr.NewTenantService()
+		as := gr.NewAuthService()
+
+		tenantA, _ := ts.CreateTenant("A")
+		tenantB, _ := ts.CreateTenant("B")
+
+		if _, err := as.Register(guardrail.RegisterRequest{Email: "Same@Example.test", Password: "correct-horse-battery", TenantID: tenantA.ID.String()}); err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+		if _, err := as.Register(guardrail.RegisterRequest{Email: "same@example.test", Password: "correct-horse-battery", TenantID: tenantB.ID.String()}); err == nil {
+			t.Error("Expected duplicate email to be rejected across tenants in global scope")
+		}
+	})
+
+	t.Run("Tenant", func(t *testing.T) {
+		gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true, EmailUniqueness: guardrail.EmailScopeTenant})
+		ts := gr.NewTenantService()
+		as := gr.NewAuthService()
+
+		tenantA, _ := ts.CreateTenant("A")
+		tenantB, _ := ts.CreateTenant("B")
+
+		for _, tenant := range []*guardrail.Tenant{tenantA, tenantB} {
+			if _, err := as.Register(guardrail.RegisterRequest{Email: "same@example.test", Password: "password-" + tenant.Name, TenantID: tenant.ID.String()}); err != nil {
+				t.Fatalf("Register in tenant %s failed: %v", tenant.Name, err)
+			}
+		}
+		if _, err := as.Register(guardrail.RegisterRequest{Email: "SAME@example.test", Password: "password-x", TenantID: tenantA.ID.String()}); err == nil {
+			t.Error("Expected duplicate email within a tenant to be rejected")
+		}
+
+		// Each tenant's account has its own password
+		respA, err := as.Login(guardrail.LoginRequest{Email: "same@example.test", Password: "password-A", TenantID: tenantA.ID.String()})
+		if err != nil {
+			t.Fatalf("Login to tenant A failed: %v", err)
+		}
+		if _, err := as.Login(guardrail.LoginRequest{Email: "same@example.test", Password: "password-A", TenantID: tenantB.ID.String()}); err == nil {
+			t.Error("Expected tenant A password to fail for tenant B account")
+		}
+
+		refreshed, err := as.RefreshToken(respA.RefreshToken)
+		if err != nil {
+			t.Fatalf("RefreshToken failed: %v", err)
+		}
+		if refreshed.TenantID != tenantA.ID.String() || refreshed.UserID != respA.UserID {
+			t.Errorf("Expected refresh to stay on tenant A account, got %+v", refreshed)
+		}
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		_, db := newTestGuardRail(t, guardrail.Config{})
+		_, err := guardrail.New(guardrail.Config{DB: db, JWTSecret: "x", EmailUniqueness: guardrail.EmailScopeTenant})
+		if err == nil {
+			t.Error("Expected error for tenant scope without multi-tenant")
+		}
+	})
+}
+
+func TestRefreshTokenRejectsAccessToken(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{})
+	as := gr.NewAuthService()
+
+	resp, err := as.Register(guardrail.RegisterRequest{Email: "user@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := as.RefreshToken(resp.AccessToken); err == nil {
+		t.Error("Expected access token to be rejected by RefreshToken")
+	}
+}
+
+func TestRegisterIgnoresRequestedRole(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true, EnableRBAC: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+	tenant, _ := ts.CreateTenant("Acme")
+
+	var req guardrail.RegisterRequest
+	body := `{"email": "mallory@example.test", "password": "correct-horse-battery", "role": "admin", "tenant_id": "` + tenant.ID.String() + `"}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := as.Register(req)
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if resp.Role != "user" || len(resp.Roles) != 1 || resp.Roles[0] != "user" {
+		t.Errorf("Expected the user role, got %q %v", resp.Role, resp.Roles)
+	}
+	members, _ := ts.ListMembers(tenant.ID.String())
+	if len(members) != 1 || len(members[0].Roles) != 1 || members[0].Roles[0] != "user" {
+		t.Errorf("Expected a user membership, got %+v", members)
+	}
+}
+
+func TestEmailIndexMigrationRejectsDuplicates(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{})
+
+	db.Exec("DROP INDEX idx_users_email")
+	db.Exec("INSERT INTO users (id, email, password, salt) VALUES ('a6a3e2a4-3c0e-4c53-8a53-0d8d1d1a0001', 'dup@example.test', 'x', 'x')")
+	db.Exec("INSERT INTO users (id, email, password, salt) VALUES ('a6a3e2a4-3c0e-4c53-8a53-0d8d1d1a0002', 'DUP@example.test', 'x', 'x')")
+
+	if err := gr.AutoMigrate(); err == nil {
+		t.Error("Expected migration to fail on case-insensitive duplicate emails")
+	}
+}
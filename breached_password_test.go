@@ -0,0 +1,69 @@
+package guardrail_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestBloomFilter(t *testing.T) {
+	breached := []string{"hunter2-hunter2", "correct-horse-battery", "monkey-business-42"}
+
+	var list strings.Builder
+	list.WriteString("# sha1:count\n")
+	for i, password := range breached {
+		sum := sha1.Sum([]byte(password))
+		fmt.Fprintf(&list, "%s:%d\n", strings.ToUpper(hex.EncodeToString(sum[:])), i+1)
+	}
+
+	filter := guardrail.NewBloomFilter(uint64(len(breached)), 0.001)
+	if n, err := filter.AddHashes(strings.NewReader(list.String())); err != nil || n != len(breached) {
+		t.Fatalf("AddHashes = %d, %v", n, err)
+	}
+	if _, err := filter.AddHashes(strings.NewReader("not-a-hash\n")); err == nil {
+		t.Error("Expected malformed line to be rejected")
+	}
+
+	// Survives a round trip through the file format
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	loaded, err := guardrail.ReadBloomFilter(&buf)
+	if err != nil {
+		t.Fatalf("ReadBloomFilter failed: %v", err)
+	}
+	for _, password := range breached {
+		if ok, _ := loaded.IsBreached(context.Background(), password); !ok {
+			t.Errorf("Expected %q to be breached", password)
+		}
+	}
+	if ok, _ := loaded.IsBreached(context.Background(), "violet-tundra-47-kayak"); ok {
+		t.Error("Expected unlisted password to pass")
+	}
+	if _, err := guardrail.ReadBloomFilter(strings.NewReader("garbage")); !errors.Is(err, guardrail.ErrInvalidBloomFilter) {
+		t.Errorf("Expected ErrInvalidBloomFilter, got %v", err)
+	}
+}
+
+func TestBreachedPasswordsRejected(t *testing.T) {
+	filter := guardrail.NewBloomFilter(10, 0.001)
+	filter.Add("correct-horse-battery")
+	gr, _ := newTestGuardRail(t, guardrail.Config{BreachedPasswords: filter})
+	as := gr.NewAuthService()
+
+	_, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if rules := violatedRules(t, err); len(rules) != 1 || rules[0] != "breached" {
+		t.Errorf("Expected breached violation, got %v", rules)
+	}
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "violet-tundra-47-kayak"}); err != nil {
+		t.Errorf("Register failed: %v", err)
+	}
+}
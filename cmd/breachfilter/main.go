@@ -0,0 +1,79 @@
+// Command breachfilter builds the Bloom filter used by
+// guardrail.BloomFilter from a list of SHA-1 password hashes, one per line,
+// optionally followed by ":count" (the Pwned Passwords download format).
+//
+// Usage:
+//
+//	breachfilter -in pwned-passwords-sha1.txt -out breached.bloom -fp 0.001
+//
+// Load the result with guardrail.LoadBloomFilter and set it as
+// Config.BreachedPasswords.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func main() {
+	in := flag.String("in", "", "file with one SHA-1 hash per line (required)")
+	out := flag.String("out", "breached.bloom", "output filter file")
+	fp := flag.Float64("fp", 0.001, "false positive rate")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Size the filter with a first pass over the input
+	n, err := countLines(*in)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", *in, err)
+	}
+
+	filter := guardrail.NewBloomFilter(n, *fp)
+	file, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", *in, err)
+	}
+	defer file.Close()
+	added, err := filter.AddHashes(file)
+	if err != nil {
+		log.Fatalf("Failed to read hashes: %v", err)
+	}
+
+	output, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+	size, err := filter.WriteTo(output)
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+
+	fmt.Printf("Wrote %d hashes to %s (%d bytes, %.4f%% false positives)\n", added, *out, size, *fp*100)
+}
+
+func countLines(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var n uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+	}
+	return n, scanner.Err()
+}
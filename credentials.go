@@ -0,0 +1,282 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Token purposes of the email change flow
+const (
+	emailChangeTokenPurpose     = "email_change"
+	emailChangeUndoTokenPurpose = "email_change_undo"
+)
+
+var (
+	// ErrInvalidCurrentPassword is returned when a credential change is not
+	// confirmed with the right current password
+	ErrInvalidCurrentPassword = errors.New("current password is incorrect")
+	// ErrInvalidEmailChangeToken is returned for unknown, expired or used email change and undo tokens
+	ErrInvalidEmailChangeToken = errors.New("email change link is invalid or has expired")
+)
+
+// ChangePassword replaces the password of a signed-in user after checking
+// the current one. Every other session is signed out; the returned tokens
+// replace the caller's, scoped to the tenant bound to ctx (e.g.
+// c.UserContext()) or the user's home tenant. They keep the auth_time and
+// amr of the token on ctx, so an MFA session stays one and SessionLifetime
+// still counts from its login.
+func (as *AuthService) ChangePassword(ctx context.Context, userID, currentPassword, newPassword string) (*AuthResponse, error) {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return nil, err
+	}
+	tenantID, err := as.contextTenant(ctx, *user)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := as.gr.effectiveSettings(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := as.gr.checkPassword(settings.PasswordPolicy, *user, newPassword); err != nil {
+		return nil, err
+	}
+
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := as.setPassword(tx, user, newPassword, settings.PasswordPolicy.HistorySize); err != nil {
+			return err
+		}
+		return as.gr.revokeSessions(tx, user)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to change password: %w", err)
+	}
+	as.gr.forgetSessionVersion(user.ID)
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditPasswordChanged,
+		TenantID: tenantID.String(),
+		UserID:   user.ID.String(),
+	})
+	as.notifyPasswordChanged(*user)
+
+	// The caller's session goes on with the login it came from; without one
+	// the user logs in again, which asks MFA users for their second factor
+	if session, ok := sessionFromContext(ctx); ok && session.UserID == user.ID.String() {
+		return as.issueSession(*user, tenantID, session.AuthTime, session.AMR)
+	}
+	return as.startSession(*user, tenantID, LoginMethodPassword, "", "", []string{amrPassword})
+}
+
+// ChangeEmail starts moving a signed-in user to a new email address. Nothing
+// changes until the link sent to the new address is opened, see
+// ConfirmEmailChange.
+func (as *AuthService) ChangeEmail(ctx context.Context, userID, currentPassword, newEmail string) error {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	email := normalizeEmail(newEmail)
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("a valid email is required")
+	}
+	if email == user.Email {
+		return nil
+	}
+	if taken, err := as.gr.emailTaken(as.gr.db, email, user.TenantID); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	} else if taken {
+		return ErrEmailTaken
+	}
+
+	token, record, err := as.gr.issueUserToken(as.gr.db, *user, email, emailChangeTokenPurpose, as.gr.config.EmailVerificationExpiry)
+	if err != nil {
+		return fmt.Errorf("failed to issue email change token: %w", err)
+	}
+	err = as.gr.config.Notifier.Notify(ctx, Notification{
+		Type:     NotificationEmailChange,
+		To:       email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Token:    token,
+		Data: map[string]string{
+			"first_name": user.FirstName,
+			"old_email":  user.Email,
+			"expires_at": record.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send email change confirmation: %w", err)
+	}
+	return nil
+}
+
+// ConfirmEmailChange moves the user to the address the token was sent to,
+// which counts as verified. The old address gets a link to undo the change
+// for Config.EmailChangeUndoExpiry, see UndoEmailChange.
+func (as *AuthService) ConfirmEmailChange(token string) error {
+	var user User
+	var oldEmail string
+	err := as.gr.db.Transaction(func(tx *gorm.DB) error {
+		record, err := as.gr.consumeUserToken(tx, emailChangeTokenPurpose, token)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND is_active = true", record.UserID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInvalidUserToken
+			}
+			return err
+		}
+
+		oldEmail = user.Email
+		return as.moveEmail(tx, &user, record.Email)
+	})
+	if errors.Is(err, errInvalidUserToken) {
+		return ErrInvalidEmailChangeToken
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change email: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditEmailChanged,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"old_email": oldEmail, "new_email": user.Email},
+	})
+
+	// The change already happened; a failed undo email only loses the safety net
+	undo, record, err := as.gr.issueUserToken(as.gr.db, user, oldEmail, emailChangeUndoTokenPurpose, as.gr.config.EmailChangeUndoExpiry)
+	if err != nil {
+		logNotifyError(err)
+		return nil
+	}
+	err = as.gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationEmailChanged,
+		To:       oldEmail,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Token:    undo,
+		Data: map[string]string{
+			"first_name": user.FirstName,
+			"new_email":  user.Email,
+			"expires_at": record.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		logNotifyError(err)
+	}
+	return nil
+}
+
+// UndoEmailChange restores the address the undo link was sent to. Someone
+// else changing the email suggests the account was taken over, so every
+// session is signed out and pending email changes are dropped; follow up
+// with a password reset.
+func (as *AuthService) UndoEmailChange(token string) error {
+	var user User
+	err := as.gr.db.Transaction(func(tx *gorm.DB) error {
+		record, err := as.gr.consumeUserToken(tx, emailChangeUndoTokenPurpose, token)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", record.UserID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInvalidUserToken
+			}
+			return err
+		}
+
+		if err := as.moveEmail(tx, &user, record.Email); err != nil {
+			return err
+		}
+		if err := as.gr.voidUserTokens(tx, user.ID, emailChangeTokenPurpose); err != nil {
+			return err
+		}
+		return as.gr.revokeSessions(tx, &user)
+	})
+	if errors.Is(err, errInvalidUserToken) {
+		return ErrInvalidEmailChangeToken
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to undo email change: %w", err)
+	}
+	as.gr.forgetSessionVersion(user.ID)
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditEmailChangeUndone,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"email": user.Email},
+	})
+	return nil
+}
+
+// moveEmail sets a user's email, which must still be free, as verified
+func (as *AuthService) moveEmail(tx *gorm.DB, user *User, email string) error {
+	var count int64
+	query := tx.Model(&User{}).Where("email = ? AND id <> ?", email, user.ID)
+	if as.gr.tenantScoped() {
+		query = query.Where("tenant_id = ?", user.TenantID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrEmailTaken
+	}
+
+	now := time.Now()
+	user.Email = email
+	user.EmailVerifiedAt = &now
+	return tx.Model(user).Select("email", "email_verified_at").Updates(user).Error
+}
+
+// credentialOwner loads an active user and checks their current password,
+// subject to the login lockout
+func (as *AuthService) credentialOwner(userID, currentPassword string) (*User, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+
+	var user User
+	if err := as.gr.db.Where("id = ? AND is_active = true", uid).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("user not found or inactive: %w", err)
+	}
+	ok, err := as.gr.checkUserPassword(&user, currentPassword, "")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCurrentPassword
+	}
+	return &user, nil
+}
+
+// contextTenant returns the tenant bound to ctx, defaulting to the user's home tenant
+func (as *AuthService) contextTenant(ctx context.Context, user User) (uuid.UUID, error) {
+	if tenantID, ok := TenantFromContext(ctx); ok && as.gr.config.EnableMultiTenant {
+		id, err := uuid.Parse(tenantID)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("invalid tenant_id: %w", err)
+		}
+		return id, nil
+	}
+	return user.TenantID, nil
+}
@@ -0,0 +1,157 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestChangePassword(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{})
+	as := gr.NewAuthService()
+
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+	current, _ := as.Login(login)
+	other, _ := as.Login(login)
+
+	if _, err := as.ChangePassword(context.Background(), current.UserID, "wrong-password", "a-brand-new-password"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	var policyErr *guardrail.PasswordPolicyError
+	if _, err := as.ChangePassword(context.Background(), current.UserID, "correct-horse-battery", "short"); !errors.As(err, &policyErr) {
+		t.Errorf("Expected PasswordPolicyError, got %v", err)
+	}
+
+	resp, err := as.ChangePassword(context.Background(), current.UserID, "correct-horse-battery", "a-brand-new-password")
+	if err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if _, err := as.RefreshToken(other.RefreshToken); err == nil {
+		t.Error("Expected other sessions to be revoked")
+	}
+	if _, err := as.RefreshToken(resp.RefreshToken); err != nil {
+		t.Errorf("Expected the returned session to stay valid, got %v", err)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "a-brand-new-password"}); err != nil {
+		t.Errorf("Login with new password failed: %v", err)
+	}
+}
+
+func TestChangePasswordKeepsSession(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{})
+	as := gr.NewAuthService()
+	user, _ := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	enrollment, _ := as.EnrollTOTP(user.UserID, "correct-horse-battery")
+	if err := as.ConfirmTOTP(user.UserID, totpCode(t, enrollment.Secret, time.Now())); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+	challenge, _ := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	session, err := as.VerifyMFA(guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Code: totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second))})
+	if err != nil {
+		t.Fatalf("VerifyMFA failed: %v", err)
+	}
+
+	var changed *guardrail.AuthResponse
+	app := fiber.New()
+	app.Post("/password", gr.Protect(), func(c *fiber.Ctx) error {
+		userID, _ := guardrail.GetUserID(c)
+		resp, err := as.ChangePassword(c.UserContext(), userID, "correct-horse-battery", "a-brand-new-password")
+		if err != nil {
+			return err
+		}
+		changed = resp
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	req := httptest.NewRequest("POST", "/password", nil)
+	req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", resp.StatusCode)
+	}
+
+	// The new tokens continue the MFA login instead of starting a weaker one
+	original, replaced := tokenClaims(t, session.AccessToken), tokenClaims(t, changed.AccessToken)
+	if replaced["auth_time"] != original["auth_time"] || fmt.Sprint(replaced["amr"]) != fmt.Sprint(original["amr"]) || replaced["acr"] != "aal2" {
+		t.Errorf("Expected the session to carry over, got %v from %v", replaced, original)
+	}
+
+	// Without a session on ctx the user logs in again, second factor included
+	resp, err := as.ChangePassword(context.Background(), user.UserID, "a-brand-new-password", "another-new-password")
+	if err != nil || !resp.MFARequired || resp.AccessToken != "" {
+		t.Errorf("Expected an MFA challenge, got %+v, %v", resp, err)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	var sent []guardrail.Notification
+	gr, db := newTestGuardRail(t, guardrail.Config{
+		Notifier: guardrail.NotifierFunc(func(ctx context.Context, n guardrail.Notification) error {
+			sent = append(sent, n)
+			return nil
+		}),
+	})
+	as := gr.NewAuthService()
+	ctx := context.Background()
+
+	ada, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "bob@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	sent = nil
+
+	if err := as.ChangeEmail(ctx, ada.UserID, "wrong-password", "ada@new.test"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	if err := as.ChangeEmail(ctx, ada.UserID, "correct-horse-battery", "Bob@Example.test"); !errors.Is(err, guardrail.ErrEmailTaken) {
+		t.Errorf("Expected ErrEmailTaken, got %v", err)
+	}
+
+	// Nothing changes until the new address confirms
+	if err := as.ChangeEmail(ctx, ada.UserID, "correct-horse-battery", "Ada@New.test"); err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if len(sent) != 1 || sent[0].Type != guardrail.NotificationEmailChange || sent[0].To != "ada@new.test" {
+		t.Fatalf("Expected confirmation to the new address, got %+v", sent)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Errorf("Expected old address to work before confirmation, got %v", err)
+	}
+	if err := as.ConfirmEmailChange(sent[0].Token); err != nil {
+		t.Fatalf("ConfirmEmailChange failed: %v", err)
+	}
+	if err := as.ConfirmEmailChange(sent[0].Token); !errors.Is(err, guardrail.ErrInvalidEmailChangeToken) {
+		t.Errorf("Expected used token to be rejected, got %v", err)
+	}
+	session, err := as.Login(guardrail.LoginRequest{Email: "ada@new.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Expected login with the new address, got %v", err)
+	}
+
+	// The old address can take the account back
+	undo := sent[len(sent)-1]
+	if undo.Type != guardrail.NotificationEmailChanged || undo.To != "ada@example.test" || undo.Data["new_email"] != "ada@new.test" {
+		t.Fatalf("Expected undo link to the old address, got %+v", undo)
+	}
+	if err := as.UndoEmailChange(undo.Token); err != nil {
+		t.Fatalf("UndoEmailChange failed: %v", err)
+	}
+	var user guardrail.User
+	db.Where("id = ?", ada.UserID).First(&user)
+	if user.Email != "ada@example.test" {
+		t.Errorf("Expected email to be restored, got %s", user.Email)
+	}
+	if _, err := as.RefreshToken(session.RefreshToken); err == nil {
+		t.Error("Expected sessions to be revoked by the undo")
+	}
+}
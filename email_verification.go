@@ -0,0 +1,131 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// emailVerificationTokenPurpose binds verification tokens to this flow
+const emailVerificationTokenPurpose = "email_verification"
+
+var (
+	// ErrEmailNotVerified is returned by Login when RequireEmailVerification
+	// is set and the user has not confirmed their address yet
+	ErrEmailNotVerified = errors.New("email address has not been verified")
+	// ErrInvalidVerificationToken is returned for unknown, expired or used verification tokens
+	ErrInvalidVerificationToken = errors.New("verification link is invalid or has expired")
+)
+
+// VerifyEmail confirms a user's email address with the token from their
+// verification email. Each token works once, and only for the address it was
+// sent to.
+func (as *AuthService) VerifyEmail(token string) error {
+	return as.gr.db.Transaction(func(tx *gorm.DB) error {
+		record, err := as.gr.consumeUserToken(tx, emailVerificationTokenPurpose, token)
+		if errors.Is(err, errInvalidUserToken) {
+			return ErrInvalidVerificationToken
+		}
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+
+		res := tx.Model(&User{}).
+			Where("id = ? AND email = ? AND email_verified_at IS NULL", record.UserID, record.Email).
+			Update("email_verified_at", time.Now())
+		if res.Error != nil {
+			return fmt.Errorf("database error: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidVerificationToken
+		}
+		return nil
+	})
+}
+
+// ResendVerificationEmail sends a new verification email, voiding earlier
+// ones. It reports success for unknown and already verified addresses, and
+// silently skips requests within Config.EmailResendInterval of
+// the last email, so it reveals nothing about which accounts exist.
+func (as *AuthService) ResendVerificationEmail(email, tenantID string) error {
+	if as.gr.tenantScoped() && tenantID == "" {
+		return fmt.Errorf("tenant_id is required")
+	}
+	var tenantUUID uuid.UUID
+	if tenantID != "" {
+		var err error
+		if tenantUUID, err = uuid.Parse(tenantID); err != nil {
+			return fmt.Errorf("invalid tenant_id: %w", err)
+		}
+	}
+
+	lookupTenant := uuid.Nil
+	if as.gr.tenantScoped() {
+		lookupTenant = tenantUUID
+	}
+	user, err := as.gr.userByEmail(as.gr.db.Where("is_active = true"), email, lookupTenant)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+
+	if recent, err := as.gr.recentlyIssued(user.ID, emailVerificationTokenPurpose); err != nil || recent {
+		return err
+	}
+
+	return as.sendVerificationEmail(*user)
+}
+
+// sendVerificationEmail issues a verification token and notifies the user
+func (as *AuthService) sendVerificationEmail(user User) error {
+	token, record, err := as.gr.issueUserToken(as.gr.db, user, user.Email, emailVerificationTokenPurpose, as.gr.config.EmailVerificationExpiry)
+	if err != nil {
+		return fmt.Errorf("failed to issue verification token: %w", err)
+	}
+
+	err = as.gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationEmailVerification,
+		To:       user.Email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Token:    token,
+		Data: map[string]string{
+			"first_name": user.FirstName,
+			"expires_at": record.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send verification email: %w", err)
+	}
+	return nil
+}
+
+// needsEmailVerificationBackfill reports whether the users table predates
+// email verification. Check it before AutoMigrate adds the column.
+func needsEmailVerificationBackfill(db *gorm.DB) bool {
+	m := db.Migrator()
+	return m.HasTable(&User{}) && !m.HasColumn(&User{}, "EmailVerifiedAt")
+}
+
+// backfillEmailVerified marks users that existed before email verification
+// was introduced as verified, so turning on RequireEmailVerification does not
+// lock them out
+func backfillEmailVerified(db *gorm.DB) error {
+	return db.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error
+}
+
+// logNotifyError reports a notification that could not be delivered after
+// the action it belongs to already succeeded
+func logNotifyError(err error) {
+	log.Printf("GuardRail notification failed: %v", err)
+}
@@ -0,0 +1,116 @@
+package guardrail_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+// linkToken extracts the token from a link in an email body
+func linkToken(t *testing.T, email guardrail.Email) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(email.Body, "token=")
+	if !ok {
+		t.Fatalf("No link in email: %q", email.Body)
+	}
+	token, _, _ := strings.Cut(rest, "\n")
+	return token
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := guardrail.NewMemoryMailer()
+	gr, db := newTestGuardRail(t, guardrail.Config{
+		RequireEmailVerification: true,
+		Notifier: &guardrail.MailNotifier{
+			Mailer: mailer,
+			From:   "noreply@example.test",
+			Links:  map[guardrail.NotificationType]string{guardrail.NotificationEmailVerification: "https://app.test/verify?token={token}"},
+		},
+	})
+	as := gr.NewAuthService()
+
+	resp, err := as.Register(guardrail.RegisterRequest{Email: "Ada@Example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if !resp.EmailVerificationRequired || resp.AccessToken != "" {
+		t.Errorf("Expected no tokens before verification, got %+v", resp)
+	}
+	email, ok := mailer.Last("ada@example.test")
+	if !ok || email.From != "noreply@example.test" || email.Subject != "Confirm your email address" {
+		t.Fatalf("Expected verification email, got %+v", mailer.Sent())
+	}
+	first := linkToken(t, email)
+
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+	if _, err := as.Login(login); !errors.Is(err, guardrail.ErrEmailNotVerified) {
+		t.Errorf("Expected ErrEmailNotVerified, got %v", err)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "wrong-password"}); errors.Is(err, guardrail.ErrEmailNotVerified) {
+		t.Error("Expected a wrong password not to reveal the verification state")
+	}
+
+	// Resends are throttled and unknown addresses look the same
+	if err := as.ResendVerificationEmail("ada@example.test", ""); err != nil {
+		t.Fatalf("ResendVerificationEmail failed: %v", err)
+	}
+	if err := as.ResendVerificationEmail("nobody@example.test", ""); err != nil {
+		t.Errorf("Expected unknown address to be accepted silently, got %v", err)
+	}
+	if n := len(mailer.Sent()); n != 1 {
+		t.Fatalf("Expected throttled resend, got %d emails", n)
+	}
+
+	// A resend voids the earlier link
+	db.Model(&guardrail.UserToken{}).Where("1 = 1").Update("created_at", time.Now().Add(-time.Hour))
+	if err := as.ResendVerificationEmail("ada@example.test", ""); err != nil {
+		t.Fatalf("ResendVerificationEmail failed: %v", err)
+	}
+	email, _ = mailer.Last("ada@example.test")
+	second := linkToken(t, email)
+	if err := as.VerifyEmail(first); !errors.Is(err, guardrail.ErrInvalidVerificationToken) {
+		t.Errorf("Expected voided token to be rejected, got %v", err)
+	}
+	if err := as.VerifyEmail(second + "x"); !errors.Is(err, guardrail.ErrInvalidVerificationToken) {
+		t.Errorf("Expected tampered token to be rejected, got %v", err)
+	}
+	if err := as.VerifyEmail(second); err != nil {
+		t.Fatalf("VerifyEmail failed: %v", err)
+	}
+	if err := as.VerifyEmail(second); !errors.Is(err, guardrail.ErrInvalidVerificationToken) {
+		t.Errorf("Expected used token to be rejected, got %v", err)
+	}
+
+	if _, err := as.Login(login); err != nil {
+		t.Errorf("Expected login after verification, got %v", err)
+	}
+	var user guardrail.User
+	db.Where("email = ?", "ada@example.test").First(&user)
+	if user.EmailVerifiedAt == nil {
+		t.Error("Expected EmailVerifiedAt to be set")
+	}
+}
+
+func TestEmailVerificationBackfill(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{})
+	if _, err := gr.NewAuthService().Register(guardrail.RegisterRequest{Email: "old@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// Existing users count as verified once the column is introduced
+	if err := db.Migrator().DropColumn(&guardrail.User{}, "EmailVerifiedAt"); err != nil {
+		t.Fatalf("DropColumn failed: %v", err)
+	}
+	if err := gr.AutoMigrate(); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+
+	var user guardrail.User
+	db.Where("email = ?", "old@example.test").First(&user)
+	if user.EmailVerifiedAt == nil {
+		t.Error("Expected existing user to be marked verified")
+	}
+}
@@ -0,0 +1,82 @@
+package guardrail
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedSecretPrefix versions the format of encrypted secrets
+const encryptedSecretPrefix = "v1:"
+
+// errUndecryptableSecret is returned for secrets that fail authentication,
+// e.g. after EncryptionKey changed
+var errUndecryptableSecret = errors.New("secret cannot be decrypted")
+
+// secretCipher returns the AEAD used for secrets at rest. The key is derived
+// from Config.EncryptionKey, or the JWT secret without one.
+func (gr *GuardRail) secretCipher() (cipher.AEAD, error) {
+	master := []byte(gr.config.EncryptionKey)
+	if len(master) == 0 {
+		master = gr.jwtSecret
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("guardrail secret encryption")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret seals a secret with AES-GCM. owner is authenticated along with
+// it, so a ciphertext copied to another row does not decrypt.
+func (gr *GuardRail) encryptSecret(secret []byte, owner string) (string, error) {
+	aead, err := gr.secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, secret, []byte(owner))
+	return encryptedSecretPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret opens a secret sealed by encryptSecret for the same owner
+func (gr *GuardRail) decryptSecret(encrypted, owner string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(encrypted, encryptedSecretPrefix)
+	if !ok {
+		return nil, errUndecryptableSecret
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errUndecryptableSecret
+	}
+
+	aead, err := gr.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errUndecryptableSecret
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(owner))
+	if err != nil {
+		return nil, errUndecryptableSecret
+	}
+	return secret, nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -80,7 +82,15 @@ func main() {
 			})
 		}
 
+		req.IPAddress = c.IP()
 		response, err := authService.Login(req)
+		var lockout *guardrail.LockoutError
+		if errors.As(err, &lockout) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(lockout.RetryAfter.Seconds())))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": err.Error(),
@@ -1,6 +1,7 @@
 package guardrail
 
 import (
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -22,24 +23,120 @@ type Config struct {
 	// Redis client for caching (optional but recommended)
 	RedisClient *redis.Client
 
+	// Where ApplicationKeyMiddleware looks for keys, checked in order
+	// (default: X-Application-Key header, then HTTP Basic credentials)
+	ApplicationKeySources []ApplicationKeySource
+
+	// Maximum clock skew accepted for signed requests (default: 5 minutes)
+	SignatureMaxSkew time.Duration
+
 	// Custom error messages (optional)
 	ErrorMessages ErrorMessages
 
 	// Enable/disable features
 	EnableRBAC        bool // Enable Role-Based Access Control (default: true)
 	EnableMultiTenant bool // Enable multi-tenant support (default: false)
+
+	// Catalog of permissions custom roles can be built from, and the
+	// permissions of built-in roles such as "admin" (PermissionAll for all).
+	// PermissionManageRoles and PermissionInviteMembers are always part of the catalog.
+	Permissions     []Permission
+	RolePermissions map[string][]Permission
+	// Role names custom roles can't take, on top of "admin", "user" and the
+	// RolePermissions keys. List every role you check with ProtectWithRole.
+	ReservedRoles []string
+
+	// Account security defaults, each can be overridden per tenant with
+	// TenantSettings (default: 8-128 character passwords, every login method,
+	// no MFA requirement, no session limit, any IP)
+	PasswordPolicy      PasswordPolicy
+	RequireMFA          bool
+	AllowedLoginMethods []LoginMethod
+	SessionLifetime     time.Duration
+	IPAllowlist         []string
+
+	// Argon2id cost for new password hashes (default: 64 MiB, 1 iteration,
+	// 4 lanes). Hashes with other parameters are upgraded at login.
+	PasswordHashing Argon2Params
+	// Server-side secrets mixed into password hashes, by key id, and the id
+	// used for new hashes. Keep retired keys until no hash references them.
+	PasswordPeppers  map[string]string
+	PasswordPepperID string
+	// Needed to verify password hashes imported from Firebase, see ImportUsers
+	FirebaseScrypt *FirebaseScryptParams
+
+	// Rejects passwords known from breaches wherever a password is chosen,
+	// e.g. a BloomFilter built with cmd/breachfilter (default: no check)
+	BreachedPasswords BreachedPasswordChecker
+
+	// Name authenticator apps show for TOTP entries (default: "GuardRail")
+	MFAIssuer string
+	// How long the MFA step of a login may take (default: 5 minutes)
+	MFAChallengeExpiry time.Duration
+	// Encrypts secrets stored in the database, such as TOTP seeds
+	// (default: derived from JWTSecret). Changing it invalidates them.
+	EncryptionKey string
+	// Passkeys for passwordless login and as a second factor (default: off)
+	WebAuthn WebAuthnConfig
+
+	// Failed login tracking per account and IP, kept in Redis if available
+	// (default: 5 failures lock an account, 50 an IP, for 1 minute doubling
+	// up to 1 hour)
+	Lockout LockoutPolicy
+
+	// Where the RateLimit middleware keeps its counters (default: Redis if
+	// RedisClient is set, otherwise memory)
+	RateLimitStore RateLimitStore
+
+	// Let Register add users to any tenant that knows its tenant_id. Off by
+	// default: users join tenants through invitations unless a tenant opts in
+	// with TenantSettings.AllowSelfRegistration.
+	AllowSelfRegistration bool
+
+	// Delivers invitations and other account emails (default: sent through
+	// Mailer from MailFrom if set, otherwise logged and dropped). Use a
+	// MailNotifier with Links to put links into the emails.
+	Notifier Notifier
+	Mailer   Mailer
+	MailFrom string
+	// How long invitations stay valid (default: 7 days)
+	InvitationExpiry time.Duration
+
+	// Block login until the user has confirmed their email address
+	RequireEmailVerification bool
+	// How long verification links stay valid (default: 24 hours)
+	EmailVerificationExpiry time.Duration
+	// How long password reset links stay valid (default: 30 minutes)
+	PasswordResetExpiry time.Duration
+	// How long the old address can undo an email change (default: 72 hours)
+	EmailChangeUndoExpiry time.Duration
+	// Minimum time between two verification or reset emails to one user (default: 1 minute)
+	EmailResendInterval time.Duration
+
+	// Where email addresses must be unique (default: EmailScopeGlobal).
+	// EmailScopeTenant lets the same person sign up to several tenants.
+	EmailUniqueness EmailScope
+
+	// Receives security-relevant events such as tenant scope bypasses
+	// (default: written to the standard logger)
+	AuditHook func(AuditEvent)
 }
 
 // ErrorMessages allows customization of error responses
 type ErrorMessages struct {
-	Unauthorized  string
-	Forbidden     string
-	InvalidToken  string
-	MissingToken  string
-	ExpiredToken  string
-	InvalidAppKey string
-	MissingAppKey string
-	InternalError string
+	Unauthorized     string
+	Forbidden        string
+	InvalidToken     string
+	MissingToken     string
+	ExpiredToken     string
+	InvalidAppKey    string
+	MissingAppKey    string
+	InvalidSignature string
+	TenantSuspended  string
+	TenantMismatch   string
+	IPNotAllowed     string
+	RateLimited      string
+	InternalError    string
 }
 
 // setDefaults sets default values for optional configuration
@@ -50,6 +147,75 @@ func (c *Config) setDefaults() {
 	if c.RefreshTokenExpiry == 0 {
 		c.RefreshTokenExpiry = 7 * 24 * time.Hour
 	}
+	if c.EmailUniqueness == "" {
+		c.EmailUniqueness = EmailScopeGlobal
+	}
+	if len(c.ApplicationKeySources) == 0 {
+		c.ApplicationKeySources = []ApplicationKeySource{AppKeySourceHeader, AppKeySourceBasic}
+	}
+	if c.SignatureMaxSkew == 0 {
+		c.SignatureMaxSkew = 5 * time.Minute
+	}
+	c.PasswordHashing = c.PasswordHashing.inherit(defaultArgon2Params)
+	c.Lockout = c.Lockout.inherit(defaultLockoutPolicy)
+	if c.MFAIssuer == "" {
+		c.MFAIssuer = "GuardRail"
+	}
+	if c.MFAChallengeExpiry == 0 {
+		c.MFAChallengeExpiry = 5 * time.Minute
+	}
+	if c.WebAuthn.RPName == "" {
+		c.WebAuthn.RPName = c.MFAIssuer
+	}
+	if c.WebAuthn.UserVerification == "" {
+		c.WebAuthn.UserVerification = UserVerificationPreferred
+	}
+	if c.WebAuthn.Attestation == "" {
+		c.WebAuthn.Attestation = AttestationAny
+	}
+	if c.WebAuthn.Timeout == 0 {
+		c.WebAuthn.Timeout = 5 * time.Minute
+	}
+	if c.RateLimitStore == nil && c.RedisClient != nil {
+		c.RateLimitStore = NewRedisRateLimitStore(c.RedisClient)
+	}
+	if c.RateLimitStore == nil {
+		c.RateLimitStore = NewMemoryRateLimitStore()
+	}
+	c.PasswordPolicy = c.PasswordPolicy.inherit(PasswordPolicy{
+		MinLength: defaultPasswordMinLength,
+		MaxLength: defaultPasswordMaxLength,
+	})
+	if c.Notifier == nil && c.Mailer != nil {
+		c.Notifier = &MailNotifier{Mailer: c.Mailer, From: c.MailFrom}
+	}
+	if c.Notifier == nil {
+		c.Notifier = logNotifier{}
+	}
+	if c.InvitationExpiry == 0 {
+		c.InvitationExpiry = 7 * 24 * time.Hour
+	}
+	if c.EmailVerificationExpiry == 0 {
+		c.EmailVerificationExpiry = 24 * time.Hour
+	}
+	if c.PasswordResetExpiry == 0 {
+		c.PasswordResetExpiry = 30 * time.Minute
+	}
+	if c.EmailChangeUndoExpiry == 0 {
+		c.EmailChangeUndoExpiry = 72 * time.Hour
+	}
+	if c.EmailResendInterval == 0 {
+		c.EmailResendInterval = time.Minute
+	}
+	if c.AuditHook == nil {
+		c.AuditHook = logAuditEvent
+	}
+	c.Permissions = append([]Permission{}, c.Permissions...)
+	for _, p := range []Permission{PermissionManageRoles, PermissionInviteMembers} {
+		if !containsPermission(c.Permissions, p) {
+			c.Permissions = append(c.Permissions, p)
+		}
+	}
 
 	// Set default error messages if not provided
 	if c.ErrorMessages.Unauthorized == "" {
@@ -73,6 +239,21 @@ func (c *Config) setDefaults() {
 	if c.ErrorMessages.MissingAppKey == "" {
 		c.ErrorMessages.MissingAppKey = "Application key is required"
 	}
+	if c.ErrorMessages.InvalidSignature == "" {
+		c.ErrorMessages.InvalidSignature = "Invalid or expired request signature"
+	}
+	if c.ErrorMessages.TenantSuspended == "" {
+		c.ErrorMessages.TenantSuspended = "Tenant is suspended or does not exist"
+	}
+	if c.ErrorMessages.TenantMismatch == "" {
+		c.ErrorMessages.TenantMismatch = "Application key and token belong to different tenants"
+	}
+	if c.ErrorMessages.IPNotAllowed == "" {
+		c.ErrorMessages.IPNotAllowed = "Access from this IP address is not allowed"
+	}
+	if c.ErrorMessages.RateLimited == "" {
+		c.ErrorMessages.RateLimited = "Too many requests"
+	}
 	if c.ErrorMessages.InternalError == "" {
 		c.ErrorMessages.InternalError = "Internal server error"
 	}
@@ -86,6 +267,53 @@ func (c *Config) Validate() error {
 	if c.JWTSecret == "" {
 		return &ConfigError{Field: "JWTSecret", Message: "JWT secret is required"}
 	}
+	switch c.EmailUniqueness {
+	case "", EmailScopeGlobal:
+	case EmailScopeTenant:
+		if !c.EnableMultiTenant {
+			return &ConfigError{Field: "EmailUniqueness", Message: "tenant scope requires EnableMultiTenant"}
+		}
+	default:
+		return &ConfigError{Field: "EmailUniqueness", Message: "must be global or tenant"}
+	}
+	if c.PasswordPepperID != "" && c.PasswordPeppers[c.PasswordPepperID] == "" {
+		return &ConfigError{Field: "PasswordPepperID", Message: "no pepper configured for key id " + c.PasswordPepperID}
+	}
+	for keyID := range c.PasswordPeppers {
+		if keyID == "" || strings.ContainsAny(keyID, "$,=") {
+			return &ConfigError{Field: "PasswordPeppers", Message: "key ids must be non-empty and not contain $ , or ="}
+		}
+	}
+	if p := c.PasswordHashing; p.Parallelism > 0 && p.Memory > 0 && p.Memory < 8*uint32(p.Parallelism) {
+		return &ConfigError{Field: "PasswordHashing", Message: "memory must be at least 8 KiB per lane"}
+	}
+	if p := c.PasswordHashing; p.Memory > maxArgon2Memory || p.Iterations > maxArgon2Iterations || p.Parallelism > maxArgon2Parallelism || p.KeyLength > maxHashKeyLength {
+		return &ConfigError{Field: "PasswordHashing", Message: "at most 1 GiB memory, 16 iterations, 16 lanes and 128 byte keys"}
+	}
+	if w := c.WebAuthn; w.RPID != "" {
+		if len(w.Origins) == 0 {
+			return &ConfigError{Field: "WebAuthn", Message: "Origins is required with RPID"}
+		}
+		if w.Attestation == AttestationTrusted && w.AttestationRoots == nil {
+			return &ConfigError{Field: "WebAuthn", Message: "trusted attestation requires AttestationRoots"}
+		}
+	}
+	err := validateTenantSettings(TenantSettings{
+		PasswordPolicy:      &c.PasswordPolicy,
+		AllowedLoginMethods: c.AllowedLoginMethods,
+		SessionLifetime:     &c.SessionLifetime,
+		IPAllowlist:         c.IPAllowlist,
+	})
+	if err != nil {
+		return &ConfigError{Field: "TenantSettings", Message: err.Error()}
+	}
+	for role, permissions := range c.RolePermissions {
+		for _, p := range permissions {
+			if p != PermissionAll && p != PermissionManageRoles && p != PermissionInviteMembers && !containsPermission(c.Permissions, p) {
+				return &ConfigError{Field: "RolePermissions", Message: "role " + role + " uses unknown permission " + string(p)}
+			}
+		}
+	}
 	return nil
 }
 
@@ -1,11 +1,13 @@
 package guardrail_test
 
 import (
+	"strings"
 	"testing"
 
 	guardrail "github.com/vviveksharma/auth"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func TestNewGuardRail(t *testing.T) {
@@ -86,3 +88,30 @@ func TestHelperFunctions(t *testing.T) {
 	_ = guardrail.GetTenantID
 	_ = guardrail.GetClaims
 }
+
+// newTestGuardRail returns a GuardRail backed by a fresh in-memory database
+// with all library tables migrated, along with the database handle
+func newTestGuardRail(t *testing.T, config guardrail.Config) (*guardrail.GuardRail, *gorm.DB) {
+	t.Helper()
+
+	dsn := "file:" + strings.ReplaceAll(t.Name(), "/", "_") + "?mode=memory&cache=shared"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	config.DB = db
+	if config.JWTSecret == "" {
+		config.JWTSecret = "test-secret"
+	}
+
+	gr, err := guardrail.New(config)
+	if err != nil {
+		t.Fatalf("Failed to create GuardRail: %v", err)
+	}
+	if err := gr.AutoMigrate(); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	return gr, db
+}
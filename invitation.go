@@ -0,0 +1,373 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// invitationTokenPurpose binds invitation tokens to this flow
+const invitationTokenPurpose = "invitation"
+
+var (
+	// ErrInvalidInvitation is returned for unknown, expired, revoked or used invitations
+	ErrInvalidInvitation = errors.New("invitation is invalid or has expired")
+	// ErrInvitationNotFound is returned when a managed invitation does not exist
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrAlreadyMember is returned when inviting someone who already belongs to the tenant
+	ErrAlreadyMember = errors.New("user is already a member of this tenant")
+)
+
+// Invitation lets someone join a tenant. Only a hash of the emailed token is stored.
+type Invitation struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	TenantID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"tenant_id"`
+	Email      string     `gorm:"not null;index" json:"email"`
+	Roles      []string   `gorm:"serializer:json" json:"roles"`
+	InvitedBy  *uuid.UUID `gorm:"type:uuid" json:"invited_by,omitempty"`
+	TokenHash  string     `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	AcceptedBy *uuid.UUID `gorm:"type:uuid" json:"accepted_by,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName specifies the table name for Invitation model
+func (Invitation) TableName() string {
+	return "invitations"
+}
+
+// BeforeCreate assigns the invitation ID
+func (i *Invitation) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = uuid.New()
+	}
+	return nil
+}
+
+// IsPending reports whether the invitation can still be accepted
+func (i Invitation) IsPending(now time.Time) bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && now.Before(i.ExpiresAt)
+}
+
+// InvitationRequest describes whom to invite and with which roles
+type InvitationRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"` // Defaults to "user"
+	// Overrides Config.InvitationExpiry
+	ExpiresIn time.Duration `json:"-"`
+}
+
+// AcceptInvitationRequest completes an invitation. Existing users prove who
+// they are with their current password; new users choose one.
+type AcceptInvitationRequest struct {
+	Token     string `json:"token"`
+	Password  string `json:"password"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	// Client IP, set by the handler (e.g. c.IP())
+	IPAddress string `json:"-"`
+}
+
+// InvitationService manages invitation-based onboarding into tenants
+type InvitationService struct {
+	gr *GuardRail
+}
+
+// NewInvitationService creates a new invitation service instance
+func (gr *GuardRail) NewInvitationService() *InvitationService {
+	return &InvitationService{gr: gr}
+}
+
+// Invite creates an invitation on behalf of a tenant admin. The actor needs
+// PermissionInviteMembers and every permission the invited roles grant.
+func (is *InvitationService) Invite(actorID, tenantID string, req InvitationRequest) (*Invitation, error) {
+	tid, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+	actor, err := uuid.Parse(actorID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+	held, err := is.gr.NewRoleService().Permissions(actorID, tenantID)
+	if errors.Is(err, ErrNotTenantMember) || (err == nil && !containsPermission(held, PermissionInviteMembers)) {
+		return nil, ErrPermissionDenied
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	roles := invitationRoles(req.Roles)
+	if err := is.gr.checkRolesExist(tid, roles); err != nil {
+		return nil, err
+	}
+	granted, err := is.gr.permissionsFor(tid, roles)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireHeld(held, granted); err != nil {
+		return nil, err
+	}
+
+	return is.createInvitation(tenantID, req, &actor)
+}
+
+// CreateInvitation creates an invitation without an acting user, e.g. for
+// the first admin of a new tenant
+func (is *InvitationService) CreateInvitation(tenantID string, req InvitationRequest) (*Invitation, error) {
+	return is.createInvitation(tenantID, req, nil)
+}
+
+func (is *InvitationService) createInvitation(tenantID string, req InvitationRequest, invitedBy *uuid.UUID) (*Invitation, error) {
+	if !is.gr.config.EnableMultiTenant {
+		return nil, fmt.Errorf("multi-tenant support is not enabled")
+	}
+	tenant, err := is.gr.NewTenantService().GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	email := normalizeEmail(req.Email)
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("a valid email is required")
+	}
+	if member, err := is.isMember(tenant.ID, email); err != nil {
+		return nil, err
+	} else if member {
+		return nil, ErrAlreadyMember
+	}
+
+	expiresIn := req.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = is.gr.config.InvitationExpiry
+	}
+
+	token, hash, err := is.gr.newSignedToken(invitationTokenPurpose)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := Invitation{
+		TenantID:  tenant.ID,
+		Email:     email,
+		Roles:     invitationRoles(req.Roles),
+		InvitedBy: invitedBy,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(expiresIn),
+	}
+	if err := is.gr.db.Create(&invitation).Error; err != nil {
+		return nil, fmt.Errorf("failed to create invitation: %w", err)
+	}
+
+	err = is.gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationInvitation,
+		To:       invitation.Email,
+		TenantID: tenant.ID.String(),
+		Token:    token,
+		Data: map[string]string{
+			"tenant_name": tenant.Name,
+			"roles":       strings.Join(invitation.Roles, ","),
+			"expires_at":  invitation.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		// An undeliverable invitation is useless, don't leave it pending
+		is.gr.db.Delete(&invitation)
+		return nil, fmt.Errorf("failed to send invitation: %w", err)
+	}
+
+	return &invitation, nil
+}
+
+// ListInvitations returns the invitations of a tenant, newest first
+func (is *InvitationService) ListInvitations(tenantID string) ([]Invitation, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var invitations []Invitation
+	if err := is.gr.db.Where("tenant_id = ?", id).Order("created_at DESC").Find(&invitations).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation makes a pending invitation unusable
+func (is *InvitationService) RevokeInvitation(invitationID string) error {
+	id, err := uuid.Parse(invitationID)
+	if err != nil {
+		return fmt.Errorf("invalid invitation_id: %w", err)
+	}
+
+	res := is.gr.db.Model(&Invitation{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return fmt.Errorf("failed to revoke invitation: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
+
+// AcceptInvitation redeems an invitation token. A user with the invited email
+// who already has an account joins the tenant after confirming their
+// password; anyone else gets a new account in the tenant. Either way the
+// response holds tokens for the inviting tenant.
+func (is *InvitationService) AcceptInvitation(req AcceptInvitationRequest) (*AuthResponse, error) {
+	hash, ok := is.gr.verifySignedToken(invitationTokenPurpose, req.Token)
+	if !ok {
+		return nil, ErrInvalidInvitation
+	}
+
+	var invitation Invitation
+	if err := is.gr.db.Where("token_hash = ?", hash).First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidInvitation
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if !invitation.IsPending(time.Now()) {
+		return nil, ErrInvalidInvitation
+	}
+	if err := is.gr.checkTenantActive(invitation.TenantID.String()); err != nil {
+		return nil, err
+	}
+
+	settings, err := is.gr.effectiveSettings(invitation.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.AllowsLoginMethod(LoginMethodPassword) {
+		return nil, ErrLoginMethodNotAllowed
+	}
+
+	as := is.gr.NewAuthService()
+	existing, err := is.gr.userByEmail(is.gr.db.Where("is_active = true"), invitation.Email, is.lookupTenant(invitation.TenantID))
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if existing != nil {
+		ok, err := is.gr.checkUserPassword(existing, req.Password, req.IPAddress)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid email or password")
+		}
+	}
+	if existing == nil {
+		newUser := User{Email: invitation.Email, FirstName: req.FirstName, LastName: req.LastName}
+		if err := is.gr.checkPassword(settings.PasswordPolicy, newUser, req.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	// The invitation token reached the address, which verifies it
+	var user User
+	now := time.Now()
+	err = is.gr.db.Transaction(func(tx *gorm.DB) error {
+		if existing != nil {
+			user = *existing
+			if err := attachMember(tx, user.ID, invitation.TenantID, invitation.Roles); err != nil {
+				return err
+			}
+			if user.EmailVerifiedAt == nil {
+				user.EmailVerifiedAt = &now
+				if err := tx.Model(&user).Update("email_verified_at", now).Error; err != nil {
+					return err
+				}
+			}
+		} else {
+			user = User{
+				Email:           invitation.Email,
+				FirstName:       req.FirstName,
+				LastName:        req.LastName,
+				TenantID:        invitation.TenantID,
+				EmailVerifiedAt: &now,
+			}
+			if err := as.createAccount(tx, &user, req.Password, invitation.Roles); err != nil {
+				return err
+			}
+		}
+
+		// Single use, even under concurrent accepts
+		res := tx.Model(&Invitation{}).
+			Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", invitation.ID).
+			Updates(map[string]interface{}{"accepted_at": &now, "accepted_by": user.ID})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidInvitation
+		}
+		return nil
+	})
+	if errors.Is(err, ErrInvalidInvitation) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept invitation: %w", err)
+	}
+
+	return as.startSession(user, invitation.TenantID, LoginMethodPassword, req.IPAddress, "", []string{amrPassword})
+}
+
+// lookupTenant returns the tenant to find existing accounts in. With
+// tenant-scoped emails only an account in the inviting tenant is the same person.
+func (is *InvitationService) lookupTenant(tenantID uuid.UUID) uuid.UUID {
+	if is.gr.tenantScoped() {
+		return tenantID
+	}
+	return uuid.Nil
+}
+
+// isMember reports whether the email already has an active membership
+func (is *InvitationService) isMember(tenantID uuid.UUID, email string) (bool, error) {
+	var count int64
+	err := is.gr.db.Model(&Membership{}).
+		Joins("JOIN users ON users.id = memberships.user_id AND users.deleted_at IS NULL").
+		Where("memberships.tenant_id = ? AND memberships.status = ? AND users.email = ?", tenantID, MembershipStatusActive, email).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return count > 0, nil
+}
+
+// attachMember adds an existing user to a tenant, reactivating and updating
+// a previous membership if there is one
+func attachMember(tx *gorm.DB, userID, tenantID uuid.UUID, roles []string) error {
+	var membership Membership
+	err := tx.Where("user_id = ? AND tenant_id = ?", userID, tenantID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx.Create(&Membership{
+			UserID:   userID,
+			TenantID: tenantID,
+			Roles:    roles,
+			Status:   MembershipStatusActive,
+		}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	membership.Roles = roles
+	membership.Status = MembershipStatusActive
+	return tx.Model(&membership).Select("roles", "status").Updates(&membership).Error
+}
+
+func invitationRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return []string{"user"}
+	}
+	return roles
+}
@@ -0,0 +1,103 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestInvitationFlow(t *testing.T) {
+	var sent []guardrail.Notification
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		EnableMultiTenant: true,
+		EnableRBAC:        true,
+		RolePermissions: map[string][]guardrail.Permission{
+			"admin": {guardrail.PermissionAll},
+			"user":  {},
+		},
+		Notifier: guardrail.NotifierFunc(func(ctx context.Context, n guardrail.Notification) error {
+			sent = append(sent, n)
+			return nil
+		}),
+	})
+	ts := gr.NewTenantService()
+	is := gr.NewInvitationService()
+	as := gr.NewAuthService()
+
+	acme, _ := ts.CreateTenant("Acme")
+	globex, _ := ts.CreateTenant("Globex")
+
+	// Self-registration is off unless a tenant opts in
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "x@example.test", Password: "correct-horse-battery", TenantID: acme.ID.String()}); !errors.Is(err, guardrail.ErrSelfRegistrationDisabled) {
+		t.Errorf("Expected ErrSelfRegistrationDisabled, got %v", err)
+	}
+
+	// Bootstrap the first admin without an acting user
+	if _, err := is.CreateInvitation(acme.ID.String(), guardrail.InvitationRequest{Email: "Admin@Acme.test", Roles: []string{"admin"}}); err != nil {
+		t.Fatalf("CreateInvitation failed: %v", err)
+	}
+	if len(sent) != 1 || sent[0].Type != guardrail.NotificationInvitation || sent[0].To != "admin@acme.test" || sent[0].Token == "" {
+		t.Fatalf("Expected invitation notification, got %+v", sent)
+	}
+	admin, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: sent[0].Token, Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("AcceptInvitation failed: %v", err)
+	}
+	if admin.TenantID != acme.ID.String() || admin.Role != "admin" {
+		t.Errorf("Expected admin of Acme, got %s/%s", admin.TenantID, admin.Role)
+	}
+	if _, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: sent[0].Token, Password: "correct-horse-battery"}); !errors.Is(err, guardrail.ErrInvalidInvitation) {
+		t.Errorf("Expected used invitation to be rejected, got %v", err)
+	}
+	if _, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: sent[0].Token + "x"}); !errors.Is(err, guardrail.ErrInvalidInvitation) {
+		t.Errorf("Expected tampered token to be rejected, got %v", err)
+	}
+
+	// Members without the invite permission can't invite
+	if _, err := is.CreateInvitation(acme.ID.String(), guardrail.InvitationRequest{Email: "member@acme.test"}); err != nil {
+		t.Fatalf("CreateInvitation failed: %v", err)
+	}
+	member, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: sent[1].Token, Password: "another-good-password"})
+	if err != nil {
+		t.Fatalf("AcceptInvitation failed: %v", err)
+	}
+	if _, err := is.Invite(member.UserID, acme.ID.String(), guardrail.InvitationRequest{Email: "friend@acme.test"}); !errors.Is(err, guardrail.ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied, got %v", err)
+	}
+	if _, err := is.Invite(admin.UserID, acme.ID.String(), guardrail.InvitationRequest{Email: "member@acme.test"}); !errors.Is(err, guardrail.ErrAlreadyMember) {
+		t.Errorf("Expected ErrAlreadyMember, got %v", err)
+	}
+	if _, err := is.Invite(admin.UserID, acme.ID.String(), guardrail.InvitationRequest{Email: "friend@acme.test", Roles: []string{"superuser"}}); !errors.Is(err, guardrail.ErrUnknownRole) {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+	if _, err := is.Invite("not-a-uuid", acme.ID.String(), guardrail.InvitationRequest{Email: "friend@acme.test"}); err == nil {
+		t.Error("Expected a malformed actor ID to be rejected")
+	}
+
+	// An existing user joins another tenant with their own password
+	if _, err := is.CreateInvitation(globex.ID.String(), guardrail.InvitationRequest{Email: "admin@acme.test"}); err != nil {
+		t.Fatalf("CreateInvitation failed: %v", err)
+	}
+	token := sent[len(sent)-1].Token
+	if _, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: token, Password: "wrong-password"}); err == nil {
+		t.Error("Expected wrong password to be rejected for existing user")
+	}
+	joined, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: token, Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("AcceptInvitation for existing user failed: %v", err)
+	}
+	if joined.UserID != admin.UserID || joined.TenantID != globex.ID.String() || len(joined.Tenants) != 2 {
+		t.Errorf("Expected existing user attached to Globex, got %+v", joined)
+	}
+
+	// Revoked invitations can't be used
+	revoked, _ := is.CreateInvitation(globex.ID.String(), guardrail.InvitationRequest{Email: "late@globex.test"})
+	if err := is.RevokeInvitation(revoked.ID.String()); err != nil {
+		t.Fatalf("RevokeInvitation failed: %v", err)
+	}
+	if _, err := is.AcceptInvitation(guardrail.AcceptInvitationRequest{Token: sent[len(sent)-1].Token, Password: "correct-horse-battery"}); !errors.Is(err, guardrail.ErrInvalidInvitation) {
+		t.Errorf("Expected revoked invitation to be rejected, got %v", err)
+	}
+}
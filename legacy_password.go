@@ -0,0 +1,291 @@
+package guardrail
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// FirebaseScryptParams are the project-wide hash parameters Firebase shows
+// under Authentication > Users > Password hash parameters. They are needed
+// to verify passwords imported from Firebase.
+type FirebaseScryptParams struct {
+	SignerKey     string // base64_signer_key
+	SaltSeparator string // base64_salt_separator
+	Rounds        int
+	MemCost       int
+}
+
+// Formats of password hashes imported from other systems. All of them are
+// verified as-is and replaced with Argon2id at the next login.
+//
+//	bcrypt           $2a$10$...  ($2b$, $2y$)
+//	scrypt           $scrypt$ln=15,r=8,p=1$salt$hash
+//	PBKDF2-SHA256    $pbkdf2-sha256$i=600000$salt$hash, or Django's pbkdf2_sha256$600000$salt$hash
+//	Firebase scrypt  $firebase-scrypt$salt$hash, with Config.FirebaseScrypt
+//
+// Salts and hashes are base64, padded or not.
+const (
+	hashPrefixArgon2id       = "$argon2id$"
+	hashPrefixScrypt         = "$scrypt$"
+	hashPrefixPBKDF2         = "$pbkdf2-sha256$"
+	hashPrefixDjangoPBKDF2   = "pbkdf2_sha256$"
+	hashPrefixFirebaseScrypt = "$firebase-scrypt$"
+)
+
+// isBcryptHash reports whether a hash uses one of the bcrypt prefixes
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// isSupportedHash reports whether verifyPassword understands a stored hash
+func isSupportedHash(encoded string) bool {
+	for _, prefix := range []string{hashPrefixArgon2id, hashPrefixScrypt, hashPrefixPBKDF2, hashPrefixDjangoPBKDF2, hashPrefixFirebaseScrypt} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return isBcryptHash(encoded)
+}
+
+// Upper bounds for the parameters of imported hashes, see maxArgon2Memory
+const (
+	maxBcryptCost        = 16
+	maxScryptMemory      = 1 << 30 // bytes, 128 * r * N
+	maxScryptParallelism = 16
+	maxPBKDF2Iterations  = 10_000_000
+)
+
+// checkImportedHash parses a hash from another system without verifying
+// anything, so malformed hashes and ones beyond the parameter bounds are
+// refused at import rather than at login
+func checkImportedHash(encoded string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(encoded, hashPrefixArgon2id):
+		_, err = decodePasswordHash(encoded)
+	case isBcryptHash(encoded):
+		err = checkBcryptCost(encoded)
+	case strings.HasPrefix(encoded, hashPrefixScrypt):
+		_, err = parseScrypt(encoded)
+	case strings.HasPrefix(encoded, hashPrefixPBKDF2):
+		_, err = parsePBKDF2(strings.TrimPrefix(encoded, hashPrefixPBKDF2), "i=")
+	case strings.HasPrefix(encoded, hashPrefixDjangoPBKDF2):
+		_, err = parsePBKDF2(strings.TrimPrefix(encoded, hashPrefixDjangoPBKDF2), "")
+	case strings.HasPrefix(encoded, hashPrefixFirebaseScrypt):
+		_, _, err = parseFirebaseScrypt(encoded)
+	default:
+		err = ErrUnknownPasswordHash
+	}
+	return err
+}
+
+// verifyImportedPassword checks a password against a hash imported from
+// another system
+func (gr *GuardRail) verifyImportedPassword(password, encoded string) (bool, error) {
+	switch {
+	case isBcryptHash(encoded):
+		if err := checkBcryptCost(encoded); err != nil {
+			return false, err
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encoded, hashPrefixScrypt):
+		return verifyScrypt(password, encoded)
+	case strings.HasPrefix(encoded, hashPrefixPBKDF2):
+		return verifyPBKDF2(password, strings.TrimPrefix(encoded, hashPrefixPBKDF2), "i=")
+	case strings.HasPrefix(encoded, hashPrefixDjangoPBKDF2):
+		return verifyPBKDF2(password, strings.TrimPrefix(encoded, hashPrefixDjangoPBKDF2), "")
+	case strings.HasPrefix(encoded, hashPrefixFirebaseScrypt):
+		return verifyFirebaseScrypt(password, encoded, gr.config.FirebaseScrypt)
+	}
+	return false, ErrUnknownPasswordHash
+}
+
+// checkBcryptCost rejects bcrypt hashes beyond maxBcryptCost
+func checkBcryptCost(encoded string) error {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return fmt.Errorf("invalid bcrypt hash: %w", err)
+	}
+	if cost > maxBcryptCost {
+		return fmt.Errorf("bcrypt cost %d exceeds the limit of %d", cost, maxBcryptCost)
+	}
+	return nil
+}
+
+// scryptHash is a parsed $scrypt$ hash
+type scryptHash struct {
+	ln, r, p  int
+	salt, key []byte
+}
+
+// parseScrypt parses $scrypt$ln=<log2 N>,r=<r>,p=<p>$salt$hash
+func parseScrypt(encoded string) (*scryptHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return nil, ErrUnknownPasswordHash
+	}
+	params, err := parseHashParams(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := scryptHash{ln: params["ln"], r: params["r"], p: params["p"]}
+	if h.ln < 1 || h.ln > 30 || h.r < 1 || h.p < 1 {
+		return nil, fmt.Errorf("invalid scrypt parameters %q", parts[2])
+	}
+	// scrypt needs 128 * r * N bytes
+	if h.r > maxScryptMemory>>(7+h.ln) || h.p > maxScryptParallelism {
+		return nil, fmt.Errorf("scrypt parameters %q exceed the limits", parts[2])
+	}
+	if h.salt, err = decodeBase64(parts[3]); err != nil {
+		return nil, fmt.Errorf("invalid scrypt salt: %w", err)
+	}
+	if h.key, err = decodeBase64(parts[4]); err != nil || len(h.key) == 0 || len(h.key) > maxHashKeyLength {
+		return nil, fmt.Errorf("invalid scrypt hash")
+	}
+	return &h, nil
+}
+
+// verifyScrypt checks a password against a $scrypt$ hash
+func verifyScrypt(password, encoded string) (bool, error) {
+	h, err := parseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key([]byte(password), h.salt, 1<<h.ln, h.r, h.p, len(h.key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// pbkdf2Hash is a parsed PBKDF2-SHA256 hash
+type pbkdf2Hash struct {
+	iterations int
+	salt, key  []byte
+}
+
+// parsePBKDF2 parses <iterations>$salt$hash, where iterations may carry a
+// prefix such as "i=". Django uses the salt string itself rather than its
+// decoded bytes, which an empty prefix selects.
+func parsePBKDF2(rest, iterPrefix string) (*pbkdf2Hash, error) {
+	parts := strings.Split(rest, "$")
+	if len(parts) != 3 {
+		return nil, ErrUnknownPasswordHash
+	}
+	var h pbkdf2Hash
+	var err error
+	h.iterations, err = strconv.Atoi(strings.TrimPrefix(parts[0], iterPrefix))
+	if err != nil || h.iterations < 1 {
+		return nil, fmt.Errorf("invalid pbkdf2 iterations %q", parts[0])
+	}
+	if h.iterations > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("pbkdf2 iterations %q exceed the limit of %d", parts[0], maxPBKDF2Iterations)
+	}
+	if h.key, err = decodeBase64(parts[2]); err != nil || len(h.key) == 0 || len(h.key) > maxHashKeyLength {
+		return nil, fmt.Errorf("invalid pbkdf2 hash")
+	}
+
+	h.salt = []byte(parts[1])
+	if iterPrefix != "" {
+		if h.salt, err = decodeBase64(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid pbkdf2 salt: %w", err)
+		}
+	}
+	return &h, nil
+}
+
+// verifyPBKDF2 checks a password against a hash read by parsePBKDF2
+func verifyPBKDF2(password, rest, iterPrefix string) (bool, error) {
+	h, err := parsePBKDF2(rest, iterPrefix)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2.Key([]byte(password), h.salt, h.iterations, len(h.key), sha256.New)
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// parseFirebaseScrypt parses $firebase-scrypt$salt$hash
+func parseFirebaseScrypt(encoded string) (salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 {
+		return nil, nil, ErrUnknownPasswordHash
+	}
+	if salt, err = decodeBase64(parts[2]); err != nil {
+		return nil, nil, fmt.Errorf("invalid firebase salt: %w", err)
+	}
+	if hash, err = decodeBase64(parts[3]); err != nil || len(hash) == 0 || len(hash) > maxHashKeyLength {
+		return nil, nil, fmt.Errorf("invalid firebase hash")
+	}
+	return salt, hash, nil
+}
+
+// verifyFirebaseScrypt checks Firebase's modified scrypt: the scrypt key of
+// the password and salt+separator encrypts the project's signer key with
+// AES-256-CTR, and the result is the stored hash
+func verifyFirebaseScrypt(password, encoded string, params *FirebaseScryptParams) (bool, error) {
+	if params == nil {
+		return false, fmt.Errorf("firebase scrypt hash found but Config.FirebaseScrypt is not set")
+	}
+	salt, want, err := parseFirebaseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	signerKey, err := decodeBase64(params.SignerKey)
+	if err != nil {
+		return false, fmt.Errorf("invalid firebase signer key: %w", err)
+	}
+	separator, err := decodeBase64(params.SaltSeparator)
+	if err != nil {
+		return false, fmt.Errorf("invalid firebase salt separator: %w", err)
+	}
+
+	derived, err := scrypt.Key([]byte(password), append(salt, separator...), 1<<params.MemCost, params.Rounds, 1, 32)
+	if err != nil {
+		return false, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return false, err
+	}
+	got := make([]byte, len(signerKey))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(got, signerKey)
+
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// parseHashParams parses "a=1,b=2" parameter lists
+func parseHashParams(s string) (map[string]int, error) {
+	params := make(map[string]int)
+	for _, param := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(param, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash parameter %q", param)
+		}
+		params[name] = n
+	}
+	return params, nil
+}
+
+// decodeBase64 accepts standard, URL-safe and passlib's "." base64, padded or not
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.ReplaceAll(strings.TrimRight(s, "="), ".", "+")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
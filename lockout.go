@@ -0,0 +1,411 @@
+package guardrail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// accountUnlockTokenPurpose binds unlock links to this flow
+const accountUnlockTokenPurpose = "account_unlock"
+
+var (
+	// ErrAccountLocked is returned by Login while too many recent attempts
+	// failed. The actual error is a *LockoutError carrying the wait.
+	ErrAccountLocked = errors.New("too many failed login attempts, try again later")
+	// ErrInvalidUnlockToken is returned for unknown, expired or used unlock tokens
+	ErrInvalidUnlockToken = errors.New("unlock link is invalid or has expired")
+)
+
+// LockoutError is returned by Login for a locked account or IP address.
+// errors.Is(err, ErrAccountLocked) matches it.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+// Is makes LockoutError match ErrAccountLocked
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// LockoutPolicy slows down password guessing. Failed logins are counted per
+// email address and per client IP; once either count reaches its threshold,
+// logins are refused for Duration, doubling with every further failure up to
+// MaxDuration. A count resets once Window passes without failures and it is
+// not locked.
+type LockoutPolicy struct {
+	MaxFailures   int           // Failures per account before locking (default: 5)
+	IPMaxFailures int           // Failures per IP before locking (default: 50)
+	Window        time.Duration // Default: 15 minutes
+	Duration      time.Duration // First lockout (default: 1 minute)
+	MaxDuration   time.Duration // Default: 1 hour
+	// How long the unlock link sent on lockout stays valid (default: 24 hours)
+	UnlockLinkExpiry time.Duration
+	// Turn lockout off, e.g. when a proxy in front already does it
+	Disabled bool
+}
+
+var defaultLockoutPolicy = LockoutPolicy{
+	MaxFailures:      5,
+	IPMaxFailures:    50,
+	Window:           15 * time.Minute,
+	Duration:         time.Minute,
+	MaxDuration:      time.Hour,
+	UnlockLinkExpiry: 24 * time.Hour,
+}
+
+// inherit fills unset fields from defaults
+func (p LockoutPolicy) inherit(defaults LockoutPolicy) LockoutPolicy {
+	if p.MaxFailures == 0 {
+		p.MaxFailures = defaults.MaxFailures
+	}
+	if p.IPMaxFailures == 0 {
+		p.IPMaxFailures = defaults.IPMaxFailures
+	}
+	if p.Window == 0 {
+		p.Window = defaults.Window
+	}
+	if p.Duration == 0 {
+		p.Duration = defaults.Duration
+	}
+	if p.MaxDuration == 0 {
+		p.MaxDuration = defaults.MaxDuration
+	}
+	if p.UnlockLinkExpiry == 0 {
+		p.UnlockLinkExpiry = defaults.UnlockLinkExpiry
+	}
+	return p
+}
+
+// lockDuration returns how long to lock after the given number of failures
+func (p LockoutPolicy) lockDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := p.Duration
+	for i := threshold; i < failures && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDuration)
+}
+
+// LoginAttempt counts recent failed logins for an account or IP address.
+// Only used without Redis.
+type LoginAttempt struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key"`
+	Key         string    `gorm:"size:100;not null;uniqueIndex"`
+	Failures    int       `gorm:"not null;default:0"`
+	LockedUntil *time.Time
+	// The count resets after this
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// TableName specifies the table name for LoginAttempt model
+func (LoginAttempt) TableName() string {
+	return "login_attempts"
+}
+
+// BeforeCreate assigns the attempt ID
+func (a *LoginAttempt) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+// accountLockoutKey identifies the account a login is for. It is derived from
+// what was typed rather than the user record, so unknown addresses lock
+// exactly like real ones, and hashed to keep addresses out of the store.
+func accountLockoutKey(email string, tenantID uuid.UUID) string {
+	sum := sha256.Sum256([]byte(tenantID.String() + ":" + normalizeEmail(email)))
+	return "account:" + hex.EncodeToString(sum[:])
+}
+
+// ipLockoutKey identifies a client IP address
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// userLockoutKey is the account key Login uses for a user
+func (gr *GuardRail) userLockoutKey(user User) string {
+	tenantID := uuid.Nil
+	if gr.tenantScoped() {
+		tenantID = user.TenantID
+	}
+	return accountLockoutKey(user.Email, tenantID)
+}
+
+// checkUserPassword verifies the password of a known user outside Login.
+// Failures count towards the same lockout as logins, so password prompts
+// elsewhere can't be used to guess it.
+func (gr *GuardRail) checkUserPassword(user *User, password, ip string) (bool, error) {
+	key := gr.userLockoutKey(*user)
+	if err := gr.checkLockout(key, ip); err != nil {
+		return false, err
+	}
+	if ok, _ := gr.verifyPassword(password, user.Password, user.Salt); !ok {
+		if err := gr.loginFailed(user, key, ip); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	if err := gr.clearLoginFailures(key); err != nil {
+		return false, fmt.Errorf("failed to reset login failures: %w", err)
+	}
+	return true, nil
+}
+
+// checkLockout refuses logins for a locked account or IP address
+func (gr *GuardRail) checkLockout(accountKey, ip string) error {
+	if gr.config.Lockout.Disabled {
+		return nil
+	}
+	keys := []string{accountKey}
+	if ip != "" {
+		keys = append(keys, ipLockoutKey(ip))
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		lockedUntil, err := gr.lockedUntil(key)
+		if err != nil {
+			return fmt.Errorf("lockout check failed: %w", err)
+		}
+		if lockedUntil.After(now) {
+			return &LockoutError{RetryAfter: lockedUntil.Sub(now).Round(time.Second)}
+		}
+	}
+	return nil
+}
+
+// loginFailed counts a failed login against the account and IP address.
+// user is nil when no account matched. When the account becomes locked its
+// owner is sent an unlock link.
+func (gr *GuardRail) loginFailed(user *User, accountKey, ip string) error {
+	policy := gr.config.Lockout
+	if policy.Disabled {
+		return nil
+	}
+
+	failures, err := gr.addLoginFailure(accountKey, policy.MaxFailures)
+	if err != nil {
+		return fmt.Errorf("failed to record login failure: %w", err)
+	}
+	if failures == policy.MaxFailures {
+		event := AuditEvent{Action: AuditAccountLocked, Metadata: map[string]string{"ip": ip}}
+		if user != nil {
+			event.TenantID = user.TenantID.String()
+			event.UserID = user.ID.String()
+		}
+		gr.audit(event)
+		if user != nil {
+			gr.sendUnlockEmail(*user)
+		}
+	}
+
+	if ip == "" {
+		return nil
+	}
+	failures, err = gr.addLoginFailure(ipLockoutKey(ip), policy.IPMaxFailures)
+	if err != nil {
+		return fmt.Errorf("failed to record login failure: %w", err)
+	}
+	if failures == policy.IPMaxFailures {
+		gr.audit(AuditEvent{Action: AuditAccountLocked, Reason: "ip", Metadata: map[string]string{"ip": ip}})
+	}
+	return nil
+}
+
+// sendUnlockEmail sends the owner of a locked account a link that unlocks it
+// right away. Delivery failures are logged.
+func (gr *GuardRail) sendUnlockEmail(user User) {
+	token, record, err := gr.issueUserToken(gr.db, user, user.Email, accountUnlockTokenPurpose, gr.config.Lockout.UnlockLinkExpiry)
+	if err != nil {
+		logNotifyError(fmt.Errorf("failed to issue unlock token: %w", err))
+		return
+	}
+	err = gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationAccountLocked,
+		To:       user.Email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Token:    token,
+		Data: map[string]string{
+			"first_name": user.FirstName,
+			"expires_at": record.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		logNotifyError(err)
+	}
+}
+
+// UnlockAccount clears the lockout of an account with the token from the
+// email sent when it was locked. Failures counted against the client IP stay.
+func (as *AuthService) UnlockAccount(token string) error {
+	var user User
+	err := as.gr.db.Transaction(func(tx *gorm.DB) error {
+		record, err := as.gr.consumeUserToken(tx, accountUnlockTokenPurpose, token)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND email = ?", record.UserID, record.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInvalidUserToken
+			}
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidUserToken) {
+		return ErrInvalidUnlockToken
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	return as.unlock(user, "link")
+}
+
+// UnlockUser clears the lockout of a user's account, for admins
+func (as *AuthService) UnlockUser(userID string) error {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user_id: %w", err)
+	}
+	var user User
+	if err := as.gr.db.Where("id = ?", uid).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user not found")
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	return as.unlock(user, "admin")
+}
+
+// UnlockIP clears the failures counted against a client IP address, for admins
+func (as *AuthService) UnlockIP(ip string) error {
+	if err := as.gr.clearLoginFailures(ipLockoutKey(ip)); err != nil {
+		return fmt.Errorf("failed to unlock: %w", err)
+	}
+	as.gr.audit(AuditEvent{Action: AuditAccountUnlocked, Reason: "admin", Metadata: map[string]string{"ip": ip}})
+	return nil
+}
+
+func (as *AuthService) unlock(user User, reason string) error {
+	if err := as.gr.clearLoginFailures(as.gr.userLockoutKey(user)); err != nil {
+		return fmt.Errorf("failed to unlock: %w", err)
+	}
+	if err := as.gr.voidUserTokens(as.gr.db, user.ID, accountUnlockTokenPurpose); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditAccountUnlocked,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Reason:   reason,
+	})
+	return nil
+}
+
+// lockedUntil returns when the lock on a key ends, zero if it is not locked
+func (gr *GuardRail) lockedUntil(key string) (time.Time, error) {
+	if gr.redis != nil {
+		val, err := gr.redis.HGet(context.Background(), "login_failures:"+key, "locked_until").Int64()
+		// Only a missing key or field means not locked; an unreachable redis
+		// must not wave logins through
+		if errors.Is(err, redis.Nil) || (err == nil && val == 0) {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, val), nil
+	}
+
+	var attempt LoginAttempt
+	err := gr.db.Where("key = ? AND expires_at > ?", key, time.Now()).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && attempt.LockedUntil == nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *attempt.LockedUntil, nil
+}
+
+// addLoginFailure counts a failure against a key, locking it once the count
+// reaches threshold, and returns the new count
+func (gr *GuardRail) addLoginFailure(key string, threshold int) (int, error) {
+	policy := gr.config.Lockout
+	now := time.Now()
+
+	if gr.redis != nil {
+		ctx := context.Background()
+		redisKey := "login_failures:" + key
+		failures, err := gr.redis.HIncrBy(ctx, redisKey, "failures", 1).Result()
+		if err != nil {
+			return 0, err
+		}
+		lock := policy.lockDuration(int(failures), threshold)
+		pipe := gr.redis.TxPipeline()
+		if lock > 0 {
+			pipe.HSet(ctx, redisKey, "locked_until", strconv.FormatInt(now.Add(lock).UnixNano(), 10))
+		}
+		pipe.PExpire(ctx, redisKey, max(policy.Window, lock))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+		return int(failures), nil
+	}
+
+	var failures int
+	err := gr.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginAttempt{Key: key, ExpiresAt: now}).Error
+		if err != nil {
+			return err
+		}
+		var attempt LoginAttempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&attempt).Error; err != nil {
+			return err
+		}
+
+		if !attempt.ExpiresAt.After(now) {
+			attempt.Failures = 0
+			attempt.LockedUntil = nil
+		}
+		attempt.Failures++
+		lock := policy.lockDuration(attempt.Failures, threshold)
+		if lock > 0 {
+			lockedUntil := now.Add(lock)
+			attempt.LockedUntil = &lockedUntil
+		}
+		attempt.ExpiresAt = now.Add(max(policy.Window, lock))
+		failures = attempt.Failures
+		return tx.Model(&attempt).Select("failures", "locked_until", "expires_at").Updates(&attempt).Error
+	})
+	return failures, err
+}
+
+// clearLoginFailures forgets the failures counted against a key
+func (gr *GuardRail) clearLoginFailures(key string) error {
+	if gr.redis != nil {
+		return gr.redis.Del(context.Background(), "login_failures:"+key).Err()
+	}
+	return gr.db.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
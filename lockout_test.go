@@ -0,0 +1,167 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestAccountLockout(t *testing.T) {
+	mailer := guardrail.NewMemoryMailer()
+	var audits []guardrail.AuditEvent
+	gr, db := newTestGuardRail(t, guardrail.Config{
+		Lockout: guardrail.LockoutPolicy{MaxFailures: 3},
+		Notifier: &guardrail.MailNotifier{
+			Mailer: mailer,
+			Links:  map[guardrail.NotificationType]string{guardrail.NotificationAccountLocked: "https://app.test/unlock?token={token}"},
+		},
+		AuditHook: func(e guardrail.AuditEvent) { audits = append(audits, e) },
+	})
+	as := gr.NewAuthService()
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	good := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+	fail := func(email string) error {
+		_, err := as.Login(guardrail.LoginRequest{Email: email, Password: "wrong-password"})
+		return err
+	}
+
+	// A successful login resets the count
+	fail("ada@example.test")
+	fail("ada@example.test")
+	if _, err := as.Login(good); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	var known, unknown []error
+	for i := 0; i < 4; i++ {
+		known = append(known, fail("ADA@example.test"))
+		unknown = append(unknown, fail("nobody@example.test"))
+	}
+	var lockout *guardrail.LockoutError
+	if errors.Is(known[2], guardrail.ErrAccountLocked) || !errors.As(known[3], &lockout) || lockout.RetryAfter != time.Minute {
+		t.Fatalf("Expected a 1 minute lockout after 3 failures, got %v", known)
+	}
+	for i := range known {
+		if known[i].Error() != unknown[i].Error() {
+			t.Errorf("Attempt %d reveals the account: %v vs %v", i, known[i], unknown[i])
+		}
+	}
+	if _, err := as.Login(good); !errors.Is(err, guardrail.ErrAccountLocked) {
+		t.Errorf("Expected correct password to be refused while locked, got %v", err)
+	}
+	if len(audits) != 2 || audits[0].Action != guardrail.AuditAccountLocked || audits[0].UserID != user.UserID || audits[1].UserID != "" {
+		t.Errorf("Unexpected audit events: %+v", audits)
+	}
+
+	// Each failure after the lock ends doubles the next one
+	db.Exec("UPDATE login_attempts SET locked_until = ?", time.Now().Add(-time.Second))
+	fail("ada@example.test")
+	if _, err := as.Login(good); !errors.As(err, &lockout) || lockout.RetryAfter != 2*time.Minute {
+		t.Errorf("Expected a 2 minute lockout, got %v", err)
+	}
+
+	// Only the real account gets an unlock link
+	if len(mailer.Sent()) != 2 {
+		t.Fatalf("Expected verification and unlock emails only, got %+v", mailer.Sent())
+	}
+	email, _ := mailer.Last("ada@example.test")
+	token := linkToken(t, email)
+	if err := as.UnlockAccount(token); err != nil {
+		t.Fatalf("UnlockAccount failed: %v", err)
+	}
+	if _, err := as.Login(good); err != nil {
+		t.Errorf("Login after unlock failed: %v", err)
+	}
+	if err := as.UnlockAccount(token); !errors.Is(err, guardrail.ErrInvalidUnlockToken) {
+		t.Errorf("Expected used token to be rejected, got %v", err)
+	}
+
+	// Admin unlock
+	for i := 0; i < 3; i++ {
+		fail("ada@example.test")
+	}
+	if _, err := as.Login(good); !errors.Is(err, guardrail.ErrAccountLocked) {
+		t.Fatalf("Expected lockout, got %v", err)
+	}
+	if err := as.UnlockUser(user.UserID); err != nil {
+		t.Fatalf("UnlockUser failed: %v", err)
+	}
+	if _, err := as.Login(good); err != nil {
+		t.Errorf("Login after admin unlock failed: %v", err)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{Lockout: guardrail.LockoutPolicy{IPMaxFailures: 3}})
+	as := gr.NewAuthService()
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// Spraying one password over many accounts trips the IP limit
+	for _, email := range []string{"a@example.test", "b@example.test", "c@example.test"} {
+		as.Login(guardrail.LoginRequest{Email: email, Password: "Summer2024!", IPAddress: "203.0.113.7"})
+	}
+	good := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery", IPAddress: "203.0.113.7"}
+	if _, err := as.Login(good); !errors.Is(err, guardrail.ErrAccountLocked) {
+		t.Errorf("Expected IP lockout, got %v", err)
+	}
+	good.IPAddress = "198.51.100.1"
+	if _, err := as.Login(good); err != nil {
+		t.Errorf("Expected other IPs to be unaffected, got %v", err)
+	}
+
+	if err := as.UnlockIP("203.0.113.7"); err != nil {
+		t.Fatalf("UnlockIP failed: %v", err)
+	}
+	good.IPAddress = "203.0.113.7"
+	if _, err := as.Login(good); err != nil {
+		t.Errorf("Login after IP unlock failed: %v", err)
+	}
+}
+
+func TestCurrentPasswordLockout(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{Lockout: guardrail.LockoutPolicy{MaxFailures: 3}})
+	as := gr.NewAuthService()
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// Current-password prompts can't be used to guess the password
+	for i := 0; i < 3; i++ {
+		if _, err := as.ChangePassword(context.Background(), user.UserID, "wrong-password", "violet-tundra-47-kayak"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+			t.Fatalf("Expected ErrInvalidCurrentPassword, got %v", err)
+		}
+	}
+	if _, err := as.ChangePassword(context.Background(), user.UserID, "correct-horse-battery", "violet-tundra-47-kayak"); !errors.Is(err, guardrail.ErrAccountLocked) {
+		t.Errorf("Expected the correct password to be refused while locked, got %v", err)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); !errors.Is(err, guardrail.ErrAccountLocked) {
+		t.Errorf("Expected login to share the lockout, got %v", err)
+	}
+}
+
+func TestLockoutRedisUnavailable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	gr, _ := newTestGuardRail(t, guardrail.Config{RedisClient: client})
+	as := gr.NewAuthService()
+
+	// Register doesn't consult the lockout; Login must not skip it
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err == nil || !strings.Contains(err.Error(), "lockout check failed") {
+		t.Errorf("Expected the lockout check to fail without redis, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package guardrail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email is a plain-text message sent by a Mailer
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// SMTPMailer sends emails through an SMTP server. Without credentials it
+// sends unauthenticated, which suits local mail catchers.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPMailerFromEnv creates an SMTPMailer from SMTP_HOST, SMTP_PORT and
+// the optional SMTP_USERNAME / SMTP_PASSWORD (default: localhost:1025)
+func NewSMTPMailerFromEnv(from string) *SMTPMailer {
+	m := &SMTPMailer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+	if m.Host == "" {
+		m.Host = "localhost"
+	}
+	if m.Port == "" {
+		m.Port = "1025"
+	}
+	return m
+}
+
+// Send delivers an email over SMTP
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	if email.From == "" {
+		email.From = m.From
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	if err := smtp.SendMail(addr, auth, email.From, []string{email.To}, formatEmail(email)); err != nil {
+		return fmt.Errorf("smtp send failed: %w", err)
+	}
+	return nil
+}
+
+// WriterMailer writes emails to an io.Writer instead of sending them, for
+// development. Use NewConsoleMailer or NewFileMailer.
+type WriterMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewConsoleMailer prints emails to stdout
+func NewConsoleMailer() *WriterMailer {
+	return &WriterMailer{w: os.Stdout}
+}
+
+// NewFileMailer appends emails to a file
+func NewFileMailer(path string) (*WriterMailer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mail file: %w", err)
+	}
+	return &WriterMailer{w: f}, nil
+}
+
+// Send writes the email followed by a separator line
+func (m *WriterMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "%s\n%s\n", formatEmail(email), strings.Repeat("-", 72))
+	return err
+}
+
+// MemoryMailer keeps sent emails in memory, for tests
+type MemoryMailer struct {
+	mu     sync.Mutex
+	emails []Email
+}
+
+// NewMemoryMailer creates an empty MemoryMailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send records the email
+func (m *MemoryMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+// Sent returns every email sent so far, oldest first
+func (m *MemoryMailer) Sent() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Email(nil), m.emails...)
+}
+
+// Last returns the most recent email sent to an address
+func (m *MemoryMailer) Last(to string) (Email, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.emails) - 1; i >= 0; i-- {
+		if strings.EqualFold(m.emails[i].To, to) {
+			return m.emails[i], true
+		}
+	}
+	return Email{}, false
+}
+
+// formatEmail renders an RFC 5322 message. Header values can't break out of
+// their line, and a non-ASCII subject is Q-encoded.
+func formatEmail(email Email) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(email.From))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(email.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(email.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerValue folds line breaks into spaces so a value can't add headers
+func headerValue(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+// MailNotifier turns notifications into emails. Links holds a URL per
+// notification type with a {token} placeholder, e.g.
+// "https://app.example.com/verify?token={token}"; types without a link get
+// the token itself in the body.
+type MailNotifier struct {
+	Mailer Mailer
+	From   string
+	Links  map[NotificationType]string
+}
+
+// notificationSubjects are the email subjects per notification type
+var notificationSubjects = map[NotificationType]string{
+	NotificationInvitation:        "You've been invited to join %s",
+	NotificationEmailVerification: "Confirm your email address",
+	NotificationPasswordReset:     "Reset your password",
+	NotificationPasswordChanged:   "Your password was changed",
+	NotificationEmailChange:       "Confirm your new email address",
+	NotificationEmailChanged:      "Your email address was changed",
+	NotificationAccountLocked:     "Your account was locked after failed sign-in attempts",
+	NotificationRecoveryCodeUsed:  "A recovery code was used to sign in to your account",
+}
+
+// Notify renders the notification and sends it
+func (n *MailNotifier) Notify(ctx context.Context, notification Notification) error {
+	subject, ok := notificationSubjects[notification.Type]
+	if !ok {
+		subject = "Account notification"
+	}
+	if strings.Contains(subject, "%s") {
+		// Tenant names are user input
+		subject = fmt.Sprintf(subject, headerValue(notification.Data["tenant_name"]))
+	}
+
+	var body strings.Builder
+	body.WriteString(subject + "\n\n")
+	if link, ok := n.Links[notification.Type]; ok && notification.Token != "" {
+		body.WriteString(strings.ReplaceAll(link, "{token}", notification.Token) + "\n")
+	} else if notification.Token != "" {
+		body.WriteString("Your code: " + notification.Token + "\n")
+	}
+	if expires, ok := notification.Data["expires_at"]; ok {
+		body.WriteString("\nThis expires at " + expires + ".\n")
+	}
+
+	return n.Mailer.Send(ctx, Email{
+		From:    n.From,
+		To:      notification.To,
+		Subject: subject,
+		Body:    body.String(),
+	})
+}
@@ -0,0 +1,56 @@
+package guardrail_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestMailNotifierHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	mailer, err := guardrail.NewFileMailer(path)
+	if err != nil {
+		t.Fatalf("NewFileMailer failed: %v", err)
+	}
+	notifier := &guardrail.MailNotifier{Mailer: mailer, From: "noreply@example.test"}
+
+	// A tenant name can't smuggle headers into the invitation
+	err = notifier.Notify(context.Background(), guardrail.Notification{
+		Type:  guardrail.NotificationInvitation,
+		To:    "ada@example.test\r\nBcc: eve@attacker.test",
+		Token: "token",
+		Data:  map[string]string{"tenant_name": "Acme\r\nBcc: eve@attacker.test\r\n\r\nClick here"},
+	})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	headers, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") || strings.HasPrefix(line, "Click") {
+			t.Errorf("Expected no injected header, got %q", headers)
+		}
+	}
+	if !strings.Contains(headers, "Subject: You've been invited to join Acme Bcc: eve@attacker.test") {
+		t.Errorf("Expected the tenant name on the subject line, got %q", headers)
+	}
+
+	// Non-ASCII subjects are encoded
+	err = notifier.Notify(context.Background(), guardrail.Notification{
+		Type: guardrail.NotificationInvitation,
+		To:   "ada@example.test",
+		Data: map[string]string{"tenant_name": "Zürich"},
+	})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	raw, _ = os.ReadFile(path)
+	if !strings.Contains(string(raw), "Subject: =?utf-8?q?") {
+		t.Errorf("Expected a Q-encoded subject, got %q", raw)
+	}
+}
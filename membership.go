@@ -0,0 +1,264 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MembershipStatus describes whether a membership grants access
+type MembershipStatus string
+
+const (
+	MembershipStatusActive    MembershipStatus = "active"
+	MembershipStatusSuspended MembershipStatus = "suspended"
+)
+
+var (
+	// ErrNotTenantMember is returned when a user has no active access to a tenant
+	ErrNotTenantMember = errors.New("user is not a member of this tenant")
+	// ErrMembershipNotFound is returned when a managed membership does not exist
+	ErrMembershipNotFound = errors.New("membership not found")
+)
+
+// Membership grants a user access to a tenant with tenant-specific roles
+type Membership struct {
+	ID       uuid.UUID        `gorm:"type:uuid;primary_key"`
+	UserID   uuid.UUID        `gorm:"type:uuid;not null;uniqueIndex:idx_memberships_user_tenant"`
+	TenantID uuid.UUID        `gorm:"type:uuid;not null;uniqueIndex:idx_memberships_user_tenant;index"`
+	Roles    []string         `gorm:"serializer:json"`
+	Status   MembershipStatus `gorm:"type:varchar(20);default:'active'"`
+	// Grant the same roles in every descendant of the tenant
+	InheritToDescendants bool `gorm:"not null;default:false"`
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+// TableName specifies the table name for Membership model
+func (Membership) TableName() string {
+	return "memberships"
+}
+
+// BeforeCreate assigns the membership ID
+func (m *Membership) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == uuid.Nil {
+		m.ID = uuid.New()
+	}
+	return nil
+}
+
+// TenantAccess describes a tenant a user can switch to
+type TenantAccess struct {
+	TenantID string   `json:"tenant_id"`
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles"`
+}
+
+// AddMember grants a user access to a tenant with the given roles
+func (ts *TenantService) AddMember(tenantID, userID string, roles []string) (*Membership, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+	if len(roles) == 0 {
+		roles = []string{"user"}
+	}
+
+	membership := Membership{
+		UserID:   uid,
+		TenantID: tenant.ID,
+		Roles:    roles,
+		Status:   MembershipStatusActive,
+	}
+	if err := ts.gr.db.Create(&membership).Error; err != nil {
+		return nil, fmt.Errorf("failed to add member: %w", err)
+	}
+
+	return &membership, nil
+}
+
+// ListMembers returns all memberships of a tenant
+func (ts *TenantService) ListMembers(tenantID string) ([]Membership, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var memberships []Membership
+	if err := ts.gr.db.Where("tenant_id = ?", id).Order("created_at").Find(&memberships).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return memberships, nil
+}
+
+// UpdateMemberRoles replaces the roles a user holds in a tenant. The change
+// applies to tokens issued from now on.
+func (ts *TenantService) UpdateMemberRoles(tenantID, userID string, roles []string) error {
+	if len(roles) == 0 {
+		return fmt.Errorf("at least one role is required")
+	}
+	membership, err := ts.getMembership(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	membership.Roles = roles
+	if err := ts.gr.db.Model(membership).Select("roles").Updates(membership).Error; err != nil {
+		return fmt.Errorf("failed to update member roles: %w", err)
+	}
+	return nil
+}
+
+// SetMemberStatus suspends or reactivates a user's access to a tenant
+func (ts *TenantService) SetMemberStatus(tenantID, userID string, status MembershipStatus) error {
+	if status != MembershipStatusActive && status != MembershipStatusSuspended {
+		return fmt.Errorf("invalid membership status: %s", status)
+	}
+	membership, err := ts.getMembership(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.gr.db.Model(membership).Update("status", status).Error; err != nil {
+		return fmt.Errorf("failed to update membership status: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember revokes a user's access to a tenant
+func (ts *TenantService) RemoveMember(tenantID, userID string) error {
+	membership, err := ts.getMembership(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.gr.db.Delete(membership).Error; err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+	return nil
+}
+
+func (ts *TenantService) getMembership(tenantID, userID string) (*Membership, error) {
+	tid, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+
+	var membership Membership
+	if err := ts.gr.db.Where("tenant_id = ? AND user_id = ?", tid, uid).First(&membership).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMembershipNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &membership, nil
+}
+
+// tenantRoles returns the roles a user holds in a tenant: those of their own
+// membership plus any inherited from ancestor memberships that flow down. A
+// suspended membership in the tenant itself blocks access regardless. Users
+// without any membership keep their global role in their home tenant, which
+// covers accounts created before memberships existed.
+func (gr *GuardRail) tenantRoles(user User, tenantID uuid.UUID) ([]string, error) {
+	ancestors, err := gr.tenantAncestorIDs(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var memberships []Membership
+	query := gr.db.Where("user_id = ? AND tenant_id = ?", user.ID, tenantID)
+	if len(ancestors) > 0 {
+		query = gr.db.Where("user_id = ?", user.ID).Where(
+			gr.db.Where("tenant_id = ?", tenantID).
+				Or("tenant_id IN ? AND inherit_to_descendants = ? AND status = ?", ancestors, true, MembershipStatusActive),
+		)
+	}
+	if err := query.Find(&memberships).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	// Own membership first, then inherited ones from the nearest ancestor up
+	byTenant := make(map[string]Membership, len(memberships))
+	for _, m := range memberships {
+		byTenant[m.TenantID.String()] = m
+	}
+	roles := []string{}
+	member := false
+	if own, ok := byTenant[tenantID.String()]; ok {
+		if own.Status != MembershipStatusActive {
+			return nil, ErrNotTenantMember
+		}
+		roles = append(roles, own.Roles...)
+		member = true
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if inherited, ok := byTenant[ancestors[i]]; ok {
+			member = true
+			for _, role := range inherited.Roles {
+				if !containsString(roles, role) {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+
+	switch {
+	case member:
+		return roles, nil
+	case len(memberships) == 0 && tenantID == user.TenantID:
+		return []string{user.Role}, nil
+	}
+	return nil, ErrNotTenantMember
+}
+
+// availableTenants lists the active tenants a user can switch to
+func (gr *GuardRail) availableTenants(user User) ([]TenantAccess, error) {
+	var rows []struct {
+		TenantID uuid.UUID
+		Name     string
+		Roles    []string `gorm:"serializer:json"`
+	}
+	err := gr.db.Table("memberships").
+		Select("memberships.tenant_id, tenants.name, memberships.roles").
+		Joins("JOIN tenants ON tenants.id = memberships.tenant_id AND tenants.deleted_at IS NULL").
+		Where("memberships.user_id = ? AND memberships.status = ? AND tenants.status = ?", user.ID, MembershipStatusActive, TenantStatusActive).
+		Order("tenants.name").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	tenants := make([]TenantAccess, 0, len(rows)+1)
+	homeListed := false
+	for _, row := range rows {
+		homeListed = homeListed || row.TenantID == user.TenantID
+		tenants = append(tenants, TenantAccess{TenantID: row.TenantID.String(), Name: row.Name, Roles: row.Roles})
+	}
+
+	// Home tenants of users without membership rows
+	if !homeListed && user.TenantID != uuid.Nil {
+		var home Tenant
+		if err := gr.db.Where("id = ? AND status = ?", user.TenantID, TenantStatusActive).First(&home).Error; err == nil {
+			var count int64
+			gr.db.Model(&Membership{}).Where("user_id = ? AND tenant_id = ?", user.ID, user.TenantID).Count(&count)
+			if count == 0 {
+				tenants = append(tenants, TenantAccess{TenantID: home.ID.String(), Name: home.Name, Roles: []string{user.Role}})
+			}
+		}
+	}
+
+	return tenants, nil
+}
@@ -0,0 +1,118 @@
+package guardrail_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestTenantMemberships(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true, EnableRBAC: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	home, _ := ts.CreateTenant("Home")
+	other, _ := ts.CreateTenant("Other")
+
+	registered, err := as.Register(guardrail.RegisterRequest{
+		Email:    "user@example.test",
+		Password: "correct-horse-battery",
+		TenantID: home.ID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := ts.AddMember(other.ID.String(), registered.UserID, []string{"admin"}); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+
+	login, err := as.Login(guardrail.LoginRequest{Email: "user@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if login.TenantID != home.ID.String() || login.Role != "user" {
+		t.Errorf("Expected home tenant with role user, got %s/%s", login.TenantID, login.Role)
+	}
+	if len(login.Tenants) != 2 {
+		t.Fatalf("Expected 2 available tenants, got %+v", login.Tenants)
+	}
+
+	switched, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: registered.AccessToken, TenantID: other.ID.String()})
+	if err != nil {
+		t.Fatalf("SwitchTenant failed: %v", err)
+	}
+	if switched.TenantID != other.ID.String() || switched.Role != "admin" {
+		t.Errorf("Expected other tenant with role admin, got %s/%s", switched.TenantID, switched.Role)
+	}
+
+	app := fiber.New()
+	app.Get("/admin", gr.ProtectWithRole("admin"), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	status := func(token string) int {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+	if got := status(login.AccessToken); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 in home tenant, got %d", got)
+	}
+	if got := status(switched.AccessToken); got != fiber.StatusOK {
+		t.Errorf("Expected 200 as admin of other tenant, got %d", got)
+	}
+
+	// Suspending the membership stops switching and refreshing into the tenant
+	if err := ts.SetMemberStatus(other.ID.String(), registered.UserID, guardrail.MembershipStatusSuspended); err != nil {
+		t.Fatalf("SetMemberStatus failed: %v", err)
+	}
+	if _, err := as.RefreshToken(switched.RefreshToken); !errors.Is(err, guardrail.ErrNotTenantMember) {
+		t.Errorf("Expected ErrNotTenantMember on refresh, got %v", err)
+	}
+
+	if err := ts.RemoveMember(other.ID.String(), registered.UserID); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	if _, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: registered.AccessToken, TenantID: other.ID.String()}); !errors.Is(err, guardrail.ErrNotTenantMember) {
+		t.Errorf("Expected ErrNotTenantMember after removal, got %v", err)
+	}
+}
+
+func TestSwitchTenantLoginRules(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	home, _ := ts.CreateTenant("Home")
+	passkeysOnly, _ := ts.CreateTenant("Passkeys only")
+	office, _ := ts.CreateTenant("Office")
+	registered, err := as.Register(guardrail.RegisterRequest{Email: "user@example.test", Password: "correct-horse-battery", TenantID: home.ID.String()})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	ts.AddMember(passkeysOnly.ID.String(), registered.UserID, nil)
+	ts.AddMember(office.ID.String(), registered.UserID, nil)
+	ts.UpdateSettings(passkeysOnly.ID.String(), guardrail.TenantSettings{AllowedLoginMethods: []guardrail.LoginMethod{guardrail.LoginMethodPasskey}})
+	ts.UpdateSettings(office.ID.String(), guardrail.TenantSettings{IPAllowlist: []string{"10.0.0.0/8"}})
+
+	// The target tenant's login rules apply to the session being carried over
+	req := guardrail.SwitchTenantRequest{AccessToken: registered.AccessToken, TenantID: passkeysOnly.ID.String()}
+	if _, err := as.SwitchTenant(req); !errors.Is(err, guardrail.ErrLoginMethodNotAllowed) {
+		t.Errorf("Expected ErrLoginMethodNotAllowed for a password session, got %v", err)
+	}
+	req = guardrail.SwitchTenantRequest{AccessToken: registered.AccessToken, TenantID: office.ID.String(), IPAddress: "203.0.113.7"}
+	if _, err := as.SwitchTenant(req); !errors.Is(err, guardrail.ErrIPNotAllowed) {
+		t.Errorf("Expected ErrIPNotAllowed, got %v", err)
+	}
+	req.IPAddress = "10.1.2.3"
+	if _, err := as.SwitchTenant(req); err != nil {
+		t.Errorf("Expected switching from an allowed IP to work, got %v", err)
+	}
+	if _, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: registered.RefreshToken, TenantID: home.ID.String()}); err == nil {
+		t.Error("Expected a refresh token to be refused")
+	}
+}
@@ -0,0 +1,270 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MFAMethod is a second factor a user can complete login with
+type MFAMethod string
+
+const (
+	MFAMethodTOTP         MFAMethod = "totp"
+	MFAMethodPasskey      MFAMethod = "passkey"
+	MFAMethodRecoveryCode MFAMethod = "recovery_code"
+)
+
+// mfaChallengeTokenPurpose binds challenge tokens to the MFA step
+const mfaChallengeTokenPurpose = "mfa_challenge"
+
+// maxMFAAttempts is how many codes one challenge accepts before the user
+// has to enter their password again
+const maxMFAAttempts = 5
+
+// Authentication method references (RFC 8176) and assurance levels carried
+// in the amr and acr claims
+const (
+	amrPassword    = "pwd"
+	amrOTP         = "otp"
+	amrMultiFactor = "mfa"
+
+	acrSingleFactor = "aal1"
+	acrMultiFactor  = "aal2"
+)
+
+// ErrInvalidMFAToken is returned for unknown, expired or used challenge tokens
+var ErrInvalidMFAToken = errors.New("mfa challenge is invalid or has expired, please login again")
+
+// MFAChallenge is a login waiting for its second factor
+type MFAChallenge struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	TenantID  uuid.UUID `gorm:"type:uuid"`
+	TokenHash string    `gorm:"not null;uniqueIndex"`
+	// Role requested at login, checked once the challenge is completed
+	Role string
+	// Methods of the first factor, e.g. pwd
+	AMR []string `gorm:"serializer:json"`
+	// Set when the user has no second factor yet; VerifyMFA then confirms
+	// the authenticator app added with EnrollTOTPForLogin
+	Enrollment bool
+	Attempts   int `gorm:"not null;default:0"`
+	ExpiresAt  time.Time
+	UsedAt     *time.Time
+	CreatedAt  time.Time
+}
+
+// TableName specifies the table name for MFAChallenge model
+func (MFAChallenge) TableName() string {
+	return "mfa_challenges"
+}
+
+// BeforeCreate assigns the challenge ID
+func (c *MFAChallenge) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// VerifyMFARequest completes a login that returned MFARequired
+type VerifyMFARequest struct {
+	MFAToken string    `json:"mfa_token" validate:"required"`
+	Method   MFAMethod `json:"method"` // Default: MFAMethodTOTP
+	Code     string    `json:"code"`
+	// Response to BeginPasskeyMFA, for MFAMethodPasskey
+	Assertion *PasskeyAssertion `json:"assertion,omitempty"`
+	// Client IP, set by the handler (e.g. c.IP())
+	IPAddress string `json:"-"`
+}
+
+// VerifyMFA exchanges the challenge token from Login and a second factor for
+// tokens. Wrong codes count towards the account lockout like wrong passwords,
+// and after a few the user has to login again.
+func (as *AuthService) VerifyMFA(req VerifyMFARequest) (*AuthResponse, error) {
+	challenge, err := as.gr.findMFAChallenge(req.MFAToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := as.gr.db.Where("id = ? AND is_active = true", challenge.UserID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidMFAToken
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	lockoutKey := as.gr.userLockoutKey(user)
+	if err := as.gr.checkLockout(lockoutKey, req.IPAddress); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	var second string
+	switch req.Method {
+	case MFAMethodTOTP, "":
+		if challenge.Enrollment {
+			ok, err = as.gr.confirmTOTP(user, req.Code)
+		} else {
+			ok, err = as.gr.verifyTOTP(user, req.Code)
+		}
+		second = amrOTP
+	case MFAMethodPasskey:
+		ok, err = as.gr.verifyPasskeyFactor(user, req.Assertion)
+		second = amrHardwareKey
+	case MFAMethodRecoveryCode:
+		ok, err = as.gr.useRecoveryCode(user, req.Code)
+		second = amrOTP
+	default:
+		return nil, fmt.Errorf("unsupported mfa method: %s", req.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := as.gr.db.Model(challenge).Update("attempts", gorm.Expr("attempts + 1")).Error; err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if err := as.gr.loginFailed(&user, lockoutKey, req.IPAddress); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidMFACode
+	}
+
+	// Each challenge completes one login
+	res := as.gr.db.Model(&MFAChallenge{}).Where("id = ? AND used_at IS NULL", challenge.ID).Update("used_at", time.Now())
+	if res.Error != nil {
+		return nil, fmt.Errorf("database error: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrInvalidMFAToken
+	}
+	if err := as.gr.clearLoginFailures(lockoutKey); err != nil {
+		return nil, fmt.Errorf("failed to reset login failures: %w", err)
+	}
+
+	amr := append(append([]string{}, challenge.AMR...), second, amrMultiFactor)
+	response, err := as.issueSession(user, challenge.TenantID, time.Now(), amr)
+	if err != nil {
+		return nil, err
+	}
+	if as.gr.config.EnableRBAC && challenge.Role != "" && !containsString(response.Roles, challenge.Role) {
+		return nil, fmt.Errorf("invalid role for this user")
+	}
+	return response, nil
+}
+
+// mfaMethods lists the second factors a user has set up
+func (gr *GuardRail) mfaMethods(user User) ([]MFAMethod, error) {
+	var methods []MFAMethod
+
+	var totp int64
+	if err := gr.db.Model(&TOTPFactor{}).Where("user_id = ? AND confirmed_at IS NOT NULL", user.ID).Count(&totp).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if totp > 0 {
+		methods = append(methods, MFAMethodTOTP)
+	}
+
+	if gr.config.WebAuthn.RPID != "" {
+		var passkeys int64
+		if err := gr.db.Model(&Credential{}).Where("user_id = ?", user.ID).Count(&passkeys).Error; err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if passkeys > 0 {
+			methods = append(methods, MFAMethodPasskey)
+		}
+	}
+
+	// Recovery codes only stand in for another factor
+	if len(methods) > 0 {
+		remaining, err := gr.unusedRecoveryCodes(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if remaining > 0 {
+			methods = append(methods, MFAMethodRecoveryCode)
+		}
+	}
+
+	return methods, nil
+}
+
+// mfaChallenge answers a verified first factor, whose methods are amr, with a
+// challenge for the second factor instead of tokens. Without methods the
+// challenge is completed by enrolling one.
+func (as *AuthService) mfaChallenge(user User, tenantID uuid.UUID, role string, amr []string, methods []MFAMethod) (*AuthResponse, error) {
+	token, hash, err := as.gr.newSignedToken(mfaChallengeTokenPurpose)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := MFAChallenge{
+		UserID:     user.ID,
+		TenantID:   tenantID,
+		TokenHash:  hash,
+		Role:       role,
+		AMR:        amr,
+		Enrollment: len(methods) == 0,
+		ExpiresAt:  time.Now().Add(as.gr.config.MFAChallengeExpiry),
+	}
+	if err := as.gr.db.Create(&challenge).Error; err != nil {
+		return nil, fmt.Errorf("failed to create mfa challenge: %w", err)
+	}
+
+	return &AuthResponse{
+		UserID:                user.ID.String(),
+		MFARequired:           true,
+		MFAToken:              token,
+		MFAMethods:            methods,
+		MFAEnrollmentRequired: challenge.Enrollment,
+	}, nil
+}
+
+// findMFAChallenge looks up an open challenge by its token
+func (gr *GuardRail) findMFAChallenge(token string) (*MFAChallenge, error) {
+	hash, ok := gr.verifySignedToken(mfaChallengeTokenPurpose, token)
+	if !ok {
+		return nil, ErrInvalidMFAToken
+	}
+
+	var challenge MFAChallenge
+	err := gr.db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?", hash, time.Now(), maxMFAAttempts).
+		First(&challenge).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidMFAToken
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &challenge, nil
+}
+
+// activeUser loads an active user by ID
+func (as *AuthService) activeUser(userID string) (*User, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+	var user User
+	if err := as.gr.db.Where("id = ? AND is_active = true", uid).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("user not found or inactive: %w", err)
+	}
+	return &user, nil
+}
+
+// acrFor returns the assurance level reached with the given methods
+func acrFor(amr []string) string {
+	switch {
+	case containsString(amr, amrMultiFactor):
+		return acrMultiFactor
+	case len(amr) > 0:
+		return acrSingleFactor
+	}
+	return ""
+}
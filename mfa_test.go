@@ -0,0 +1,312 @@
+package guardrail_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+// totpCode computes the code an authenticator app shows for secret at a time
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Invalid secret %q: %v", secret, err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func tokenClaims(t *testing.T, token string) jwt.MapClaims {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	return claims
+}
+
+func TestTOTPLogin(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{MFAIssuer: "Acme", Lockout: guardrail.LockoutPolicy{MaxFailures: 100}})
+	as := gr.NewAuthService()
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if claims := tokenClaims(t, user.AccessToken); claims["acr"] != "aal1" || fmt.Sprint(claims["amr"]) != "[pwd]" {
+		t.Errorf("Expected password-only claims, got %v", claims)
+	}
+
+	// A session alone can't enroll an authenticator
+	if _, err := as.EnrollTOTP(user.UserID, ""); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	enrollment, err := as.EnrollTOTP(user.UserID, "correct-horse-battery")
+	if err != nil {
+		t.Fatalf("EnrollTOTP failed: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Acme:ada@example.test?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("Unexpected URI %q", enrollment.URI)
+	}
+	var factor guardrail.TOTPFactor
+	db.First(&factor)
+	if !strings.HasPrefix(factor.Secret, "v1:") || strings.Contains(factor.Secret, enrollment.Secret) {
+		t.Errorf("Expected the secret to be stored encrypted, got %q", factor.Secret)
+	}
+
+	// Nothing changes until the first code confirms the enrollment
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+	if resp, err := as.Login(login); err != nil || resp.MFARequired {
+		t.Fatalf("Expected unconfirmed TOTP to be ignored, got %+v, %v", resp, err)
+	}
+	now := time.Now()
+	if err := as.ConfirmTOTP(user.UserID, "000000"); !errors.Is(err, guardrail.ErrInvalidMFACode) {
+		t.Errorf("Expected ErrInvalidMFACode, got %v", err)
+	}
+	if err := as.ConfirmTOTP(user.UserID, totpCode(t, enrollment.Secret, now)); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+	if _, err := as.EnrollTOTP(user.UserID, "correct-horse-battery"); !errors.Is(err, guardrail.ErrTOTPAlreadyEnrolled) {
+		t.Errorf("Expected ErrTOTPAlreadyEnrolled, got %v", err)
+	}
+
+	challenge, err := as.Login(login)
+	if err != nil || !challenge.MFARequired || challenge.AccessToken != "" || len(challenge.MFAMethods) != 1 || challenge.MFAMethods[0] != guardrail.MFAMethodTOTP {
+		t.Fatalf("Expected an MFA challenge, got %+v, %v", challenge, err)
+	}
+
+	// The confirmation code can't be replayed
+	verify := guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Code: totpCode(t, enrollment.Secret, now)}
+	if _, err := as.VerifyMFA(verify); !errors.Is(err, guardrail.ErrInvalidMFACode) {
+		t.Errorf("Expected reused code to be rejected, got %v", err)
+	}
+	verify.Code = totpCode(t, enrollment.Secret, now.Add(30*time.Second))
+	resp, err := as.VerifyMFA(verify)
+	if err != nil {
+		t.Fatalf("VerifyMFA failed: %v", err)
+	}
+	if claims := tokenClaims(t, resp.AccessToken); claims["acr"] != "aal2" || fmt.Sprint(claims["amr"]) != "[pwd otp mfa]" {
+		t.Errorf("Expected MFA claims, got %v", claims)
+	}
+	if _, err := as.VerifyMFA(verify); !errors.Is(err, guardrail.ErrInvalidMFAToken) {
+		t.Errorf("Expected used challenge to be rejected, got %v", err)
+	}
+	refreshed, err := as.RefreshToken(resp.RefreshToken)
+	if err != nil || tokenClaims(t, refreshed.AccessToken)["acr"] != "aal2" {
+		t.Errorf("Expected refresh to keep the MFA claims, got %v", err)
+	}
+
+	// A challenge only takes a few guesses
+	challenge, _ = as.Login(login)
+	for i := 0; i < 5; i++ {
+		as.VerifyMFA(guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Code: "000000"})
+	}
+	verify = guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Code: totpCode(t, enrollment.Secret, now.Add(-30*time.Second))}
+	if _, err := as.VerifyMFA(verify); !errors.Is(err, guardrail.ErrInvalidMFAToken) {
+		t.Errorf("Expected challenge to be exhausted, got %v", err)
+	}
+
+	if err := as.DisableTOTP(user.UserID, "wrong-password"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	if err := as.DisableTOTP(user.UserID, "correct-horse-battery"); err != nil {
+		t.Fatalf("DisableTOTP failed: %v", err)
+	}
+	if resp, err := as.Login(login); err != nil || resp.MFARequired {
+		t.Errorf("Expected password-only login after disabling TOTP, got %+v, %v", resp, err)
+	}
+}
+
+func TestTOTPRequiredByTenant(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+	home, _ := ts.CreateTenant("Home")
+	strict, _ := ts.CreateTenant("Strict")
+
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: home.ID.String()})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	ts.AddMember(strict.ID.String(), user.UserID, []string{"admin"})
+	requireMFA := true
+	ts.UpdateSettings(strict.ID.String(), guardrail.TenantSettings{RequireMFA: &requireMFA})
+
+	// A password-only session can't switch into a tenant that requires MFA
+	if _, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: user.AccessToken, TenantID: strict.ID.String()}); !errors.Is(err, guardrail.ErrMFARequired) {
+		t.Errorf("Expected ErrMFARequired from SwitchTenant, got %v", err)
+	}
+
+	enrollment, _ := as.EnrollTOTP(user.UserID, "correct-horse-battery")
+	as.ConfirmTOTP(user.UserID, totpCode(t, enrollment.Secret, time.Now()))
+
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: strict.ID.String(), Role: "admin"}
+	challenge, err := as.Login(login)
+	if err != nil || !challenge.MFARequired {
+		t.Fatalf("Expected an MFA challenge, got %+v, %v", challenge, err)
+	}
+	resp, err := as.VerifyMFA(guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Code: totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second))})
+	if err != nil || resp.TenantID != strict.ID.String() || resp.Role != "admin" {
+		t.Fatalf("Expected admin tokens for the strict tenant, got %+v, %v", resp, err)
+	}
+
+	// An MFA session switches in and out, keeping its login time and methods
+	out, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: resp.AccessToken, TenantID: home.ID.String()})
+	if err != nil {
+		t.Fatalf("SwitchTenant failed: %v", err)
+	}
+	back, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: out.AccessToken, TenantID: strict.ID.String()})
+	if err != nil {
+		t.Fatalf("SwitchTenant back failed: %v", err)
+	}
+	original, switched := tokenClaims(t, resp.AccessToken), tokenClaims(t, back.AccessToken)
+	if switched["auth_time"] != original["auth_time"] || fmt.Sprint(switched["amr"]) != fmt.Sprint(original["amr"]) || switched["acr"] != "aal2" {
+		t.Errorf("Expected the session to carry over, got %v from %v", switched, original)
+	}
+}
+
+func TestTOTPEnrollmentAtLogin(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+	strict, _ := ts.CreateTenant("Strict")
+	requireMFA := true
+	ts.UpdateSettings(strict.ID.String(), guardrail.TenantSettings{RequireMFA: &requireMFA})
+
+	// New users of a tenant that requires MFA enroll before they get tokens
+	registered, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: strict.ID.String()})
+	if err != nil || !registered.MFAEnrollmentRequired || registered.AccessToken != "" || len(registered.MFAMethods) != 0 {
+		t.Fatalf("Expected an enrollment challenge, got %+v, %v", registered, err)
+	}
+	if _, err := as.VerifyMFA(guardrail.VerifyMFARequest{MFAToken: registered.MFAToken, Code: "000000"}); !errors.Is(err, guardrail.ErrTOTPNotEnrolled) {
+		t.Errorf("Expected ErrTOTPNotEnrolled before enrolling, got %v", err)
+	}
+	enrollment, err := as.EnrollTOTPForLogin(registered.MFAToken)
+	if err != nil {
+		t.Fatalf("EnrollTOTPForLogin failed: %v", err)
+	}
+	resp, err := as.VerifyMFA(guardrail.VerifyMFARequest{MFAToken: registered.MFAToken, Code: totpCode(t, enrollment.Secret, time.Now())})
+	if err != nil {
+		t.Fatalf("VerifyMFA failed: %v", err)
+	}
+	if claims := tokenClaims(t, resp.AccessToken); claims["acr"] != "aal2" || fmt.Sprint(claims["amr"]) != "[pwd otp mfa]" {
+		t.Errorf("Expected MFA claims, got %v", claims)
+	}
+
+	// From then on it's a regular second factor
+	challenge, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: strict.ID.String()})
+	if err != nil || challenge.MFAEnrollmentRequired || fmt.Sprint(challenge.MFAMethods) != "[totp]" {
+		t.Fatalf("Expected a TOTP challenge, got %+v, %v", challenge, err)
+	}
+	if _, err := as.EnrollTOTPForLogin(challenge.MFAToken); !errors.Is(err, guardrail.ErrTOTPAlreadyEnrolled) {
+		t.Errorf("Expected ErrTOTPAlreadyEnrolled, got %v", err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	var notified []guardrail.Notification
+	var audits []guardrail.AuditEvent
+	gr, db := newTestGuardRail(t, guardrail.Config{
+		Notifier: guardrail.NotifierFunc(func(ctx context.Context, n guardrail.Notification) error {
+			notified = append(notified, n)
+			return nil
+		}),
+		AuditHook: func(e guardrail.AuditEvent) { audits = append(audits, e) },
+	})
+	as := gr.NewAuthService()
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	if _, err := as.GenerateRecoveryCodes(user.UserID, "correct-horse-battery"); !errors.Is(err, guardrail.ErrMFANotEnabled) {
+		t.Errorf("Expected ErrMFANotEnabled without a second factor, got %v", err)
+	}
+	enrollment, _ := as.EnrollTOTP(user.UserID, "correct-horse-battery")
+	as.ConfirmTOTP(user.UserID, totpCode(t, enrollment.Secret, time.Now()))
+
+	if _, err := as.GenerateRecoveryCodes(user.UserID, "wrong-password"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	old, err := as.GenerateRecoveryCodes(user.UserID, "correct-horse-battery")
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+	}
+	codes, err := as.GenerateRecoveryCodes(user.UserID, "correct-horse-battery")
+	if err != nil || len(codes) != 10 || codes[0] == old[0] {
+		t.Fatalf("Expected a new batch of 10 codes, got %v, %v", codes, err)
+	}
+	var stored []guardrail.RecoveryCode
+	db.Find(&stored)
+	for _, c := range stored {
+		if strings.Contains(c.CodeHash, strings.ReplaceAll(codes[0], "-", "")) {
+			t.Errorf("Expected codes to be stored hashed, got %q", c.CodeHash)
+		}
+	}
+	if len(stored) != 10 {
+		t.Errorf("Expected the old batch to be gone, found %d codes", len(stored))
+	}
+
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+	challenge, err := as.Login(login)
+	if err != nil || fmt.Sprint(challenge.MFAMethods) != "[totp recovery_code]" {
+		t.Fatalf("Expected recovery codes among the methods, got %+v, %v", challenge, err)
+	}
+	verify := guardrail.VerifyMFARequest{MFAToken: challenge.MFAToken, Method: guardrail.MFAMethodRecoveryCode, Code: old[0]}
+	if _, err := as.VerifyMFA(verify); !errors.Is(err, guardrail.ErrInvalidMFACode) {
+		t.Errorf("Expected a code from the replaced batch to fail, got %v", err)
+	}
+	// Typed without the dash and in capitals
+	verify.Code = strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	resp, err := as.VerifyMFA(verify)
+	if err != nil {
+		t.Fatalf("VerifyMFA failed: %v", err)
+	}
+	if claims := tokenClaims(t, resp.AccessToken); claims["acr"] != "aal2" {
+		t.Errorf("Expected MFA claims, got %v", claims)
+	}
+	if remaining, _ := as.RecoveryCodesRemaining(user.UserID); remaining != 9 {
+		t.Errorf("Expected 9 codes left, got %d", remaining)
+	}
+	if last := notified[len(notified)-1]; last.Type != guardrail.NotificationRecoveryCodeUsed || last.Data["remaining"] != "9" {
+		t.Errorf("Expected a recovery code notification, got %+v", last)
+	}
+	if last := audits[len(audits)-1]; last.Action != guardrail.AuditRecoveryCodeUsed {
+		t.Errorf("Expected a recovery code audit event, got %+v", last)
+	}
+
+	// Each code works once
+	challenge, _ = as.Login(login)
+	verify.MFAToken = challenge.MFAToken
+	if _, err := as.VerifyMFA(verify); !errors.Is(err, guardrail.ErrInvalidMFACode) {
+		t.Errorf("Expected a used code to fail, got %v", err)
+	}
+
+	// Codes go with the last second factor and don't return with a new one
+	if err := as.DisableTOTP(user.UserID, "correct-horse-battery"); err != nil {
+		t.Fatalf("DisableTOTP failed: %v", err)
+	}
+	if remaining, _ := as.RecoveryCodesRemaining(user.UserID); remaining != 0 {
+		t.Errorf("Expected the codes to be deleted, %d left", remaining)
+	}
+	enrollment, _ = as.EnrollTOTP(user.UserID, "correct-horse-battery")
+	as.ConfirmTOTP(user.UserID, totpCode(t, enrollment.Secret, time.Now()))
+	if challenge, err := as.Login(login); err != nil || fmt.Sprint(challenge.MFAMethods) != "[totp]" {
+		t.Errorf("Expected no recovery codes after re-enrolling, got %+v, %v", challenge, err)
+	}
+}
@@ -2,9 +2,11 @@ package guardrail
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,6 +21,8 @@ type GuardRail struct {
 	db        *gorm.DB
 	redis     *redis.Client
 	jwtSecret []byte
+	// Work still running after the call that started it, see Wait
+	pending sync.WaitGroup
 }
 
 // New creates a new GuardRail middleware instance
@@ -44,68 +48,64 @@ func New(config Config) (*GuardRail, error) {
 		jwtSecret: []byte(config.JWTSecret),
 	}
 
-	return gr, nil
-}
-
-// Protect returns a Fiber middleware handler that validates JWT tokens
-// This is the main middleware function that customers will use
-func (gr *GuardRail) Protect() fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		// Extract Authorization header
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.MissingToken,
-			})
-		}
-
-		// Extract token from "Bearer <token>" format
-		tokenStr := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
-		if tokenStr == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": "Invalid authorization header format. Expected: Bearer <token>",
-			})
+	// Scope TenantScopedModel queries to the request tenant
+	if config.EnableMultiTenant {
+		if err := config.DB.Use(&tenantScopePlugin{gr: gr}); err != nil && !errors.Is(err, gorm.ErrRegistered) {
+			return nil, fmt.Errorf("failed to register tenant scope plugin: %w", err)
 		}
+	}
 
-		// Verify the JWT token
-		claims, err := gr.verifyJWT(tokenStr)
-		if err != nil {
-			log.Printf("JWT verification failed: %v", err)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.InvalidToken,
-			})
-		}
+	return gr, nil
+}
 
-		// Extract user information from claims
-		userID, ok := claims["user_id"].(string)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": "Invalid token claims",
-			})
-		}
+// Wait blocks until background work, such as password reset emails, is
+// done. Call it on shutdown so none of it is cut off.
+func (gr *GuardRail) Wait() {
+	gr.pending.Wait()
+}
 
-		// Store user info in Fiber context for downstream handlers
-		c.Locals("user_id", userID)
+// background runs fn in its own goroutine, tracked for Wait
+func (gr *GuardRail) background(fn func()) {
+	gr.pending.Add(1)
+	go func() {
+		defer gr.pending.Done()
+		fn()
+	}()
+}
 
-		// Store role if available
-		if role, ok := claims["role"].(string); ok {
-			c.Locals("role", role)
+// AutoMigrate creates or updates the tables for all models shipped with GuardRail
+func (gr *GuardRail) AutoMigrate() error {
+	if err := migrateLegacyApplicationTokens(gr.db); err != nil {
+		return fmt.Errorf("failed to migrate application tokens: %w", err)
+	}
+	backfillVerified := needsEmailVerificationBackfill(gr.db)
+	if err := gr.db.AutoMigrate(&User{}, &Tenant{}, &ApplicationToken{}, &TenantSigningKey{}, &Membership{}, &TenantRole{}, &TenantSettings{}, &Invitation{}, &UserToken{}, &PasswordHistory{}, &LoginAttempt{}, &TOTPFactor{}, &MFAChallenge{}, &Credential{}, &WebAuthnChallenge{}, &RecoveryCode{}); err != nil {
+		return err
+	}
+	if backfillVerified {
+		if err := backfillEmailVerified(gr.db); err != nil {
+			return fmt.Errorf("failed to backfill email verification: %w", err)
 		}
+	}
+	if err := migrateTenantPaths(gr.db); err != nil {
+		return fmt.Errorf("failed to migrate tenant paths: %w", err)
+	}
+	if err := migrateUserEmailIndex(gr.db, gr.config.EmailUniqueness); err != nil {
+		return fmt.Errorf("failed to migrate user email index: %w", err)
+	}
+	if err := gr.migrateSigningKeySecrets(); err != nil {
+		return fmt.Errorf("failed to encrypt signing keys: %w", err)
+	}
+	return nil
+}
 
-		// Store tenant_id if multi-tenant is enabled
-		if gr.config.EnableMultiTenant {
-			if tenantID, ok := claims["tenant_id"].(string); ok {
-				c.Locals("tenant_id", tenantID)
-			}
+// Protect returns a Fiber middleware handler that validates JWT tokens
+// This is the main middleware function that customers will use
+func (gr *GuardRail) Protect() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := gr.tokenStage(c); err != nil {
+			return gr.respondError(c, err)
 		}
-
-		// Store all claims for advanced use cases
-		c.Locals("claims", claims)
-
 		return c.Next()
 	}
 }
@@ -115,35 +115,13 @@ func (gr *GuardRail) Protect() fiber.Handler {
 func (gr *GuardRail) ProtectWithRole(allowedRoles ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// First, run the standard protection
-		if err := gr.Protect()(c); err != nil {
-			return err
+		if err := gr.tokenStage(c); err != nil {
+			return gr.respondError(c, err)
 		}
-
-		// Check if RBAC is enabled
-		if !gr.config.EnableRBAC {
-			return c.Next()
+		if err := gr.roleStage(c, allowedRoles); err != nil {
+			return gr.respondError(c, err)
 		}
-
-		// Get role from context
-		role, ok := c.Locals("role").(string)
-		if !ok {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.Forbidden,
-			})
-		}
-
-		// Check if user's role is in allowed roles
-		for _, allowedRole := range allowedRoles {
-			if role == allowedRole {
-				return c.Next()
-			}
-		}
-
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error":   true,
-			"message": "Insufficient permissions. Required role: " + strings.Join(allowedRoles, " or "),
-		})
+		return c.Next()
 	}
 }
 
@@ -154,59 +132,168 @@ func (gr *GuardRail) ApplicationKeyMiddleware() fiber.Handler {
 			return c.Next()
 		}
 
-		key := c.Query("application_key")
-		if key == "" {
-			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.MissingAppKey,
-			})
+		if err := gr.applicationKeyStage(c); err != nil {
+			return gr.respondError(c, err)
 		}
+		return c.Next()
+	}
+}
 
-		// Check cache first if Redis is available
-		var tenantID string
-		cacheKey := "application_key:" + key
+// tokenStage validates the bearer token and stores its identity in the context
+func (gr *GuardRail) tokenStage(c *fiber.Ctx) error {
+	// Extract Authorization header
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return reject(fiber.StatusUnauthorized, gr.config.ErrorMessages.MissingToken)
+	}
 
-		if gr.redis != nil {
-			ctx := context.Background()
-			val, err := gr.redis.Get(ctx, cacheKey).Result()
-			if err == nil {
-				tenantID = val
-				c.Locals("tenant_id", tenantID)
-				c.Locals("application_key", key)
-				return c.Next()
+	// Extract token from "Bearer <token>" format
+	tokenStr := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	if tokenStr == "" {
+		return reject(fiber.StatusUnauthorized, "Invalid authorization header format. Expected: Bearer <token>")
+	}
+
+	// Verify the JWT token
+	claims, err := gr.verifyJWT(tokenStr)
+	if err != nil {
+		log.Printf("JWT verification failed: %v", err)
+		return reject(fiber.StatusUnauthorized, gr.config.ErrorMessages.InvalidToken)
+	}
+
+	// Extract user information from claims
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return reject(fiber.StatusUnauthorized, "Invalid token claims")
+	}
+
+	// Store user info in Fiber context for downstream handlers
+	c.Locals("user_id", userID)
+
+	// Store role if available
+	if role, ok := claims["role"].(string); ok {
+		c.Locals("role", role)
+	}
+
+	// Store the roles held in the token's tenant, falling back to the single
+	// role claim for tokens issued before memberships existed
+	var roles []string
+	if list, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range list {
+			if role, ok := r.(string); ok {
+				roles = append(roles, role)
 			}
 		}
-
-		// Verify from database
-		var result struct {
-			TenantID string
+	} else if role, ok := claims["role"].(string); ok {
+		roles = []string{role}
+	}
+	c.Locals("roles", roles)
+
+	// Store all claims for advanced use cases
+	c.Locals("claims", claims)
+	c.SetUserContext(withSession(c.UserContext(), claims))
+
+	// Store tenant_id if multi-tenant is enabled, rejecting suspended tenants
+	// and tokens that disagree with an application key on the same request
+	if gr.config.EnableMultiTenant {
+		tenantID, ok := claims["tenant_id"].(string)
+		if ok {
+			if err := gr.bindTenant(c, tenantID, TenantSourceToken); err != nil {
+				return err
+			}
 		}
-		err := gr.db.Raw("SELECT tenant_id FROM application_tokens WHERE token = ? AND is_active = true", key).Scan(&result).Error
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.InvalidAppKey,
-			})
+
+		// Users with inherited rights may select a descendant tenant
+		if requested := c.Get(HeaderTenantID); requested != "" && ok {
+			if err := gr.bindTenant(c, requested, TenantSourceHeader); err != nil {
+				return err
+			}
+			if bound, _ := GetTenantID(c); bound != requested {
+				return reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden)
+			}
 		}
+	}
+
+	return nil
+}
+
+// roleStage checks the role stored by tokenStage against the allowed roles
+func (gr *GuardRail) roleStage(c *fiber.Ctx, allowedRoles []string) error {
+	// Check if RBAC is enabled
+	if !gr.config.EnableRBAC {
+		return nil
+	}
+
+	// Get the roles held in the token's tenant from context
+	roles, ok := GetRoles(c)
+	if !ok || len(roles) == 0 {
+		return reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden)
+	}
 
-		tenantID = result.TenantID
-		if tenantID == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   true,
-				"message": gr.config.ErrorMessages.InvalidAppKey,
-			})
+	// Check if any of the user's roles is in allowed roles
+	for _, allowedRole := range allowedRoles {
+		if containsString(roles, allowedRole) {
+			return nil
 		}
+	}
 
-		// Cache the result if Redis is available
-		if gr.redis != nil {
-			ctx := context.Background()
-			gr.redis.Set(ctx, cacheKey, tenantID, 1*time.Hour)
+	return reject(fiber.StatusForbidden, "Insufficient permissions. Required role: "+strings.Join(allowedRoles, " or "))
+}
+
+// applicationKeyStage validates the application key and binds its tenant
+func (gr *GuardRail) applicationKeyStage(c *fiber.Ctx) error {
+	appKey, err := gr.authenticateApplicationKey(c)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrMissingApplicationKey):
+			return reject(fiber.StatusUnprocessableEntity, gr.config.ErrorMessages.MissingAppKey)
+		case errors.Is(err, ErrInvalidSignature):
+			return reject(fiber.StatusUnauthorized, gr.config.ErrorMessages.InvalidSignature)
+		case errors.Is(err, ErrInvalidApplicationKey):
+			return reject(fiber.StatusUnauthorized, gr.config.ErrorMessages.InvalidAppKey)
 		}
+		return fmt.Errorf("application key lookup failed: %w", err)
+	}
 
-		c.Locals("tenant_id", tenantID)
-		c.Locals("application_key", key)
-		return c.Next()
+	if err := gr.bindTenant(c, appKey.TenantID, TenantSourceApplicationKey); err != nil {
+		return err
+	}
+
+	// Only the public key prefix is exposed to handlers, never the secret
+	c.Locals("application_key", appKey.KeyPrefix)
+	c.Locals("application_key_id", appKey.ID)
+	return nil
+}
+
+// rejection is a request refused by a middleware stage
+type rejection struct {
+	status  int
+	message string
+}
+
+func (r *rejection) Error() string {
+	return r.message
+}
+
+func reject(status int, message string) error {
+	return &rejection{status: status, message: message}
+}
+
+// respondError writes the standard error response for a failed middleware stage.
+// Anything other than a rejection is logged and reported as an internal error.
+func (gr *GuardRail) respondError(c *fiber.Ctx, err error) error {
+	var r *rejection
+	if errors.As(err, &r) {
+		return c.Status(r.status).JSON(fiber.Map{
+			"error":   true,
+			"message": r.message,
+		})
 	}
+
+	log.Printf("GuardRail middleware error: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error":   true,
+		"message": gr.config.ErrorMessages.InternalError,
+	})
 }
 
 // verifyJWT validates a JWT token and returns its claims
@@ -223,23 +310,21 @@ func (gr *GuardRail) verifyJWT(tokenStr string) (jwt.MapClaims, error) {
 		val, err := gr.redis.Get(ctx, "token:"+tokenStr).Result()
 		if err == nil && val != "" {
 			// Parse cached claims (simplified - in production, use proper serialization)
-			token, _ := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-				return gr.jwtSecret, nil
-			})
-			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			token, err := jwt.Parse(tokenStr, gr.signingKey)
+			if claims, ok := token.Claims.(jwt.MapClaims); ok && err == nil {
+				if err := gr.checkTenantTokenAge(claims); err != nil {
+					return nil, err
+				}
+				if err := gr.checkSessionVersion(claims); err != nil {
+					return nil, err
+				}
 				return claims, nil
 			}
 		}
 	}
 
 	// Parse and validate token
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return gr.jwtSecret, nil
-	})
+	token, err := jwt.Parse(tokenStr, gr.signingKey)
 
 	if err != nil {
 		// Blacklist invalid tokens if Redis is available
@@ -251,6 +336,13 @@ func (gr *GuardRail) verifyJWT(tokenStr string) (jwt.MapClaims, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		if err := gr.checkTenantTokenAge(claims); err != nil {
+			return nil, err
+		}
+		if err := gr.checkSessionVersion(claims); err != nil {
+			return nil, err
+		}
+
 		// Cache valid token if Redis is available
 		if gr.redis != nil {
 			if exp, ok := claims["exp"].(float64); ok {
@@ -280,10 +372,10 @@ func GetRole(c *fiber.Ctx) (string, bool) {
 	return role, ok
 }
 
-// GetTenantID is a helper function to extract tenant_id from Fiber context
-func GetTenantID(c *fiber.Ctx) (string, bool) {
-	tenantID, ok := c.Locals("tenant_id").(string)
-	return tenantID, ok
+// GetRoles is a helper function to extract the roles held in the token's tenant from Fiber context
+func GetRoles(c *fiber.Ctx) ([]string, bool) {
+	roles, ok := c.Locals("roles").([]string)
+	return roles, ok
 }
 
 // GetClaims is a helper function to extract all JWT claims from Fiber context
@@ -0,0 +1,54 @@
+package guardrail
+
+import (
+	"context"
+	"log"
+)
+
+// NotificationType identifies what a notification is about
+type NotificationType string
+
+const (
+	NotificationInvitation        NotificationType = "invitation"
+	NotificationEmailVerification NotificationType = "email_verification"
+	NotificationPasswordReset     NotificationType = "password_reset"
+	NotificationPasswordChanged   NotificationType = "password_changed"
+	NotificationEmailChange       NotificationType = "email_change"
+	NotificationEmailChanged      NotificationType = "email_changed"
+	NotificationAccountLocked     NotificationType = "account_locked"
+	NotificationRecoveryCodeUsed  NotificationType = "recovery_code_used"
+)
+
+// Notification is a message GuardRail needs delivered to a user, usually by
+// email. Token carries the secret the recipient needs to act on it, if any;
+// build links from it in your Notifier.
+type Notification struct {
+	Type     NotificationType
+	To       string
+	TenantID string
+	UserID   string
+	Token    string
+	Data     map[string]string
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface
+type NotifierFunc func(ctx context.Context, n Notification) error
+
+// Notify calls f(ctx, n)
+func (f NotifierFunc) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
+
+// logNotifier is the default Notifier. It only records that a notification
+// was due, never its token, so nothing secret ends up in the logs.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("GuardRail notification %s for %s dropped: no Notifier configured", n.Type, n.To)
+	return nil
+}
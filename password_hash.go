@@ -0,0 +1,253 @@
+package guardrail
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the Argon2id cost parameters for new password hashes.
+// Stored hashes carry their own parameters, so raising these only affects
+// new hashes and those upgraded at login.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// defaultArgon2Params match the parameters of hashes from before they were
+// configurable, so existing users are not all rehashed at once
+var defaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Upper bounds for the parameters of stored hashes, so a crafted or broken
+// hash can't make one login take gigabytes of memory or minutes of CPU.
+// Config.PasswordHashing has to stay within them too.
+const (
+	maxArgon2Memory      = 1 << 20 // KiB, 1 GiB
+	maxArgon2Iterations  = 16
+	maxArgon2Parallelism = 16
+	maxHashKeyLength     = 128 // bytes
+)
+
+// ErrUnknownPasswordHash is returned for stored hashes in an unsupported format
+var ErrUnknownPasswordHash = errors.New("unsupported password hash format")
+
+// passwordHash is a parsed PHC string:
+// $argon2id$v=19$m=65536,t=1,p=4[,keyid=...]$salt$hash
+type passwordHash struct {
+	params Argon2Params
+	keyID  string
+	salt   []byte
+	key    []byte
+}
+
+// hashPassword returns a PHC-format Argon2id hash of a password, peppered
+// with the current Config.PasswordPepperID if set
+func (gr *GuardRail) hashPassword(password string) (string, error) {
+	params := gr.config.PasswordHashing
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	keyID := gr.config.PasswordPepperID
+	input, err := gr.pepper(password, keyID)
+	if err != nil {
+		return "", err
+	}
+
+	return encodePasswordHash(passwordHash{
+		params: params,
+		keyID:  keyID,
+		salt:   salt,
+		key:    argon2.IDKey(input, salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength),
+	}), nil
+}
+
+// verifyPassword checks a password against a stored hash. salt is only used
+// by hashes from before the PHC format, which kept it in its own column.
+// needsRehash reports a correct password whose hash is outdated: legacy or
+// imported format, other parameters or another pepper.
+func (gr *GuardRail) verifyPassword(password, encoded, salt string) (ok, needsRehash bool) {
+	if !strings.HasPrefix(encoded, hashPrefixArgon2id) {
+		if isSupportedHash(encoded) {
+			ok, err := gr.verifyImportedPassword(password, encoded)
+			if err != nil {
+				log.Printf("Password verification failed: %v", err)
+			}
+			return ok, true
+		}
+		return verifyLegacyPassword(password, encoded, salt), true
+	}
+
+	hash, err := decodePasswordHash(encoded)
+	if err != nil {
+		log.Printf("Password verification failed: %v", err)
+		return false, false
+	}
+	input, err := gr.pepper(password, hash.keyID)
+	if err != nil {
+		log.Printf("Password verification failed: %v", err)
+		return false, false
+	}
+
+	key := argon2.IDKey(input, hash.salt, hash.params.Iterations, hash.params.Memory, hash.params.Parallelism, uint32(len(hash.key)))
+	if subtle.ConstantTimeCompare(key, hash.key) != 1 {
+		return false, false
+	}
+
+	current := gr.config.PasswordHashing
+	outdated := hash.keyID != gr.config.PasswordPepperID ||
+		hash.params.Memory != current.Memory ||
+		hash.params.Iterations != current.Iterations ||
+		hash.params.Parallelism != current.Parallelism ||
+		uint32(len(hash.key)) != current.KeyLength ||
+		uint32(len(hash.salt)) != current.SaltLength
+	return true, outdated
+}
+
+// pepper mixes the server-side secret with the given key id into a
+// password. The secret lives outside the database, so a leaked table alone
+// can't be brute-forced.
+func (gr *GuardRail) pepper(password, keyID string) ([]byte, error) {
+	if keyID == "" {
+		return []byte(password), nil
+	}
+	secret, ok := gr.config.PasswordPeppers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown password pepper key id %q", keyID)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return mac.Sum(nil), nil
+}
+
+func encodePasswordHash(h passwordHash) string {
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", h.params.Memory, h.params.Iterations, h.params.Parallelism)
+	if h.keyID != "" {
+		params += ",keyid=" + h.keyID
+	}
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, params,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key))
+}
+
+func decodePasswordHash(encoded string) (*passwordHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownPasswordHash
+	}
+	if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var h passwordHash
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		if name == "keyid" {
+			h.keyID = value
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argon2 parameter %q", param)
+		}
+		switch name {
+		case "m":
+			h.params.Memory = uint32(n)
+		case "t":
+			h.params.Iterations = uint32(n)
+		case "p":
+			if n > maxArgon2Parallelism {
+				return nil, fmt.Errorf("invalid argon2 parameter %q", param)
+			}
+			h.params.Parallelism = uint8(n)
+		}
+	}
+	if h.params.Memory == 0 || h.params.Iterations == 0 || h.params.Parallelism == 0 {
+		return nil, fmt.Errorf("incomplete argon2 parameters %q", parts[3])
+	}
+	if h.params.Memory > maxArgon2Memory || h.params.Iterations > maxArgon2Iterations {
+		return nil, fmt.Errorf("argon2 parameters %q exceed the limits", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 || len(h.key) > maxHashKeyLength {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+	return &h, nil
+}
+
+// verifyLegacyPassword checks hashes from before the PHC format: a bare
+// Argon2id key with the default parameters and a separately stored salt
+func verifyLegacyPassword(password, hashedPassword, salt string) bool {
+	saltBytes, err := base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return false
+	}
+	p := defaultArgon2Params
+	key := argon2.IDKey([]byte(password), saltBytes, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return subtle.ConstantTimeCompare([]byte(base64.RawStdEncoding.EncodeToString(key)), []byte(hashedPassword)) == 1
+}
+
+// upgradePasswordHash rehashes a just-verified password with the current
+// parameters and pepper. It only replaces the hash it was verified against,
+// and a failure is logged rather than failing the login.
+func (gr *GuardRail) upgradePasswordHash(user *User, password string) {
+	encoded, err := gr.hashPassword(password)
+	if err != nil {
+		log.Printf("Password rehash failed: %v", err)
+		return
+	}
+
+	res := gr.db.Model(&User{}).
+		Where("id = ? AND password = ?", user.ID, user.Password).
+		Updates(map[string]interface{}{"password": encoded, "salt": ""})
+	if res.Error != nil {
+		log.Printf("Password rehash failed: %v", res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		user.Password, user.Salt = encoded, ""
+	}
+}
+
+// inherit fills zero parameters from defaults
+func (p Argon2Params) inherit(defaults Argon2Params) Argon2Params {
+	if p.Memory == 0 {
+		p.Memory = defaults.Memory
+	}
+	if p.Iterations == 0 {
+		p.Iterations = defaults.Iterations
+	}
+	if p.Parallelism == 0 {
+		p.Parallelism = defaults.Parallelism
+	}
+	if p.SaltLength == 0 {
+		p.SaltLength = defaults.SaltLength
+	}
+	if p.KeyLength == 0 {
+		p.KeyLength = defaults.KeyLength
+	}
+	return p
+}
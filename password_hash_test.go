@@ -0,0 +1,109 @@
+package guardrail_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{})
+	as := gr.NewAuthService()
+
+	storedHash := func(email string) guardrail.User {
+		var user guardrail.User
+		db.Where("email = ?", email).First(&user)
+		return user
+	}
+
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "new@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if user := storedHash("new@example.test"); !strings.HasPrefix(user.Password, "$argon2id$v=19$m=65536,t=1,p=4$") || user.Salt != "" {
+		t.Errorf("Expected PHC hash, got %q (salt %q)", user.Password, user.Salt)
+	}
+
+	// Hashes from before the PHC format keep working and get converted
+	salt := []byte("0123456789abcdef")
+	legacy := guardrail.User{
+		Email:    "legacy@example.test",
+		Password: base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("correct-horse-battery"), salt, 1, 64*1024, 4, 32)),
+		Salt:     base64.RawStdEncoding.EncodeToString(salt),
+		Role:     "user",
+		IsActive: true,
+	}
+	db.Create(&legacy)
+	if _, err := as.Login(guardrail.LoginRequest{Email: "legacy@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Login with legacy hash failed: %v", err)
+	}
+	if user := storedHash("legacy@example.test"); !strings.HasPrefix(user.Password, "$argon2id$") || user.Salt != "" {
+		t.Errorf("Expected legacy hash to be upgraded, got %q", user.Password)
+	}
+
+	// Raising the cost upgrades hashes at the next login
+	stronger, err := guardrail.New(guardrail.Config{
+		DB:              db,
+		JWTSecret:       "test-secret",
+		PasswordHashing: guardrail.Argon2Params{Memory: 32 * 1024, Iterations: 2, Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := stronger.NewAuthService().Login(guardrail.LoginRequest{Email: "new@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if user := storedHash("new@example.test"); !strings.HasPrefix(user.Password, "$argon2id$v=19$m=32768,t=2,p=1$") {
+		t.Errorf("Expected hash with new parameters, got %q", user.Password)
+	}
+	if _, err := as.Login(guardrail.LoginRequest{Email: "new@example.test", Password: "wrong-password"}); err == nil {
+		t.Error("Expected wrong password to be rejected")
+	}
+}
+
+func TestPasswordPepper(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{
+		PasswordPeppers:  map[string]string{"2025": "first-pepper"},
+		PasswordPepperID: "2025",
+	})
+	if _, err := gr.NewAuthService().Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	var user guardrail.User
+	db.Where("email = ?", "ada@example.test").First(&user)
+	if !strings.Contains(user.Password, ",keyid=2025$") {
+		t.Errorf("Expected key id in hash, got %q", user.Password)
+	}
+
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}
+
+	// The database alone is not enough to check a password
+	unpeppered, _ := guardrail.New(guardrail.Config{DB: db, JWTSecret: "test-secret"})
+	if _, err := unpeppered.NewAuthService().Login(login); err == nil {
+		t.Error("Expected login without the pepper to fail")
+	}
+
+	// Rotating the pepper keeps old hashes working and moves them over
+	rotated, err := guardrail.New(guardrail.Config{
+		DB:               db,
+		JWTSecret:        "test-secret",
+		PasswordPeppers:  map[string]string{"2025": "first-pepper", "2026": "second-pepper"},
+		PasswordPepperID: "2026",
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := rotated.NewAuthService().Login(login); err != nil {
+		t.Fatalf("Login after rotation failed: %v", err)
+	}
+	db.Where("email = ?", "ada@example.test").First(&user)
+	if !strings.Contains(user.Password, ",keyid=2026$") {
+		t.Errorf("Expected hash to move to the new pepper, got %q", user.Password)
+	}
+
+	if _, err := guardrail.New(guardrail.Config{DB: db, JWTSecret: "test-secret", PasswordPepperID: "missing"}); err == nil {
+		t.Error("Expected unknown pepper key id to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+package guardrail
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PasswordHistory keeps hashes of a user's previous passwords so
+// PasswordPolicy.HistorySize can prevent reuse
+type PasswordHistory struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	Password  string    `gorm:"not null"`
+	Salt      string    `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for PasswordHistory model
+func (PasswordHistory) TableName() string {
+	return "password_histories"
+}
+
+// BeforeCreate assigns the history entry ID
+func (h *PasswordHistory) BeforeCreate(tx *gorm.DB) error {
+	if h.ID == uuid.Nil {
+		h.ID = uuid.New()
+	}
+	return nil
+}
+
+// passwordReused reports whether password matches the current password or
+// one of the last size-1 previous ones
+func (gr *GuardRail) passwordReused(user User, password string, size int) (bool, error) {
+	if ok, _ := gr.verifyPassword(password, user.Password, user.Salt); ok {
+		return true, nil
+	}
+	if size <= 1 {
+		return false, nil
+	}
+
+	var previous []PasswordHistory
+	if err := gr.db.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(size - 1).Find(&previous).Error; err != nil {
+		return false, err
+	}
+	for _, h := range previous {
+		if ok, _ := gr.verifyPassword(password, h.Password, h.Salt); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordPasswordHistory stores the password a user is about to replace,
+// keeping the size-1 most recent entries
+func recordPasswordHistory(tx *gorm.DB, user User, size int) error {
+	if size <= 1 {
+		return tx.Where("user_id = ?", user.ID).Delete(&PasswordHistory{}).Error
+	}
+
+	if err := tx.Create(&PasswordHistory{UserID: user.ID, Password: user.Password, Salt: user.Salt}).Error; err != nil {
+		return err
+	}
+	keep := tx.Model(&PasswordHistory{}).Select("id").Where("user_id = ?", user.ID).Order("created_at DESC").Limit(size - 1)
+	return tx.Where("user_id = ? AND id NOT IN (?)", user.ID, keep).Delete(&PasswordHistory{}).Error
+}
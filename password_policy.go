@@ -0,0 +1,237 @@
+package guardrail
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// PasswordPolicy describes the passwords a tenant accepts. Zero lengths,
+// strength and history inherit the value from the level above (tenant
+// parent, then Config); banned words add to those above.
+type PasswordPolicy struct {
+	MinLength     int  `json:"min_length"`
+	MaxLength     int  `json:"max_length"`
+	RequireUpper  bool `json:"require_upper"`
+	RequireLower  bool `json:"require_lower"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+	// Words the password must not contain, case-insensitively. The user's
+	// email and name are always banned.
+	BannedWords []string `json:"banned_words,omitempty"`
+	// Minimum EstimatePasswordStrength score, 0 (any) to 4
+	MinStrength int `json:"min_strength"`
+	// Number of most recent passwords, the current one included, that can't be reused
+	HistorySize int `json:"history_size"`
+}
+
+// Default password length limits. The maximum bounds the work spent hashing.
+const (
+	defaultPasswordMinLength = 8
+	defaultPasswordMaxLength = 128
+)
+
+// Upper bounds for policy settings
+const (
+	maxPasswordStrength    = 4
+	maxPasswordHistorySize = 24
+)
+
+// minPersonalInfoLength keeps short name parts like "al" from banning half
+// of all passwords
+const minPersonalInfoLength = 3
+
+// PasswordViolation is a single password policy rule that was not met
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password failed
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password does not meet policy: " + strings.Join(messages, "; ")
+}
+
+// Check validates a password, returning a *PasswordPolicyError listing every
+// violated rule. userInputs are personal details such as the email address
+// and name, which the password must not contain.
+func (p PasswordPolicy) Check(password string, userInputs ...string) error {
+	if violations := p.violations(password, userInputs); len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func (p PasswordPolicy) violations(password string, userInputs []string) []PasswordViolation {
+	var violations []PasswordViolation
+	add := func(rule, message string) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: message})
+	}
+
+	length := len([]rune(password))
+	if p.MinLength > 0 && length < p.MinLength {
+		add("min_length", fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("max_length", fmt.Sprintf("must be at most %d characters", p.MaxLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("require_upper", "must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("require_lower", "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("require_digit", "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("require_symbol", "must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	for _, word := range p.BannedWords {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" && strings.Contains(lowered, word) {
+			add("banned_word", "must not contain "+strconv.Quote(word))
+			break
+		}
+	}
+	for _, part := range personalInfo(userInputs) {
+		if strings.Contains(lowered, part) {
+			add("personal_info", "must not contain your name or email address")
+			break
+		}
+	}
+
+	if p.MinStrength > 0 {
+		if strength := EstimatePasswordStrength(password, userInputs...); strength.Score < p.MinStrength {
+			add("min_strength", "is too easy to guess")
+		}
+	}
+
+	return violations
+}
+
+// checkPassword applies a password policy for a user, banning their email
+// and name, and Config.BreachedPasswords. For existing users it also rejects
+// their recent passwords.
+func (gr *GuardRail) checkPassword(policy PasswordPolicy, user User, password string) error {
+	violations := policy.violations(password, []string{user.Email, user.FirstName, user.LastName})
+
+	breached, err := gr.isBreached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		violations = append(violations, PasswordViolation{Rule: "breached", Message: "has appeared in a data breach, choose another"})
+	}
+
+	if user.ID != uuid.Nil && policy.HistorySize > 0 {
+		reused, err := gr.passwordReused(user, password, policy.HistorySize)
+		if err != nil {
+			return err
+		}
+		if reused {
+			violations = append(violations, PasswordViolation{Rule: "history", Message: "must not be one of your recent passwords"})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// personalInfo splits user inputs into the lowercase parts a password must
+// not contain: the whole value, an email's local part, and the words of
+// names and local parts
+func personalInfo(inputs []string) []string {
+	var parts []string
+	addPart := func(part string) {
+		if len([]rune(part)) >= minPersonalInfoLength && !containsString(parts, part) {
+			parts = append(parts, part)
+		}
+	}
+	for _, input := range inputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		addPart(input)
+		// The domain of an email is shared by many people and says nothing
+		// about the user, so only the local part is split into words
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			input = local
+			addPart(input)
+		}
+		for _, word := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			addPart(word)
+		}
+	}
+	return parts
+}
+
+// inherit fills zero lengths, strength and history from a parent policy and
+// adds its banned words
+func (p PasswordPolicy) inherit(parent PasswordPolicy) PasswordPolicy {
+	if p.MinLength == 0 {
+		p.MinLength = parent.MinLength
+	}
+	if p.MaxLength == 0 {
+		p.MaxLength = parent.MaxLength
+	}
+	if p.MinStrength == 0 {
+		p.MinStrength = parent.MinStrength
+	}
+	if p.HistorySize == 0 {
+		p.HistorySize = parent.HistorySize
+	}
+	banned := append([]string{}, parent.BannedWords...)
+	for _, word := range p.BannedWords {
+		if !containsString(banned, word) {
+			banned = append(banned, word)
+		}
+	}
+	p.BannedWords = banned
+	return p
+}
+
+// validate checks that the policy can be satisfied
+func (p PasswordPolicy) validate() error {
+	if p.MinLength < 0 || p.MaxLength < 0 {
+		return fmt.Errorf("password policy lengths cannot be negative")
+	}
+	if p.MaxLength > 0 && p.MinLength > p.MaxLength {
+		return fmt.Errorf("password policy min_length exceeds max_length")
+	}
+	if p.MinStrength < 0 || p.MinStrength > maxPasswordStrength {
+		return fmt.Errorf("password policy min_strength must be between 0 and %d", maxPasswordStrength)
+	}
+	if p.HistorySize < 0 || p.HistorySize > maxPasswordHistorySize {
+		return fmt.Errorf("password policy history_size must be between 0 and %d", maxPasswordHistorySize)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+// violatedRules returns the rules reported by a PasswordPolicyError
+func violatedRules(t *testing.T, err error) []string {
+	t.Helper()
+	var policyErr *guardrail.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Expected PasswordPolicyError, got %v", err)
+	}
+	rules := make([]string, len(policyErr.Violations))
+	for i, v := range policyErr.Violations {
+		rules[i] = v.Rule
+	}
+	return rules
+}
+
+func TestPasswordPolicyRules(t *testing.T) {
+	policy := guardrail.PasswordPolicy{
+		MinLength:    10,
+		MaxLength:    64,
+		RequireDigit: true,
+		BannedWords:  []string{"Acme"},
+		MinStrength:  3,
+	}
+
+	cases := []struct {
+		password string
+		inputs   []string
+		rules    []string
+	}{
+		{"short1", nil, []string{"min_length", "min_strength"}},
+		{"no-digits-here-at-all", nil, []string{"require_digit"}},
+		{"i-work-at-ACME-2024", nil, []string{"banned_word"}},
+		{"grace-hopper-1906!", []string{"grace.hopper@example.test", "Grace", "Hopper"}, []string{"personal_info", "min_strength"}},
+		{"welcome-computer-river-7", []string{"ada.king@gmail.com", "Ada", "King"}, nil},
+		{"kingfisher-river-1815", []string{"ada.king@gmail.com", "Ada", "King"}, []string{"personal_info"}},
+		{"P@ssw0rd12345", nil, []string{"min_strength"}},
+		{"violet-tundra-47-kayak", nil, nil},
+	}
+	for _, tc := range cases {
+		err := policy.Check(tc.password, tc.inputs...)
+		if tc.rules == nil {
+			if err != nil {
+				t.Errorf("Expected %q to pass, got %v", tc.password, err)
+			}
+			continue
+		}
+		if rules := violatedRules(t, err); len(rules) != len(tc.rules) || rules[0] != tc.rules[0] || rules[len(rules)-1] != tc.rules[len(tc.rules)-1] {
+			t.Errorf("Expected %q to violate %v, got %v", tc.password, tc.rules, rules)
+		}
+	}
+}
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	weak := guardrail.EstimatePasswordStrength("Password123")
+	repeated := guardrail.EstimatePasswordStrength("aaaaaaaaaaaaaaaa")
+	strong := guardrail.EstimatePasswordStrength("violet-tundra-47-kayak")
+
+	if weak.Score > 1 || repeated.Score > 1 {
+		t.Errorf("Expected weak passwords to score low, got %+v and %+v", weak, repeated)
+	}
+	if strong.Score != 4 {
+		t.Errorf("Expected strong password to score 4, got %+v", strong)
+	}
+	if personal := guardrail.EstimatePasswordStrength("adalovelace", "ada@example.test", "Ada", "Lovelace"); personal.Score != 0 {
+		t.Errorf("Expected password made of user details to score 0, got %+v", personal)
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{PasswordPolicy: guardrail.PasswordPolicy{HistorySize: 3}})
+	as := gr.NewAuthService()
+	ctx := context.Background()
+
+	resp, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "first-password-1"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	change := func(current, next string) error {
+		_, err := as.ChangePassword(ctx, resp.UserID, current, next)
+		return err
+	}
+	if rules := violatedRules(t, change("first-password-1", "first-password-1")); rules[0] != "history" {
+		t.Errorf("Expected current password to be rejected, got %v", rules)
+	}
+	if err := change("first-password-1", "second-password-2"); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if err := change("second-password-2", "third-password-3"); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if rules := violatedRules(t, change("third-password-3", "first-password-1")); rules[0] != "history" {
+		t.Errorf("Expected recent password to be rejected, got %v", rules)
+	}
+	if err := change("third-password-3", "fourth-password-4"); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+
+	// Only the last three passwords are remembered
+	if err := change("fourth-password-4", "first-password-1"); err != nil {
+		t.Errorf("Expected password outside the history to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// passwordResetTokenPurpose binds reset tokens to this flow
+const passwordResetTokenPurpose = "password_reset"
+
+// ErrInvalidResetToken is returned for unknown, expired or used reset tokens
+var ErrInvalidResetToken = errors.New("password reset link is invalid or has expired")
+
+// RequestPasswordReset emails a reset link to every active account
+// registered with the address, one per tenant with tenant-scoped emails.
+// Only the lookup happens before it returns; tokens and emails are handled
+// in the background (see GuardRail.Wait), so neither the result nor the
+// response time tells whether any account exists. Requests within
+// Config.EmailResendInterval of the last email are skipped, and failures
+// are logged.
+func (as *AuthService) RequestPasswordReset(email string) error {
+	var users []User
+	if err := as.gr.db.Where("email = ? AND is_active = true", normalizeEmail(email)).Find(&users).Error; err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	for _, user := range users {
+		as.gr.background(func() {
+			if err := as.sendPasswordReset(user); err != nil {
+				log.Printf("Password reset for %s failed: %v", user.ID, err)
+			}
+		})
+	}
+	return nil
+}
+
+// sendPasswordReset issues a reset token for user and emails it, unless
+// one went out recently
+func (as *AuthService) sendPasswordReset(user User) error {
+	recent, err := as.gr.recentlyIssued(user.ID, passwordResetTokenPurpose)
+	if err != nil || recent {
+		return err
+	}
+
+	token, record, err := as.gr.issueUserToken(as.gr.db, user, user.Email, passwordResetTokenPurpose, as.gr.config.PasswordResetExpiry)
+	if err != nil {
+		return fmt.Errorf("failed to issue reset token: %w", err)
+	}
+	err = as.gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationPasswordReset,
+		To:       user.Email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Token:    token,
+		Data: map[string]string{
+			"first_name": user.FirstName,
+			"expires_at": record.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		logNotifyError(err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with the token from a reset email and
+// signs the user out everywhere. A password rejected by the policy leaves
+// the token usable for another attempt.
+func (as *AuthService) ResetPassword(token, newPassword string) error {
+	record, err := as.gr.findUserToken(as.gr.db, passwordResetTokenPurpose, token)
+	if errors.Is(err, errInvalidUserToken) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	var user User
+	if err := as.gr.db.Where("id = ? AND email = ? AND is_active = true", record.UserID, record.Email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	settings, err := as.gr.effectiveSettings(user.TenantID)
+	if err != nil {
+		return err
+	}
+	if err := as.gr.checkPassword(settings.PasswordPolicy, user, newPassword); err != nil {
+		return err
+	}
+
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := as.gr.consumeUserToken(tx, passwordResetTokenPurpose, token); err != nil {
+			return err
+		}
+		if err := as.setPassword(tx, &user, newPassword, settings.PasswordPolicy.HistorySize); err != nil {
+			return err
+		}
+		// The reset link reached the address, which verifies it
+		if user.EmailVerifiedAt == nil {
+			if err := tx.Model(&user).Update("email_verified_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		return as.gr.revokeSessions(tx, &user)
+	})
+	if errors.Is(err, errInvalidUserToken) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %w", err)
+	}
+	as.gr.forgetSessionVersion(user.ID)
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditPasswordReset,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+	})
+	as.notifyPasswordChanged(user)
+	return nil
+}
+
+// setPassword stores a new password hash for a user, remembering the old one
+// for the password history, and voids any pending reset links
+func (as *AuthService) setPassword(tx *gorm.DB, user *User, password string, historySize int) error {
+	if err := recordPasswordHistory(tx, *user, historySize); err != nil {
+		return err
+	}
+
+	hash, err := as.gr.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	user.Salt = ""
+	if err := tx.Model(user).Select("password", "salt").Updates(user).Error; err != nil {
+		return err
+	}
+	return as.gr.voidUserTokens(tx, user.ID, passwordResetTokenPurpose)
+}
+
+// notifyPasswordChanged tells the user their password was changed, so an
+// unexpected change does not go unnoticed
+func (as *AuthService) notifyPasswordChanged(user User) {
+	err := as.gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationPasswordChanged,
+		To:       user.Email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Data:     map[string]string{"first_name": user.FirstName},
+	})
+	if err != nil {
+		logNotifyError(err)
+	}
+}
@@ -0,0 +1,132 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestPasswordReset(t *testing.T) {
+	var sent []guardrail.Notification
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		Notifier: guardrail.NotifierFunc(func(ctx context.Context, n guardrail.Notification) error {
+			sent = append(sent, n)
+			return nil
+		}),
+	})
+	as := gr.NewAuthService()
+
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	session, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	sent = nil
+
+	// Unknown and known addresses look the same to the caller
+	if err := as.RequestPasswordReset("nobody@example.test"); err != nil {
+		t.Errorf("Expected unknown address to be accepted silently, got %v", err)
+	}
+	if err := as.RequestPasswordReset("Ada@Example.test"); err != nil {
+		t.Fatalf("RequestPasswordReset failed: %v", err)
+	}
+	gr.Wait()
+	if err := as.RequestPasswordReset("ada@example.test"); err != nil {
+		t.Fatalf("RequestPasswordReset failed: %v", err)
+	}
+	gr.Wait()
+	if len(sent) != 1 || sent[0].Type != guardrail.NotificationPasswordReset || sent[0].Token == "" {
+		t.Fatalf("Expected one throttled reset notification, got %+v", sent)
+	}
+	token := sent[0].Token
+
+	// A rejected password doesn't burn the token
+	var policyErr *guardrail.PasswordPolicyError
+	if err := as.ResetPassword(token, "short"); !errors.As(err, &policyErr) {
+		t.Errorf("Expected PasswordPolicyError, got %v", err)
+	}
+	if err := as.ResetPassword(token+"x", "a-brand-new-password"); !errors.Is(err, guardrail.ErrInvalidResetToken) {
+		t.Errorf("Expected tampered token to be rejected, got %v", err)
+	}
+	if err := as.ResetPassword(token, "a-brand-new-password"); err != nil {
+		t.Fatalf("ResetPassword failed: %v", err)
+	}
+	if err := as.ResetPassword(token, "another-new-password"); !errors.Is(err, guardrail.ErrInvalidResetToken) {
+		t.Errorf("Expected used token to be rejected, got %v", err)
+	}
+	if last := sent[len(sent)-1]; last.Type != guardrail.NotificationPasswordChanged {
+		t.Errorf("Expected password changed notification, got %s", last.Type)
+	}
+
+	// Every earlier session is gone
+	if _, err := as.RefreshToken(session.RefreshToken); err == nil {
+		t.Error("Expected refresh token from before the reset to be rejected")
+	}
+	app := fiber.New()
+	app.Get("/me", gr.Protect(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	req := httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("Expected 401 for access token from before the reset, got %d", resp.StatusCode)
+	}
+
+	if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err == nil {
+		t.Error("Expected old password to stop working")
+	}
+	fresh, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "a-brand-new-password"})
+	if err != nil {
+		t.Fatalf("Login with new password failed: %v", err)
+	}
+	req = httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+fresh.AccessToken)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected 200 for new session, got %d", resp.StatusCode)
+	}
+	if _, err := as.RefreshToken(fresh.RefreshToken); err != nil {
+		t.Errorf("Expected new refresh token to work, got %v", err)
+	}
+}
+
+func TestPasswordResetInBackground(t *testing.T) {
+	release := make(chan struct{})
+	var sent []guardrail.Notification
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		Notifier: guardrail.NotifierFunc(func(ctx context.Context, n guardrail.Notification) error {
+			if n.Type == guardrail.NotificationPasswordReset {
+				<-release
+			}
+			sent = append(sent, n)
+			return nil
+		}),
+	})
+	as := gr.NewAuthService()
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// A slow notifier doesn't hold up the response, which would set real
+	// addresses apart from unknown ones
+	done := make(chan error, 1)
+	go func() { done <- as.RequestPasswordReset("ada@example.test") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RequestPasswordReset failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RequestPasswordReset waited for the notifier")
+	}
+
+	close(release)
+	gr.Wait()
+	if last := sent[len(sent)-1]; last.Type != guardrail.NotificationPasswordReset || last.Token == "" {
+		t.Errorf("Expected the reset email after Wait, got %+v", last)
+	}
+}
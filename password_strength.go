@@ -0,0 +1,131 @@
+package guardrail
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordStrength estimates how hard a password is to guess
+type PasswordStrength struct {
+	// 0 (trivial) to 4 (strong), e.g. for a strength meter
+	Score int `json:"score"`
+	// Estimated entropy in bits
+	Entropy float64 `json:"entropy"`
+}
+
+// Entropy thresholds for scores 1 to 4
+var passwordStrengthThresholds = []float64{28, 36, 60, 80}
+
+// commonPasswordWords are words and patterns attackers try first. A password
+// built from them is only as strong as the number of such words.
+var commonPasswordWords = []string{
+	"password", "passwort", "qwerty", "qwertz", "azerty", "asdf", "zxcv", "letmein",
+	"welcome", "admin", "login", "iloveyou", "monkey", "dragon", "master", "sunshine",
+	"princess", "football", "baseball", "soccer", "hockey", "shadow", "trustno", "superman",
+	"batman", "hello", "freedom", "whatever", "secret", "access", "starwars", "changeme",
+	"default", "summer", "winter", "spring", "autumn", "love", "test", "guest", "root",
+	"user", "pass", "ninja", "mustang", "michael", "jordan", "hunter", "ranger", "buster",
+	"killer", "charlie", "pepper", "cheese", "computer", "internet", "google", "apple",
+	"secure", "abc", "123", "1234", "12345", "123456", "654321", "111111", "000000",
+	"1q2w3e", "qazwsx",
+}
+
+// leetSubstitutions undoes common character substitutions before matching
+// words, so "p@ssw0rd" counts as "password"
+var leetSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i',
+}
+
+// EstimatePasswordStrength scores a password by its estimated entropy. Known
+// words and the user's own details (userInputs, e.g. email and name) count
+// as a single guess each, and repeated or sequential characters add almost
+// nothing, so "Password123" scores far lower than its length suggests.
+func EstimatePasswordStrength(password string, userInputs ...string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return PasswordStrength{}
+	}
+
+	words := append(append([]string{}, commonPasswordWords...), personalInfo(userInputs)...)
+	wordBits := math.Log2(float64(len(words))) + 1 // +1 for capitalization
+
+	normalized := make([]rune, len(runes))
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		if sub, ok := leetSubstitutions[r]; ok {
+			r = sub
+		}
+		normalized[i] = r
+	}
+	charBits := math.Log2(float64(characterPool(runes)))
+
+	var entropy float64
+	for i := 0; i < len(runes); {
+		if n := longestWordAt(normalized, i, words); n > 0 {
+			entropy += wordBits
+			i += n
+			continue
+		}
+		if i > 0 {
+			if delta := runes[i] - runes[i-1]; delta >= -1 && delta <= 1 {
+				entropy++
+				i++
+				continue
+			}
+		}
+		entropy += charBits
+		i++
+	}
+
+	score := 0
+	for _, threshold := range passwordStrengthThresholds {
+		if entropy >= threshold {
+			score++
+		}
+	}
+	return PasswordStrength{Score: score, Entropy: math.Round(entropy*10) / 10}
+}
+
+// longestWordAt returns the length of the longest word starting at position i
+func longestWordAt(password []rune, i int, words []string) int {
+	rest := string(password[i:])
+	longest := 0
+	for _, word := range words {
+		if n := len([]rune(word)); n > longest && strings.HasPrefix(rest, word) {
+			longest = n
+		}
+	}
+	return longest
+}
+
+// characterPool returns the number of characters an attacker has to try per
+// position given the character classes in use
+func characterPool(password []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	return pool
+}
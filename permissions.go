@@ -0,0 +1,242 @@
+package guardrail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Permission is an action a role allows, taken from Config.Permissions
+type Permission string
+
+const (
+	// PermissionAll grants every permission in the catalog
+	PermissionAll Permission = "*"
+	// PermissionManageRoles allows managing custom roles and assigning roles
+	// to members. It is always part of the catalog.
+	PermissionManageRoles Permission = "roles.manage"
+	// PermissionInviteMembers allows inviting users to a tenant. It is always
+	// part of the catalog.
+	PermissionInviteMembers Permission = "members.invite"
+)
+
+var (
+	// ErrPermissionDenied is returned when an actor lacks a required permission
+	// or tries to grant one they don't hold
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrUnknownPermission is returned for permissions outside the catalog
+	ErrUnknownPermission = errors.New("unknown permission")
+	// ErrUnknownRole is returned when granting a role that is neither built in
+	// nor a custom role of the tenant or its ancestors
+	ErrUnknownRole = errors.New("unknown role")
+)
+
+// rolePermissionsCacheTTL bounds how long resolved custom roles are cached.
+// Changes made through RoleService invalidate the entry immediately.
+const rolePermissionsCacheTTL = 5 * time.Minute
+
+// RequirePermission returns middleware that validates the JWT and requires
+// every listed permission, resolved through built-in and tenant custom roles
+// Usage: app.Post("/shipments", gr.RequirePermission("shipments.create"), handler)
+func (gr *GuardRail) RequirePermission(permissions ...Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := gr.tokenStage(c); err != nil {
+			return gr.respondError(c, err)
+		}
+		if err := gr.permissionStage(c, permissions); err != nil {
+			return gr.respondError(c, err)
+		}
+		return c.Next()
+	}
+}
+
+// permissionStage resolves the permissions of the roles stored by tokenStage
+func (gr *GuardRail) permissionStage(c *fiber.Ctx, required []Permission) error {
+	if !gr.config.EnableRBAC {
+		return nil
+	}
+
+	roles, _ := GetRoles(c)
+	tenantID := uuid.Nil
+	if id, ok := GetTenantID(c); ok {
+		tenantID, _ = uuid.Parse(id)
+	}
+
+	granted, err := gr.permissionsFor(tenantID, roles)
+	if err != nil {
+		return err
+	}
+	c.Locals("permissions", granted)
+
+	for _, permission := range required {
+		if !containsPermission(granted, permission) {
+			return reject(fiber.StatusForbidden, "Insufficient permissions. Required permission: "+string(permission))
+		}
+	}
+	return nil
+}
+
+// GetPermissions is a helper function to extract the permissions resolved by RequirePermission from Fiber context
+func GetPermissions(c *fiber.Ctx) ([]Permission, bool) {
+	permissions, ok := c.Locals("permissions").([]Permission)
+	return permissions, ok
+}
+
+// permissionsFor returns the sorted permissions granted by a set of roles in
+// a tenant. Built-in roles come from Config.RolePermissions, anything else is
+// looked up among the custom roles of the tenant and its ancestors.
+func (gr *GuardRail) permissionsFor(tenantID uuid.UUID, roles []string) ([]Permission, error) {
+	var custom map[string][]Permission
+	set := map[Permission]bool{}
+	for _, role := range roles {
+		permissions, builtin := gr.config.RolePermissions[role]
+		if !builtin && tenantID != uuid.Nil {
+			if custom == nil {
+				var err error
+				if custom, err = gr.customRolePermissions(tenantID); err != nil {
+					return nil, err
+				}
+			}
+			permissions = custom[role]
+		}
+		for _, p := range gr.expandPermissions(permissions) {
+			set[p] = true
+		}
+	}
+
+	granted := make([]Permission, 0, len(set))
+	for p := range set {
+		granted = append(granted, p)
+	}
+	sort.Slice(granted, func(i, j int) bool { return granted[i] < granted[j] })
+	return granted, nil
+}
+
+// checkRolesExist rejects roles that are neither built in nor custom roles
+// visible in the tenant. Such names grant no permissions, but ProtectWithRole
+// and the roles claim still go by name. "user" is the role members get by default.
+func (gr *GuardRail) checkRolesExist(tenantID uuid.UUID, roles []string) error {
+	var custom map[string][]Permission
+	for _, role := range roles {
+		if _, builtin := gr.config.RolePermissions[role]; builtin || role == "user" {
+			continue
+		}
+		if custom == nil {
+			var err error
+			if custom, err = gr.customRolePermissions(tenantID); err != nil {
+				return err
+			}
+		}
+		if _, ok := custom[role]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+		}
+	}
+	return nil
+}
+
+// reservedRole reports whether a custom role may not use name, because the
+// app gives that name meaning of its own
+func (gr *GuardRail) reservedRole(name string) bool {
+	reserved := append([]string{"admin", "user"}, gr.config.ReservedRoles...)
+	for role := range gr.config.RolePermissions {
+		reserved = append(reserved, role)
+	}
+	for _, role := range reserved {
+		if strings.EqualFold(role, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPermissions replaces PermissionAll with the whole catalog
+func (gr *GuardRail) expandPermissions(permissions []Permission) []Permission {
+	if containsPermission(permissions, PermissionAll) {
+		return gr.config.Permissions
+	}
+	return permissions
+}
+
+// customRolePermissions maps the custom role names visible in a tenant to
+// their permissions. Roles of the tenant itself shadow ancestor roles.
+func (gr *GuardRail) customRolePermissions(tenantID uuid.UUID) (map[string][]Permission, error) {
+	ctx := context.Background()
+	cacheKey := "tenant_roles:" + tenantID.String()
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var cached map[string][]Permission
+			if json.Unmarshal([]byte(val), &cached) == nil {
+				return cached, nil
+			}
+		}
+	}
+
+	ancestors, err := gr.tenantAncestorIDs(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	chain := append(append([]string{}, ancestors...), tenantID.String())
+
+	var roles []TenantRole
+	if err := gr.db.Where("tenant_id IN ?", chain).Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	// Apply root first so nearer tenants overwrite
+	sort.SliceStable(roles, func(i, j int) bool {
+		return indexOf(chain, roles[i].TenantID.String()) < indexOf(chain, roles[j].TenantID.String())
+	})
+	resolved := make(map[string][]Permission, len(roles))
+	for _, role := range roles {
+		resolved[role.Name] = role.Permissions
+	}
+
+	if gr.redis != nil {
+		if data, err := json.Marshal(resolved); err == nil {
+			gr.redis.Set(ctx, cacheKey, data, rolePermissionsCacheTTL)
+		}
+	}
+
+	return resolved, nil
+}
+
+// validatePermissions checks permissions against the catalog
+func (gr *GuardRail) validatePermissions(permissions []Permission) error {
+	for _, p := range permissions {
+		if p != PermissionAll && !containsPermission(gr.config.Permissions, p) {
+			return fmt.Errorf("%w: %s", ErrUnknownPermission, p)
+		}
+	}
+	return nil
+}
+
+func containsPermission(permissions []Permission, permission Permission) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeRoleName trims a role name; role names are case-sensitive
+func normalizeRoleName(name string) string {
+	return strings.TrimSpace(name)
+}
@@ -0,0 +1,235 @@
+package guardrail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// RateLimitKey is the identity requests are counted by
+type RateLimitKey string
+
+const (
+	RateLimitByUser           RateLimitKey = "user_id"
+	RateLimitByTenant         RateLimitKey = "tenant_id"
+	RateLimitByApplicationKey RateLimitKey = "application_key"
+	RateLimitByIP             RateLimitKey = "ip"
+)
+
+// RateLimitAlgorithm decides how requests are spread over a period
+type RateLimitAlgorithm string
+
+const (
+	// RateLimitSlidingWindow allows Limit requests in any window of Period,
+	// estimated from the counts of the current and previous fixed windows
+	RateLimitSlidingWindow RateLimitAlgorithm = "sliding_window"
+	// RateLimitTokenBucket allows bursts of up to Limit requests and refills
+	// at Limit per Period
+	RateLimitTokenBucket RateLimitAlgorithm = "token_bucket"
+)
+
+// Headers set by the RateLimit middleware, following the IETF RateLimit header fields draft
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+)
+
+// RateLimitQuota is a number of requests per period. A Limit of 0 or less
+// means no limit.
+type RateLimitQuota struct {
+	Limit  int           `json:"limit"`
+	Period time.Duration `json:"period"`
+}
+
+// RateLimit is a rule for the RateLimit middleware
+type RateLimit struct {
+	// Separates counters of rules with the same Key (default: the Key)
+	Name      string
+	Key       RateLimitKey
+	Algorithm RateLimitAlgorithm // Default: RateLimitSlidingWindow
+	// Quota for tenants without a plan listed in Plans
+	RateLimitQuota
+	// Quotas by plan name, see TenantSettings.Plan
+	Plans map[string]RateLimitQuota
+}
+
+// RateLimitResult is the outcome of counting one request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Until the counter is back to its full quota
+	Reset time.Duration
+	// Until the next request would be allowed, when this one was not
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps rate limit counters. Take counts one request against
+// key and reports whether it fits the quota.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, algorithm RateLimitAlgorithm, quota RateLimitQuota) (RateLimitResult, error)
+}
+
+// RateLimit returns middleware that enforces the given rules, answering 429
+// with a Retry-After header once any of them is exhausted. Rules keyed by
+// user, tenant or application key need the middleware that establishes that
+// identity to run first; requests without it are counted by client IP.
+// Errors from the store are logged and let the request through.
+// Usage: app.Use(gr.Protect(), gr.RateLimit(guardrail.RateLimit{Key: guardrail.RateLimitByUser, RateLimitQuota: guardrail.RateLimitQuota{Limit: 100, Period: time.Minute}}))
+func (gr *GuardRail) RateLimit(rules ...RateLimit) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var plan string
+		if tenantID, ok := GetTenantID(c); ok {
+			if id, err := uuid.Parse(tenantID); err == nil {
+				settings, err := gr.effectiveSettings(id)
+				if err != nil {
+					return gr.respondError(c, err)
+				}
+				plan = settings.Plan
+			}
+		}
+
+		var reported *RateLimitResult
+		var reportedQuota RateLimitQuota
+		for _, rule := range rules {
+			quota := rule.quota(plan)
+			if quota.Limit <= 0 || quota.Period <= 0 {
+				continue
+			}
+
+			result, err := gr.config.RateLimitStore.Take(c.UserContext(), rule.counterKey(c), rule.algorithm(), quota)
+			if err != nil {
+				log.Printf("GuardRail rate limit error: %v", err)
+				continue
+			}
+			if !result.Allowed {
+				setRateLimitHeaders(c, result, quota)
+				c.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				return gr.respondError(c, reject(fiber.StatusTooManyRequests, gr.config.ErrorMessages.RateLimited))
+			}
+			if reported == nil || result.Remaining < reported.Remaining {
+				reported, reportedQuota = &result, quota
+			}
+		}
+
+		if reported != nil {
+			setRateLimitHeaders(c, *reported, reportedQuota)
+		}
+		return c.Next()
+	}
+}
+
+// quota returns the quota that applies to a tenant on the given plan
+func (r RateLimit) quota(plan string) RateLimitQuota {
+	if quota, ok := r.Plans[plan]; ok && plan != "" {
+		return quota
+	}
+	return r.RateLimitQuota
+}
+
+func (r RateLimit) algorithm() RateLimitAlgorithm {
+	if r.Algorithm == "" {
+		return RateLimitSlidingWindow
+	}
+	return r.Algorithm
+}
+
+// counterKey identifies the counter a request is counted against
+func (r RateLimit) counterKey(c *fiber.Ctx) string {
+	name := r.Name
+	if name == "" {
+		name = string(r.Key)
+	}
+
+	var id string
+	switch r.Key {
+	case RateLimitByUser:
+		id, _ = GetUserID(c)
+	case RateLimitByTenant:
+		id, _ = GetTenantID(c)
+	case RateLimitByApplicationKey:
+		id = applicationKeyID(c)
+	}
+	if id == "" {
+		return fmt.Sprintf("ratelimit:%s:ip:%s", name, c.IP())
+	}
+	return fmt.Sprintf("ratelimit:%s:%s:%s", name, r.Key, id)
+}
+
+// applicationKeyID returns the ID of the key ApplicationKeyMiddleware accepted
+func applicationKeyID(c *fiber.Ctx) string {
+	switch id := c.Locals("application_key_id").(type) {
+	case string:
+		return id
+	case uuid.UUID:
+		return id.String()
+	}
+	return ""
+}
+
+func setRateLimitHeaders(c *fiber.Ctx, result RateLimitResult, quota RateLimitQuota) {
+	c.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+	c.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+	c.Set(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(result.Reset)))
+	c.Set(HeaderRateLimitPolicy, fmt.Sprintf("%d;w=%d", quota.Limit, ceilSeconds(quota.Period)))
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// tokenBucketResult derives the result of a token bucket from the tokens
+// left after the request
+func tokenBucketResult(allowed bool, tokens float64, quota RateLimitQuota) RateLimitResult {
+	perToken := float64(quota.Period) / float64(quota.Limit)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     quota.Limit,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(quota.Limit) - tokens) * perToken),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * perToken)
+	}
+	return result
+}
+
+// slidingWindowResult derives the result of a sliding window from the counts
+// of the previous and current fixed window, elapsed time into the current
+// window, and the estimated number of requests in the sliding window
+func slidingWindowResult(allowed bool, estimate float64, previous, current int, elapsed time.Duration, quota RateLimitQuota) RateLimitResult {
+	limit := float64(quota.Limit)
+	period := float64(quota.Period)
+	untilNext := quota.Period - elapsed
+
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     quota.Limit,
+		Remaining: max(0, quota.Limit-int(math.Ceil(estimate))),
+		// The current window only drops out of the estimate one period after it ends
+		Reset: untilNext + quota.Period,
+	}
+	if current == 0 {
+		result.Reset = untilNext
+	}
+	if !allowed {
+		// Wait until the weight of the previous window has dropped enough,
+		// or into the next window if the current one alone is full
+		if float64(current) <= limit-1 && previous > 0 {
+			result.RetryAfter = untilNext - time.Duration((limit-1-float64(current))*period/float64(previous))
+		} else {
+			result.RetryAfter = untilNext + time.Duration(period*(1-(limit-1)/float64(current)))
+		}
+		result.RetryAfter = max(result.RetryAfter, 0)
+	}
+	return result
+}
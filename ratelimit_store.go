@@ -0,0 +1,211 @@
+package guardrail
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitSweepInterval is how often the memory store drops idle counters
+const rateLimitSweepInterval = time.Minute
+
+// MemoryRateLimitStore keeps counters in process memory. Each instance of
+// your app counts separately, so use Redis when running several.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	counters  map[string]*rateLimitCounter
+	lastSweep time.Time
+}
+
+type rateLimitCounter struct {
+	// Token bucket
+	tokens float64
+	last   time.Time
+	// Sliding window
+	window   int64
+	current  int
+	previous int
+
+	expiresAt time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: make(map[string]*rateLimitCounter)}
+}
+
+// Take counts one request against key
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, algorithm RateLimitAlgorithm, quota RateLimitQuota) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > rateLimitSweepInterval {
+		for k, counter := range s.counters {
+			if now.After(counter.expiresAt) {
+				delete(s.counters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	counter, ok := s.counters[key]
+	if !ok {
+		counter = &rateLimitCounter{tokens: float64(quota.Limit), last: now}
+		s.counters[key] = counter
+	}
+
+	switch algorithm {
+	case RateLimitTokenBucket:
+		elapsed := now.Sub(counter.last)
+		counter.tokens = math.Min(float64(quota.Limit), counter.tokens+float64(elapsed)*float64(quota.Limit)/float64(quota.Period))
+		counter.last = now
+		allowed := counter.tokens >= 1
+		if allowed {
+			counter.tokens--
+		}
+		counter.expiresAt = now.Add(quota.Period)
+		return tokenBucketResult(allowed, counter.tokens, quota), nil
+
+	case RateLimitSlidingWindow:
+		window := now.UnixNano() / int64(quota.Period)
+		switch counter.window {
+		case window:
+		case window - 1:
+			counter.previous, counter.current = counter.current, 0
+		default:
+			counter.previous, counter.current = 0, 0
+		}
+		counter.window = window
+
+		elapsed := time.Duration(now.UnixNano() - window*int64(quota.Period))
+		estimate := float64(counter.previous)*float64(quota.Period-elapsed)/float64(quota.Period) + float64(counter.current)
+		allowed := estimate+1 <= float64(quota.Limit)
+		if allowed {
+			counter.current++
+			estimate++
+		}
+		counter.expiresAt = now.Add(2 * quota.Period)
+		return slidingWindowResult(allowed, estimate, counter.previous, counter.current, elapsed, quota), nil
+	}
+
+	return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm: %s", algorithm)
+}
+
+// RedisRateLimitStore keeps counters in Redis, shared by every instance of
+// your app. Each request is counted by a single Lua script, so concurrent
+// requests can't slip past the limit, and the script uses the Redis clock
+// so app servers don't need synchronized clocks.
+type RedisRateLimitStore struct {
+	client redis.Scripter
+}
+
+// NewRedisRateLimitStore creates a store on a Redis client
+func NewRedisRateLimitStore(client redis.Scripter) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client}
+}
+
+// tokenBucketScript refills the bucket for the time since the last request
+// and takes a token. Returns allowed and the tokens left.
+var tokenBucketScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or limit
+local last = tonumber(state[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - last) * limit / period)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(period / 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// slidingWindowScript counts the request in the current fixed window if the
+// weighted estimate allows it. Returns allowed, the estimate, the previous
+// and current counts and the microseconds elapsed in the current window.
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = math.floor(now / period)
+local elapsed = now - window * period
+
+local state = redis.call('HMGET', KEYS[1], 'window', 'current', 'previous')
+local stored = tonumber(state[1])
+local current = tonumber(state[2]) or 0
+local previous = tonumber(state[3]) or 0
+if stored == window - 1 then
+	previous, current = current, 0
+elseif stored ~= window then
+	previous, current = 0, 0
+end
+
+local estimate = previous * (period - elapsed) / period + current
+local allowed = 0
+if estimate + 1 <= limit then
+	current = current + 1
+	estimate = estimate + 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'window', window, 'current', current, 'previous', previous)
+redis.call('PEXPIRE', KEYS[1], math.ceil(2 * period / 1000))
+return {allowed, tostring(estimate), previous, current, elapsed}
+`)
+
+// Take counts one request against key
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, algorithm RateLimitAlgorithm, quota RateLimitQuota) (RateLimitResult, error) {
+	periodMicros := quota.Period.Microseconds()
+
+	switch algorithm {
+	case RateLimitTokenBucket:
+		res, err := tokenBucketScript.Run(ctx, s.client, []string{key}, quota.Limit, periodMicros).Slice()
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		tokens, err := scriptFloat(res, 1)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return tokenBucketResult(res[0] == int64(1), tokens, quota), nil
+
+	case RateLimitSlidingWindow:
+		res, err := slidingWindowScript.Run(ctx, s.client, []string{key}, quota.Limit, periodMicros).Slice()
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		estimate, err := scriptFloat(res, 1)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		previous, _ := res[2].(int64)
+		current, _ := res[3].(int64)
+		elapsed, _ := res[4].(int64)
+		return slidingWindowResult(res[0] == int64(1), estimate, int(previous), int(current), time.Duration(elapsed)*time.Microsecond, quota), nil
+	}
+
+	return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm: %s", algorithm)
+}
+
+// scriptFloat reads a number a Lua script returned as a string, since Redis
+// truncates Lua numbers to integers
+func scriptFloat(res []interface{}, i int) (float64, error) {
+	if len(res) <= i {
+		return 0, fmt.Errorf("unexpected rate limit script result: %v", res)
+	}
+	s, _ := res[i].(string)
+	return strconv.ParseFloat(s, 64)
+}
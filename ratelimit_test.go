@@ -0,0 +1,149 @@
+package guardrail_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestRateLimitAlgorithms(t *testing.T) {
+	store := guardrail.NewMemoryRateLimitStore()
+	ctx := context.Background()
+
+	// Sliding window: three per minute, then wait for the window to slide
+	window := guardrail.RateLimitQuota{Limit: 3, Period: time.Minute}
+	for i := 0; i < 3; i++ {
+		result, err := store.Take(ctx, "window", guardrail.RateLimitSlidingWindow, window)
+		if err != nil || !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("Request %d: %+v, %v", i, result, err)
+		}
+	}
+	result, _ := store.Take(ctx, "window", guardrail.RateLimitSlidingWindow, window)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > 2*time.Minute {
+		t.Errorf("Expected fourth request to be limited, got %+v", result)
+	}
+	if other, _ := store.Take(ctx, "other", guardrail.RateLimitSlidingWindow, window); !other.Allowed {
+		t.Error("Expected keys to be counted separately")
+	}
+
+	// Token bucket: a burst of two, then one token back every 100ms
+	bucket := guardrail.RateLimitQuota{Limit: 2, Period: 200 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if result, _ := store.Take(ctx, "bucket", guardrail.RateLimitTokenBucket, bucket); !result.Allowed {
+			t.Fatalf("Request %d limited: %+v", i, result)
+		}
+	}
+	result, _ = store.Take(ctx, "bucket", guardrail.RateLimitTokenBucket, bucket)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > 100*time.Millisecond {
+		t.Errorf("Expected empty bucket, got %+v", result)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if result, _ := store.Take(ctx, "bucket", guardrail.RateLimitTokenBucket, bucket); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected one refilled token, got %+v", result)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+	free, _ := ts.CreateTenant("Free")
+	pro, _ := ts.CreateTenant("Pro")
+	plan := "pro"
+	ts.UpdateSettings(pro.ID.String(), guardrail.TenantSettings{Plan: &plan})
+
+	token := func(email string, tenantID string) string {
+		resp, err := as.Register(guardrail.RegisterRequest{Email: email, Password: "correct-horse-battery", TenantID: tenantID})
+		if err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+		return resp.AccessToken
+	}
+	alice := token("alice@example.test", free.ID.String())
+	bob := token("bob@example.test", free.ID.String())
+	carol := token("carol@example.test", pro.ID.String())
+
+	app := fiber.New()
+	app.Use(gr.Protect(), gr.RateLimit(guardrail.RateLimit{
+		Key:            guardrail.RateLimitByTenant,
+		RateLimitQuota: guardrail.RateLimitQuota{Limit: 2, Period: time.Minute},
+		Plans:          map[string]guardrail.RateLimitQuota{"pro": {Limit: 5, Period: time.Minute}},
+	}))
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	get := func(token string) *http.Response {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp
+	}
+
+	first := get(alice)
+	if first.StatusCode != fiber.StatusOK || first.Header.Get(guardrail.HeaderRateLimitLimit) != "2" ||
+		first.Header.Get(guardrail.HeaderRateLimitRemaining) != "1" || first.Header.Get(guardrail.HeaderRateLimitPolicy) != "2;w=60" {
+		t.Errorf("Unexpected first response: %d %v", first.StatusCode, first.Header)
+	}
+	// Users of one tenant share its quota
+	get(bob)
+	limited := get(alice)
+	if limited.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", limited.StatusCode)
+	}
+	if retry, err := strconv.Atoi(limited.Header.Get(fiber.HeaderRetryAfter)); err != nil || retry <= 0 {
+		t.Errorf("Expected Retry-After, got %q", limited.Header.Get(fiber.HeaderRetryAfter))
+	}
+
+	// The pro plan gets its own, larger quota
+	for i := 0; i < 5; i++ {
+		if resp := get(carol); resp.StatusCode != fiber.StatusOK || resp.Header.Get(guardrail.HeaderRateLimitLimit) != "5" {
+			t.Fatalf("Pro request %d: %d %v", i, resp.StatusCode, resp.Header)
+		}
+	}
+	if resp := get(carol); resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Errorf("Expected pro quota to run out, got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimitByApplicationKey(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true})
+	ts := gr.NewTenantService()
+	tenant, _ := ts.CreateTenant("Acme")
+	first, _ := ts.CreateApplicationKey(tenant.ID.String(), "first", nil)
+	second, _ := ts.CreateApplicationKey(tenant.ID.String(), "second", nil)
+
+	app := fiber.New()
+	app.Use(gr.ApplicationKeyMiddleware(), gr.RateLimit(guardrail.RateLimit{
+		Key:            guardrail.RateLimitByApplicationKey,
+		RateLimitQuota: guardrail.RateLimitQuota{Limit: 2, Period: time.Minute},
+	}))
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	get := func(key string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(guardrail.HeaderApplicationKey, key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	// All requests come from the same IP, so only per-key counters tell them apart
+	get(first.Key)
+	get(first.Key)
+	if code := get(first.Key); code != fiber.StatusTooManyRequests {
+		t.Errorf("Expected the first key to run out, got %d", code)
+	}
+	if code := get(second.Key); code != fiber.StatusOK {
+		t.Errorf("Expected the second key to have its own quota, got %d", code)
+	}
+}
@@ -0,0 +1,221 @@
+package guardrail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+	"gorm.io/gorm"
+)
+
+// Recovery codes come in batches of recoveryCodeCount, each recoveryCodeLength
+// characters from recoveryCodeAlphabet (50 bits), shown as two groups of five
+const (
+	recoveryCodeCount    = 10
+	recoveryCodeLength   = 10
+	recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+)
+
+// ErrMFANotEnabled is returned when recovery codes are requested by a user
+// without a second factor to recover
+var ErrMFANotEnabled = errors.New("set up a second factor before generating recovery codes")
+
+// RecoveryCode is one of a user's single-use MFA recovery codes
+type RecoveryCode struct {
+	ID     uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserID uuid.UUID `gorm:"type:uuid;not null;index"`
+	// Keyed hash of the code, see recoveryCodeHash
+	CodeHash  string `gorm:"not null;uniqueIndex"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for RecoveryCode model
+func (RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// BeforeCreate assigns the code ID
+func (c *RecoveryCode) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes replaces a user's recovery codes with a new batch
+// and returns it. The codes are only stored hashed, so this is the one time
+// they can be shown. Needs the password, like DisableTOTP, and a second
+// factor the codes stand in for.
+func (as *AuthService) GenerateRecoveryCodes(userID, currentPassword string) ([]string, error) {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return nil, err
+	}
+	methods, err := as.gr.mfaMethods(*user)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) == 0 {
+		return nil, ErrMFANotEnabled
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hash, err := as.gr.recoveryCodeHash(user.ID, codes[i])
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = RecoveryCode{UserID: user.ID, CodeHash: hash}
+	}
+
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditRecoveryCodesGenerated,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+	})
+	return codes, nil
+}
+
+// dropOrphanedRecoveryCodes deletes a user's recovery codes once their last
+// second factor is gone, so old codes don't come back with the next one
+func dropOrphanedRecoveryCodes(tx *gorm.DB, userID uuid.UUID) error {
+	var totp, passkeys int64
+	if err := tx.Model(&TOTPFactor{}).Where("user_id = ? AND confirmed_at IS NOT NULL", userID).Count(&totp).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Credential{}).Where("user_id = ?", userID).Count(&passkeys).Error; err != nil {
+		return err
+	}
+	if totp+passkeys > 0 {
+		return nil
+	}
+	return tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+// RecoveryCodesRemaining returns how many of a user's recovery codes are unused
+func (as *AuthService) RecoveryCodesRemaining(userID string) (int, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user_id: %w", err)
+	}
+	return as.gr.unusedRecoveryCodes(uid)
+}
+
+// useRecoveryCode spends one of user's recovery codes, telling the user so
+// that a code used by someone else does not go unnoticed
+func (gr *GuardRail) useRecoveryCode(user User, code string) (bool, error) {
+	hash, err := gr.recoveryCodeHash(user.ID, code)
+	if err != nil {
+		return false, err
+	}
+	result := gr.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, fmt.Errorf("database error: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	remaining, err := gr.unusedRecoveryCodes(user.ID)
+	if err != nil {
+		return false, err
+	}
+	gr.audit(AuditEvent{
+		Action:   AuditRecoveryCodeUsed,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"remaining": strconv.Itoa(remaining)},
+	})
+	err = gr.config.Notifier.Notify(context.Background(), Notification{
+		Type:     NotificationRecoveryCodeUsed,
+		To:       user.Email,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Data:     map[string]string{"first_name": user.FirstName, "remaining": strconv.Itoa(remaining)},
+	})
+	if err != nil {
+		logNotifyError(err)
+	}
+	return true, nil
+}
+
+func (gr *GuardRail) unusedRecoveryCodes(userID uuid.UUID) (int, error) {
+	var count int64
+	if err := gr.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	return int(count), nil
+}
+
+// recoveryCodeHash hashes a code with a key derived like the one in
+// secretCipher, so a leaked table can't be brute forced on its own
+func (gr *GuardRail) recoveryCodeHash(userID uuid.UUID, code string) (string, error) {
+	master := []byte(gr.config.EncryptionKey)
+	if len(master) == 0 {
+		master = gr.jwtSecret
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("guardrail recovery codes")), key); err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(userID[:])
+	mac.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes as users type codes
+// in all sorts of ways
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// newRecoveryCode returns a random code formatted as xxxxx-xxxxx
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	// The alphabet has 32 characters, so the low five bits are uniform
+	code := make([]byte, 0, recoveryCodeLength+1)
+	for i, b := range buf {
+		if i == recoveryCodeLength/2 {
+			code = append(code, '-')
+		}
+		code = append(code, recoveryCodeAlphabet[b&0x1f])
+	}
+	return string(code), nil
+}
@@ -0,0 +1,132 @@
+package guardrail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Postgres settings read by row-level security policies
+const (
+	rlsTenantSetting = "app.tenant_id"
+	rlsUserSetting   = "app.user_id"
+	rlsPolicyName    = "guardrail_tenant_isolation"
+)
+
+// TenantTransaction returns middleware that runs the rest of the request in a
+// database transaction bound to the verified tenant and user. On PostgreSQL
+// app.tenant_id and app.user_id are set for the transaction only, so
+// row-level security policies (see EnableRowLevelSecurity) apply to every
+// statement the handler runs through gr.DB(c).
+//
+// The transaction commits when the handler succeeds and rolls back when it
+// returns an error, panics or responds with a 4xx/5xx status.
+// Usage: app.Get("/orders", gr.ProtectTenant(), gr.TenantTransaction(), handler)
+func (gr *GuardRail) TenantTransaction() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID, ok := GetTenantID(c)
+		if gr.config.EnableMultiTenant && !ok {
+			return gr.respondError(c, reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden))
+		}
+		userID, _ := GetUserID(c)
+
+		tx := gr.db.WithContext(c.UserContext()).Begin()
+		if tx.Error != nil {
+			return gr.respondError(c, fmt.Errorf("failed to begin request transaction: %w", tx.Error))
+		}
+
+		done := false
+		defer func() {
+			if !done {
+				tx.Rollback()
+			}
+		}()
+
+		if err := setTransactionIdentity(tx, tenantID, userID); err != nil {
+			return gr.respondError(c, err)
+		}
+
+		c.Locals("db", tx)
+		err := c.Next()
+		c.Locals("db", nil)
+
+		done = true
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return gr.respondError(c, fmt.Errorf("failed to commit request transaction: %w", err))
+		}
+		return nil
+	}
+}
+
+// setTransactionIdentity exposes the request identity to RLS policies.
+// set_config with is_local behaves like SET LOCAL but takes parameters.
+// Other databases have no equivalent, there the transaction is all you get.
+func setTransactionIdentity(tx *gorm.DB, tenantID, userID string) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	err := tx.Exec("SELECT set_config(?, ?, true), set_config(?, ?, true)",
+		rlsTenantSetting, tenantID, rlsUserSetting, userID).Error
+	if err != nil {
+		return fmt.Errorf("failed to set request identity: %w", err)
+	}
+	return nil
+}
+
+// GetDB returns the request transaction opened by TenantTransaction
+func GetDB(c *fiber.Ctx) (*gorm.DB, bool) {
+	db, ok := c.Locals("db").(*gorm.DB)
+	return db, ok
+}
+
+// RowLevelSecurityPolicy returns the statements that restrict a table to the
+// rows of the tenant in app.tenant_id, for use with your own migration tool.
+// Requests without the setting see no rows at all.
+func RowLevelSecurityPolicy(table, column string) []string {
+	t, col := quoteIdentifier(table), quoteIdentifier(column)
+	check := fmt.Sprintf("%s::text = current_setting('%s', true)", col, rlsTenantSetting)
+	return []string{
+		"ALTER TABLE " + t + " ENABLE ROW LEVEL SECURITY",
+		"ALTER TABLE " + t + " FORCE ROW LEVEL SECURITY",
+		"DROP POLICY IF EXISTS " + rlsPolicyName + " ON " + t,
+		"CREATE POLICY " + rlsPolicyName + " ON " + t + " USING (" + check + ") WITH CHECK (" + check + ")",
+	}
+}
+
+// EnableRowLevelSecurity creates tenant isolation policies for the tables of
+// the given models, using the column each model names in TenantColumn.
+// It is safe to run repeatedly. PostgreSQL only.
+//
+// Policies also apply to the table owner, so cross-tenant jobs need a role
+// with BYPASSRLS rather than WithoutTenantScope.
+func (gr *GuardRail) EnableRowLevelSecurity(models ...TenantScopedModel) error {
+	if gr.db.Dialector.Name() != "postgres" {
+		return fmt.Errorf("row-level security requires PostgreSQL, got %s", gr.db.Dialector.Name())
+	}
+
+	return gr.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range models {
+			stmt := &gorm.Statement{DB: tx}
+			if err := stmt.Parse(model); err != nil {
+				return fmt.Errorf("failed to parse model %T: %w", model, err)
+			}
+			for _, sql := range RowLevelSecurityPolicy(stmt.Schema.Table, model.TenantColumn()) {
+				if err := tx.Exec(sql).Error; err != nil {
+					return fmt.Errorf("failed to enable row-level security on %s: %w", stmt.Schema.Table, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
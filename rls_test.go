@@ -0,0 +1,90 @@
+package guardrail_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestTenantTransaction(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	if err := db.AutoMigrate(&scopedNote{}); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+	tenant, _ := gr.NewTenantService().CreateTenant("Acme")
+	auth, err := gr.NewAuthService().Register(guardrail.RegisterRequest{
+		Email:    "user@acme.test",
+		Password: "correct-horse-battery",
+		TenantID: tenant.ID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Post("/notes", gr.Protect(), gr.TenantTransaction(), func(c *fiber.Ctx) error {
+		tx, ok := guardrail.GetDB(c)
+		if !ok {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := tx.Create(&scopedNote{Body: c.Query("body")}).Error; err != nil {
+			return err
+		}
+		if c.Query("fail") != "" {
+			return c.SendStatus(fiber.StatusConflict)
+		}
+		return c.SendStatus(fiber.StatusCreated)
+	})
+	app.Get("/unprotected", gr.TenantTransaction(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if got := do("POST", "/notes?body=kept", auth.AccessToken); got != fiber.StatusCreated {
+		t.Fatalf("Expected 201, got %d", got)
+	}
+	if got := do("POST", "/notes?body=dropped&fail=1", auth.AccessToken); got != fiber.StatusConflict {
+		t.Fatalf("Expected 409, got %d", got)
+	}
+	if got := do("GET", "/unprotected", ""); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 without a verified tenant, got %d", got)
+	}
+
+	var bodies []string
+	ctx := guardrail.WithTenant(context.Background(), tenant.ID.String())
+	if err := db.WithContext(ctx).Model(&scopedNote{}).Pluck("body", &bodies).Error; err != nil {
+		t.Fatalf("Pluck failed: %v", err)
+	}
+	if strings.Join(bodies, ",") != "kept" {
+		t.Errorf("Expected only the committed note, got %v", bodies)
+	}
+}
+
+func TestRowLevelSecurityPolicy(t *testing.T) {
+	stmts := guardrail.RowLevelSecurityPolicy("orders", "tenant_id")
+	if len(stmts) != 4 {
+		t.Fatalf("Expected 4 statements, got %d", len(stmts))
+	}
+	want := `CREATE POLICY guardrail_tenant_isolation ON "orders" USING ("tenant_id"::text = current_setting('app.tenant_id', true)) WITH CHECK ("tenant_id"::text = current_setting('app.tenant_id', true))`
+	if stmts[3] != want {
+		t.Errorf("Unexpected policy:\n%s", stmts[3])
+	}
+
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	if err := gr.EnableRowLevelSecurity(scopedNote{}); err == nil {
+		t.Error("Expected EnableRowLevelSecurity to refuse non-PostgreSQL databases")
+	}
+}
@@ -0,0 +1,369 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrRoleNotFound is returned when a custom role does not exist in the tenant
+	ErrRoleNotFound = errors.New("role not found")
+	// ErrRoleExists is returned when a role name is taken or reserved
+	ErrRoleExists = errors.New("role already exists")
+)
+
+// TenantRole is a role defined by a tenant at runtime, built from the
+// permission catalog. Descendant tenants can use the roles of their ancestors.
+type TenantRole struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key"`
+	TenantID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_tenant_roles_tenant_name"`
+	Name        string    `gorm:"not null;uniqueIndex:idx_tenant_roles_tenant_name"`
+	Description string
+	Permissions []Permission `gorm:"serializer:json"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// TableName specifies the table name for TenantRole model
+func (TenantRole) TableName() string {
+	return "tenant_roles"
+}
+
+// BeforeCreate assigns the role ID
+func (r *TenantRole) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// RoleRequest describes a custom role to create or replace
+type RoleRequest struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// RoleService lets tenant admins manage custom roles. Every method acts on
+// behalf of actorID, who needs PermissionManageRoles in the tenant and can
+// only grant permissions they hold themselves.
+type RoleService struct {
+	gr *GuardRail
+}
+
+// NewRoleService creates a new role service instance
+func (gr *GuardRail) NewRoleService() *RoleService {
+	return &RoleService{gr: gr}
+}
+
+// ListRoles returns the custom roles defined by a tenant
+func (rs *RoleService) ListRoles(tenantID string) ([]TenantRole, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var roles []TenantRole
+	if err := rs.gr.db.Where("tenant_id = ?", id).Order("name").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return roles, nil
+}
+
+// CreateRole defines a new custom role in a tenant
+func (rs *RoleService) CreateRole(actorID, tenantID string, req RoleRequest) (*TenantRole, error) {
+	tenant, held, err := rs.authorize(actorID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.checkRequest(tenant.ID, "", req, held); err != nil {
+		return nil, err
+	}
+
+	role := TenantRole{
+		TenantID:    tenant.ID,
+		Name:        normalizeRoleName(req.Name),
+		Description: req.Description,
+		Permissions: req.Permissions,
+	}
+	if err := rs.gr.db.Create(&role).Error; err != nil {
+		return nil, fmt.Errorf("failed to create role: %w", err)
+	}
+
+	rs.gr.invalidateTenantSubtree(tenant)
+	return &role, nil
+}
+
+// UpdateRole replaces the name, description and permissions of a custom
+// role. A rename is applied to the memberships of the tenant and its
+// sub-tenants as well.
+func (rs *RoleService) UpdateRole(actorID, tenantID, roleID string, req RoleRequest) (*TenantRole, error) {
+	tenant, held, err := rs.authorize(actorID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := rs.getRole(tenant.ID, roleID)
+	if err != nil {
+		return nil, err
+	}
+	// Editing a role must not let the actor take away more than they could grant
+	if err := requireHeld(held, rs.gr.expandPermissions(role.Permissions)); err != nil {
+		return nil, err
+	}
+	if err := rs.checkRequest(tenant.ID, role.Name, req, held); err != nil {
+		return nil, err
+	}
+
+	oldName := role.Name
+	role.Name = normalizeRoleName(req.Name)
+	role.Description = req.Description
+	role.Permissions = req.Permissions
+	err = rs.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(role).Select("name", "description", "permissions").Updates(role).Error; err != nil {
+			return err
+		}
+		if role.Name != oldName {
+			return renameMemberRole(tx, tenant, oldName, role.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update role: %w", err)
+	}
+
+	rs.gr.invalidateTenantSubtree(tenant)
+	return role, nil
+}
+
+// DeleteRole removes a custom role and takes it away from the members of the
+// tenant and its sub-tenants
+func (rs *RoleService) DeleteRole(actorID, tenantID, roleID string) error {
+	tenant, held, err := rs.authorize(actorID, tenantID)
+	if err != nil {
+		return err
+	}
+	role, err := rs.getRole(tenant.ID, roleID)
+	if err != nil {
+		return err
+	}
+	if err := requireHeld(held, rs.gr.expandPermissions(role.Permissions)); err != nil {
+		return err
+	}
+
+	err = rs.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(role).Error; err != nil {
+			return err
+		}
+		return renameMemberRole(tx, tenant, role.Name, "")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+
+	rs.gr.invalidateTenantSubtree(tenant)
+	return nil
+}
+
+// AssignRoles replaces the roles of a member, as long as the actor holds
+// every permission the member's current and new roles grant
+func (rs *RoleService) AssignRoles(actorID, tenantID, userID string, roles []string) error {
+	tenant, held, err := rs.authorize(actorID, tenantID)
+	if err != nil {
+		return err
+	}
+	if err := rs.gr.checkRolesExist(tenant.ID, roles); err != nil {
+		return err
+	}
+
+	membership, err := rs.gr.NewTenantService().getMembership(tenantID, userID)
+	if err != nil {
+		return err
+	}
+	current, err := rs.gr.permissionsFor(tenant.ID, membership.Roles)
+	if err != nil {
+		return err
+	}
+	if err := requireHeld(held, current); err != nil {
+		return err
+	}
+
+	granted, err := rs.gr.permissionsFor(tenant.ID, roles)
+	if err != nil {
+		return err
+	}
+	if err := requireHeld(held, granted); err != nil {
+		return err
+	}
+
+	return rs.gr.NewTenantService().UpdateMemberRoles(tenantID, userID, roles)
+}
+
+// Permissions returns the effective permissions of a user in a tenant
+func (rs *RoleService) Permissions(userID, tenantID string) ([]Permission, error) {
+	tid, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+
+	var user User
+	if err := rs.gr.db.Where("id = ? AND is_active = true", uid).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotTenantMember
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	roles, err := rs.gr.tenantRoles(user, tid)
+	if err != nil {
+		return nil, err
+	}
+	return rs.gr.permissionsFor(tid, roles)
+}
+
+// authorize loads the tenant and the actor's permissions in it, requiring
+// PermissionManageRoles
+func (rs *RoleService) authorize(actorID, tenantID string) (*Tenant, []Permission, error) {
+	tenant, err := rs.gr.NewTenantService().GetTenant(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	held, err := rs.Permissions(actorID, tenantID)
+	if errors.Is(err, ErrNotTenantMember) {
+		return nil, nil, ErrPermissionDenied
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !containsPermission(held, PermissionManageRoles) {
+		return nil, nil, ErrPermissionDenied
+	}
+
+	return tenant, held, nil
+}
+
+// checkRequest validates a role request: a free, non-reserved name and
+// catalog permissions the actor holds
+func (rs *RoleService) checkRequest(tenantID uuid.UUID, currentName string, req RoleRequest, held []Permission) error {
+	name := normalizeRoleName(req.Name)
+	if name == "" {
+		return fmt.Errorf("role name is required")
+	}
+	if rs.gr.reservedRole(name) {
+		return ErrRoleExists
+	}
+	if name != currentName {
+		var count int64
+		if err := rs.gr.db.Model(&TenantRole{}).Where("tenant_id = ? AND name = ?", tenantID, name).Count(&count).Error; err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if count > 0 {
+			return ErrRoleExists
+		}
+	}
+
+	if err := rs.gr.validatePermissions(req.Permissions); err != nil {
+		return err
+	}
+	return requireHeld(held, rs.gr.expandPermissions(req.Permissions))
+}
+
+func (rs *RoleService) getRole(tenantID uuid.UUID, roleID string) (*TenantRole, error) {
+	id, err := uuid.Parse(roleID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid role_id: %w", err)
+	}
+
+	var role TenantRole
+	if err := rs.gr.db.Where("id = ? AND tenant_id = ?", id, tenantID).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRoleNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &role, nil
+}
+
+// requireHeld fails unless every wanted permission is among the held ones
+func requireHeld(held, wanted []Permission) error {
+	for _, p := range wanted {
+		if !containsPermission(held, p) {
+			return fmt.Errorf("%w: %s", ErrPermissionDenied, p)
+		}
+	}
+	return nil
+}
+
+// renameMemberRole renames a role in the memberships of a tenant and its
+// descendants, which hold it through inheritance, or removes it when newName
+// is empty. Subtrees that define a role of the same name keep theirs.
+func renameMemberRole(tx *gorm.DB, tenant *Tenant, oldName, newName string) error {
+	var subtree []Tenant
+	if err := tx.Unscoped().Select("id", "path").Where("path LIKE ?", tenant.Path+"%").Find(&subtree).Error; err != nil {
+		return err
+	}
+	ids := make([]uuid.UUID, 0, len(subtree))
+	for _, t := range subtree {
+		ids = append(ids, t.ID)
+	}
+
+	var shadowing []TenantRole
+	if err := tx.Where("name = ? AND tenant_id IN ? AND tenant_id <> ?", oldName, ids, tenant.ID).Find(&shadowing).Error; err != nil {
+		return err
+	}
+	if len(shadowing) > 0 {
+		var shadowPaths []string
+		for _, t := range subtree {
+			for _, r := range shadowing {
+				if r.TenantID == t.ID {
+					shadowPaths = append(shadowPaths, t.Path)
+				}
+			}
+		}
+		ids = ids[:0]
+		for _, t := range subtree {
+			shadowed := false
+			for _, p := range shadowPaths {
+				shadowed = shadowed || strings.HasPrefix(t.Path, p)
+			}
+			if !shadowed {
+				ids = append(ids, t.ID)
+			}
+		}
+	}
+
+	var memberships []Membership
+	if err := tx.Where("tenant_id IN ?", ids).Find(&memberships).Error; err != nil {
+		return err
+	}
+
+	for i := range memberships {
+		m := &memberships[i]
+		if !containsString(m.Roles, oldName) {
+			continue
+		}
+		roles := make([]string, 0, len(m.Roles))
+		for _, r := range m.Roles {
+			switch {
+			case r != oldName:
+				roles = append(roles, r)
+			case newName != "":
+				roles = append(roles, newName)
+			}
+		}
+		m.Roles = roles
+		if err := tx.Model(m).Select("roles").Updates(m).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
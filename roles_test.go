@@ -0,0 +1,165 @@
+package guardrail_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestCustomRoles(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		EnableMultiTenant:     true,
+		AllowSelfRegistration: true,
+		EnableRBAC:            true,
+		Permissions:           []guardrail.Permission{"shipments.read", "shipments.create", "invoices.read"},
+		RolePermissions: map[string][]guardrail.Permission{
+			"admin":   {guardrail.PermissionAll},
+			"manager": {guardrail.PermissionManageRoles, "shipments.read"},
+			"user":    {},
+		},
+	})
+	ts := gr.NewTenantService()
+	rs := gr.NewRoleService()
+	as := gr.NewAuthService()
+
+	tenant, _ := ts.CreateTenant("Acme")
+	child, _ := ts.CreateSubTenant(tenant.ID.String(), "Acme EU")
+	register := func(email, role string) string {
+		resp, err := as.Register(guardrail.RegisterRequest{Email: email, Password: "correct-horse-battery", TenantID: tenant.ID.String()})
+		if err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+		if err := ts.UpdateMemberRoles(tenant.ID.String(), resp.UserID, []string{role}); err != nil {
+			t.Fatalf("UpdateMemberRoles failed: %v", err)
+		}
+		return resp.UserID
+	}
+	admin := register("admin@acme.test", "admin")
+	manager := register("manager@acme.test", "manager")
+	worker := register("worker@acme.test", "user")
+
+	lead := guardrail.RoleRequest{Name: "Warehouse Lead", Permissions: []guardrail.Permission{"shipments.read", "shipments.create"}}
+	if _, err := rs.CreateRole(worker, tenant.ID.String(), lead); !errors.Is(err, guardrail.ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied without roles.manage, got %v", err)
+	}
+	if _, err := rs.CreateRole(manager, tenant.ID.String(), lead); !errors.Is(err, guardrail.ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied granting an unheld permission, got %v", err)
+	}
+	if _, err := rs.CreateRole(admin, tenant.ID.String(), guardrail.RoleRequest{Name: "x", Permissions: []guardrail.Permission{"nukes.launch"}}); !errors.Is(err, guardrail.ErrUnknownPermission) {
+		t.Errorf("Expected ErrUnknownPermission, got %v", err)
+	}
+	if _, err := rs.CreateRole(admin, tenant.ID.String(), guardrail.RoleRequest{Name: "admin"}); !errors.Is(err, guardrail.ErrRoleExists) {
+		t.Errorf("Expected ErrRoleExists for a built-in name, got %v", err)
+	}
+
+	role, err := rs.CreateRole(admin, tenant.ID.String(), lead)
+	if err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	if err := rs.AssignRoles(manager, tenant.ID.String(), worker, []string{"Warehouse Lead"}); !errors.Is(err, guardrail.ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied assigning a stronger role, got %v", err)
+	}
+	if err := rs.AssignRoles(admin, tenant.ID.String(), worker, []string{"Warehouse Lead"}); err != nil {
+		t.Fatalf("AssignRoles failed: %v", err)
+	}
+	// Undefined names grant no permissions but would still pass role checks
+	if err := rs.AssignRoles(manager, tenant.ID.String(), manager, []string{"superuser"}); !errors.Is(err, guardrail.ErrUnknownRole) {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+	if err := rs.AssignRoles(manager, tenant.ID.String(), admin, []string{"user"}); !errors.Is(err, guardrail.ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied replacing a stronger member's roles, got %v", err)
+	}
+
+	login, err := as.Login(guardrail.LoginRequest{Email: "worker@acme.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	app := fiber.New()
+	app.Post("/shipments", gr.RequirePermission("shipments.create"), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Get("/invoices", gr.RequirePermission("invoices.read"), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	status := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+	if got := status("POST", "/shipments"); got != fiber.StatusOK {
+		t.Errorf("Expected 200 through custom role, got %d", got)
+	}
+	if got := status("GET", "/invoices"); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 for permission outside the role, got %d", got)
+	}
+
+	// Edits apply to existing tokens
+	if _, err := rs.UpdateRole(admin, tenant.ID.String(), role.ID.String(), guardrail.RoleRequest{Name: "Shift Lead", Permissions: []guardrail.Permission{"shipments.read"}}); err != nil {
+		t.Fatalf("UpdateRole failed: %v", err)
+	}
+	perms, _ := rs.Permissions(worker, tenant.ID.String())
+	if len(perms) != 1 || perms[0] != "shipments.read" {
+		t.Errorf("Expected renamed role to follow the member, got %v", perms)
+	}
+	if got := status("POST", "/shipments"); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 after the permission was removed, got %d", got)
+	}
+
+	// Sub-tenants can use the roles of their ancestors
+	ts.AddMember(child.ID.String(), worker, []string{"Shift Lead"})
+	if perms, _ := rs.Permissions(worker, child.ID.String()); len(perms) != 1 {
+		t.Errorf("Expected inherited role definition in sub-tenant, got %v", perms)
+	}
+	childRoles := func() []string {
+		members, _ := ts.ListMembers(child.ID.String())
+		for _, m := range members {
+			if m.UserID.String() == worker {
+				return m.Roles
+			}
+		}
+		return nil
+	}
+	if _, err := rs.UpdateRole(admin, tenant.ID.String(), role.ID.String(), guardrail.RoleRequest{Name: "Dock Lead", Permissions: []guardrail.Permission{"shipments.read"}}); err != nil {
+		t.Fatalf("UpdateRole failed: %v", err)
+	}
+	if roles := childRoles(); len(roles) != 1 || roles[0] != "Dock Lead" {
+		t.Errorf("Expected the rename to reach sub-tenant memberships, got %v", roles)
+	}
+
+	if err := rs.DeleteRole(admin, tenant.ID.String(), role.ID.String()); err != nil {
+		t.Fatalf("DeleteRole failed: %v", err)
+	}
+	if perms, err := rs.Permissions(worker, tenant.ID.String()); err != nil || len(perms) != 0 {
+		t.Errorf("Expected a member without permissions after the role was deleted, got %v (%v)", perms, err)
+	}
+	if roles := childRoles(); len(roles) != 0 {
+		t.Errorf("Expected the deleted role to be gone from sub-tenant memberships, got %v", roles)
+	}
+}
+
+func TestReservedRoleNames(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{
+		EnableMultiTenant:     true,
+		AllowSelfRegistration: true,
+		EnableRBAC:            true,
+		RolePermissions:       map[string][]guardrail.Permission{"manager": {guardrail.PermissionManageRoles}},
+		ReservedRoles:         []string{"billing"},
+	})
+	ts := gr.NewTenantService()
+	tenant, _ := ts.CreateTenant("Acme")
+	resp, err := gr.NewAuthService().Register(guardrail.RegisterRequest{Email: "manager@acme.test", Password: "correct-horse-battery", TenantID: tenant.ID.String()})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	ts.UpdateMemberRoles(tenant.ID.String(), resp.UserID, []string{"manager"})
+
+	// Names the app checks with ProtectWithRole can't be defined by tenants
+	for _, name := range []string{"admin", "Admin", "user", "billing", "manager"} {
+		if _, err := gr.NewRoleService().CreateRole(resp.UserID, tenant.ID.String(), guardrail.RoleRequest{Name: name}); !errors.Is(err, guardrail.ErrRoleExists) {
+			t.Errorf("Expected %q to be reserved, got %v", name, err)
+		}
+	}
+}
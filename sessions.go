@@ -0,0 +1,85 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// sessionVersionCacheTTL bounds how long a cached session version is trusted
+const sessionVersionCacheTTL = 5 * time.Minute
+
+// ErrSessionRevoked is returned for tokens issued before the user's sessions were revoked
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// checkSessionVersion rejects tokens issued before the user's sessions were
+// last revoked. Tokens carry the version in the "sv" claim; tokens without
+// one predate revocation and count as version 0.
+func (gr *GuardRail) checkSessionVersion(claims jwt.MapClaims) error {
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return nil
+	}
+	tokenVersion, _ := claims["sv"].(float64)
+
+	current, err := gr.sessionVersion(userID)
+	if err != nil {
+		return err
+	}
+	if int(tokenVersion) != current {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// sessionVersion returns the current session version of a user
+func (gr *GuardRail) sessionVersion(userID string) (int, error) {
+	ctx := context.Background()
+	cacheKey := "session_version:" + userID
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Int(); err == nil {
+			return val, nil
+		}
+	}
+
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return 0, ErrSessionRevoked
+	}
+	var user User
+	if err := gr.db.Select("session_version").Where("id = ?", id).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrSessionRevoked
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if gr.redis != nil {
+		gr.redis.Set(ctx, cacheKey, strconv.Itoa(user.SessionVersion), sessionVersionCacheTTL)
+	}
+	return user.SessionVersion, nil
+}
+
+// revokeSessions invalidates every access and refresh token of a user.
+// Call forgetSessionVersion once the surrounding transaction has committed.
+func (gr *GuardRail) revokeSessions(tx *gorm.DB, user *User) error {
+	if err := tx.Model(user).UpdateColumn("session_version", gorm.Expr("session_version + 1")).Error; err != nil {
+		return err
+	}
+	user.SessionVersion++
+	return nil
+}
+
+// forgetSessionVersion drops the cached session version of a user
+func (gr *GuardRail) forgetSessionVersion(userID uuid.UUID) {
+	if gr.redis != nil {
+		gr.redis.Del(context.Background(), "session_version:"+userID.String())
+	}
+}
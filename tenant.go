@@ -0,0 +1,254 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TenantStatus describes whether a tenant is allowed to authenticate
+type TenantStatus string
+
+const (
+	TenantStatusActive    TenantStatus = "active"
+	TenantStatusSuspended TenantStatus = "suspended"
+)
+
+var (
+	// ErrTenantNotFound is returned when a tenant does not exist or was deleted
+	ErrTenantNotFound = errors.New("tenant not found")
+	// ErrTenantSuspended is returned when a tenant exists but is suspended
+	ErrTenantSuspended = errors.New("tenant is suspended")
+)
+
+// tenantStatusCacheTTL bounds how long a tenant status is cached in Redis.
+// Status changes made through TenantService invalidate the entry immediately.
+const tenantStatusCacheTTL = 5 * time.Minute
+
+// Tenant represents an isolated customer account in multi-tenant mode
+type Tenant struct {
+	ID          uuid.UUID    `gorm:"type:uuid;primary_key"`
+	Name        string       `gorm:"not null"`
+	Status      TenantStatus `gorm:"type:varchar(20);default:'active';index"`
+	SuspendedAt *time.Time
+	// Optional parent for sub-tenants, see tenant_hierarchy.go
+	ParentID *uuid.UUID `gorm:"type:uuid;index"`
+	// Materialized path of IDs from the root down to this tenant, "/root/.../id/"
+	Path string `gorm:"type:varchar(1024);index"`
+	// Token lifetime overrides, zero values inherit the global Config
+	TokenSettings TenantTokenSettings `gorm:"embedded;embeddedPrefix:token_"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName specifies the table name for Tenant model
+func (Tenant) TableName() string {
+	return "tenants"
+}
+
+// BeforeCreate assigns the tenant ID
+func (t *Tenant) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// IsActive reports whether the tenant may authenticate
+func (t Tenant) IsActive() bool {
+	return t.Status == TenantStatusActive
+}
+
+// TenantService provides tenant management functionality
+type TenantService struct {
+	gr *GuardRail
+}
+
+// NewTenantService creates a new tenant service instance
+func (gr *GuardRail) NewTenantService() *TenantService {
+	return &TenantService{gr: gr}
+}
+
+// CreateTenant creates a new active tenant
+func (ts *TenantService) CreateTenant(name string) (*Tenant, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("tenant name is required")
+	}
+
+	tenant := Tenant{
+		ID:     uuid.New(),
+		Name:   name,
+		Status: TenantStatusActive,
+	}
+	tenant.Path = tenantPath("/", tenant.ID)
+	if err := ts.gr.db.Create(&tenant).Error; err != nil {
+		return nil, fmt.Errorf("failed to create tenant: %w", err)
+	}
+
+	return &tenant, nil
+}
+
+// GetTenant returns a tenant by ID
+func (ts *TenantService) GetTenant(tenantID string) (*Tenant, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var tenant Tenant
+	if err := ts.gr.db.Where("id = ?", id).First(&tenant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTenantNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &tenant, nil
+}
+
+// RenameTenant changes the display name of a tenant
+func (ts *TenantService) RenameTenant(tenantID, name string) (*Tenant, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("tenant name is required")
+	}
+
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ts.gr.db.Model(tenant).Update("name", name).Error; err != nil {
+		return nil, fmt.Errorf("failed to rename tenant: %w", err)
+	}
+
+	return tenant, nil
+}
+
+// SuspendTenant blocks all authentication for a tenant until it is reactivated
+func (ts *TenantService) SuspendTenant(tenantID string) error {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = ts.gr.db.Model(tenant).Updates(map[string]interface{}{
+		"status":       TenantStatusSuspended,
+		"suspended_at": &now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to suspend tenant: %w", err)
+	}
+
+	// Sub-tenants inherit the suspension
+	ts.gr.invalidateTenantSubtree(tenant)
+	return nil
+}
+
+// ActivateTenant lifts a suspension
+func (ts *TenantService) ActivateTenant(tenantID string) error {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	err = ts.gr.db.Model(tenant).Updates(map[string]interface{}{
+		"status":       TenantStatusActive,
+		"suspended_at": nil,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to activate tenant: %w", err)
+	}
+
+	ts.gr.invalidateTenantSubtree(tenant)
+	return nil
+}
+
+// DeleteTenant removes a tenant and deactivates its application keys. Its
+// sub-tenants stay but can't authenticate any more, like under a suspension.
+func (ts *TenantService) DeleteTenant(tenantID string) error {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	var keyHashes []string
+	err = ts.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&ApplicationToken{}).Where("tenant_id = ?", tenant.ID).Pluck("key_hash", &keyHashes).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&ApplicationToken{}).Where("tenant_id = ?", tenant.ID).Update("is_active", false).Error; err != nil {
+			return err
+		}
+		return tx.Delete(tenant).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete tenant: %w", err)
+	}
+
+	// Sub-tenants go down with their parent
+	ts.gr.invalidateTenantSubtree(tenant)
+	for _, hash := range keyHashes {
+		ts.gr.invalidateApplicationKey(hash)
+	}
+	return nil
+}
+
+// checkTenantActive returns nil if the tenant exists and is active, and so
+// are all of its ancestors
+func (gr *GuardRail) checkTenantActive(tenantID string) error {
+	ctx := context.Background()
+	cacheKey := "tenant_status:" + tenantID
+
+	if gr.redis != nil {
+		val, err := gr.redis.Get(ctx, cacheKey).Result()
+		if err == nil {
+			return tenantStatusError(TenantStatus(val))
+		}
+	}
+
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return ErrTenantNotFound
+	}
+
+	var tenant Tenant
+	if err := gr.db.Select("id", "status", "path").Where("id = ?", id).First(&tenant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTenantNotFound
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	// Suspended and deleted ancestors both take the tenant down with them
+	if ancestors := tenant.AncestorIDs(); tenant.IsActive() && len(ancestors) > 0 {
+		var active int64
+		if err := gr.db.Model(&Tenant{}).Where("id IN ? AND status = ?", ancestors, TenantStatusActive).Count(&active).Error; err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if active < int64(len(ancestors)) {
+			tenant.Status = TenantStatusSuspended
+		}
+	}
+
+	if gr.redis != nil {
+		gr.redis.Set(ctx, cacheKey, string(tenant.Status), tenantStatusCacheTTL)
+	}
+
+	return tenantStatusError(tenant.Status)
+}
+
+func tenantStatusError(status TenantStatus) error {
+	if status == TenantStatusActive {
+		return nil
+	}
+	return ErrTenantSuspended
+}
@@ -0,0 +1,199 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrTenantCycle is returned when moving a tenant below one of its own descendants
+var ErrTenantCycle = errors.New("tenant cannot be moved below itself")
+
+// tenantPath appends a tenant ID to its parent's materialized path
+func tenantPath(parentPath string, id uuid.UUID) string {
+	return parentPath + id.String() + "/"
+}
+
+// AncestorIDs returns the IDs of the tenant's ancestors, root first
+func (t Tenant) AncestorIDs() []string {
+	ids := strings.Split(strings.Trim(t.Path, "/"), "/")
+	if len(ids) <= 1 {
+		return nil
+	}
+	return ids[:len(ids)-1]
+}
+
+// CreateSubTenant creates an active tenant below parentID
+func (ts *TenantService) CreateSubTenant(parentID, name string) (*Tenant, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("tenant name is required")
+	}
+
+	parent, err := ts.GetTenant(parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant := Tenant{
+		ID:       uuid.New(),
+		Name:     name,
+		Status:   TenantStatusActive,
+		ParentID: &parent.ID,
+	}
+	tenant.Path = tenantPath(parent.Path, tenant.ID)
+	if err := ts.gr.db.Create(&tenant).Error; err != nil {
+		return nil, fmt.Errorf("failed to create tenant: %w", err)
+	}
+
+	return &tenant, nil
+}
+
+// Ancestors returns the ancestors of a tenant, root first
+func (ts *TenantService) Ancestors(tenantID string) ([]Tenant, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	ancestors := []Tenant{}
+	if ids := tenant.AncestorIDs(); len(ids) > 0 {
+		if err := ts.gr.db.Where("id IN ?", ids).Order("LENGTH(path)").Find(&ancestors).Error; err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+	}
+
+	return ancestors, nil
+}
+
+// Descendants returns all tenants below a tenant, each parent before its children
+func (ts *TenantService) Descendants(tenantID string) ([]Tenant, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var descendants []Tenant
+	if err := ts.gr.descendantsQuery(tenant).Order("path").Find(&descendants).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return descendants, nil
+}
+
+// MoveTenant puts a tenant and its subtree below a new parent. An empty
+// parentID makes the tenant a root.
+func (ts *TenantService) MoveTenant(tenantID, parentID string) error {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	var newParentID *uuid.UUID
+	newPath := tenantPath("/", tenant.ID)
+	if parentID != "" {
+		parent, err := ts.GetTenant(parentID)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(parent.Path, tenant.Path) {
+			return ErrTenantCycle
+		}
+		newParentID = &parent.ID
+		newPath = tenantPath(parent.Path, tenant.ID)
+	}
+
+	oldPath := tenant.Path
+	err = ts.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(tenant).Update("parent_id", newParentID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Tenant{}).Unscoped().
+			Where("path LIKE ?", oldPath+"%").
+			Update("path", gorm.Expr("? || SUBSTR(path, ?)", newPath, len(oldPath)+1)).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move tenant: %w", err)
+	}
+
+	// Inherited suspensions may differ under the new parent
+	tenant.Path = newPath
+	ts.gr.invalidateTenantSubtree(tenant)
+	return nil
+}
+
+// SetMemberInheritance controls whether a user's roles in a tenant also apply
+// in all of its descendants
+func (ts *TenantService) SetMemberInheritance(tenantID, userID string, inherit bool) error {
+	membership, err := ts.getMembership(tenantID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.gr.db.Model(membership).Update("inherit_to_descendants", inherit).Error; err != nil {
+		return fmt.Errorf("failed to update membership: %w", err)
+	}
+	return nil
+}
+
+func (gr *GuardRail) descendantsQuery(tenant *Tenant) *gorm.DB {
+	return gr.db.Where("path LIKE ? AND id <> ?", tenant.Path+"%", tenant.ID)
+}
+
+// tenantAncestorIDs returns the ancestor IDs of a tenant, root first
+func (gr *GuardRail) tenantAncestorIDs(tenantID uuid.UUID) ([]string, error) {
+	var tenant Tenant
+	if err := gr.db.Select("id", "path").Where("id = ?", tenantID).First(&tenant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return tenant.AncestorIDs(), nil
+}
+
+// isDescendantTenant reports whether descendantID lies below ancestorID
+func (gr *GuardRail) isDescendantTenant(ancestorID, descendantID string) (bool, error) {
+	id, err := uuid.Parse(descendantID)
+	if err != nil {
+		return false, nil
+	}
+	ancestors, err := gr.tenantAncestorIDs(id)
+	if err != nil {
+		return false, err
+	}
+	return containsString(ancestors, ancestorID), nil
+}
+
+// invalidateTenantSubtree drops the cached status, custom roles and settings
+// of a tenant and its descendants, which inherit all three
+func (gr *GuardRail) invalidateTenantSubtree(tenant *Tenant) {
+	if gr.redis == nil {
+		return
+	}
+
+	var ids []string
+	gr.descendantsQuery(tenant).Model(&Tenant{}).Pluck("id", &ids)
+	ctx := context.Background()
+	for _, id := range append(ids, tenant.ID.String()) {
+		gr.redis.Del(ctx, "tenant_status:"+id, "tenant_roles:"+id, "tenant_settings:"+id)
+	}
+}
+
+// migrateTenantPaths gives tenants created before hierarchies existed a root path
+func migrateTenantPaths(db *gorm.DB) error {
+	var ids []uuid.UUID
+	if err := db.Model(&Tenant{}).Unscoped().Where("path IS NULL OR path = ''").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := db.Model(&Tenant{}).Unscoped().Where("id = ?", id).Update("path", tenantPath("/", id)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package guardrail_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestTenantHierarchy(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true, EnableRBAC: true})
+	ts := gr.NewTenantService()
+
+	reseller, _ := ts.CreateTenant("Reseller")
+	child, err := ts.CreateSubTenant(reseller.ID.String(), "Child")
+	if err != nil {
+		t.Fatalf("CreateSubTenant failed: %v", err)
+	}
+	grandchild, err := ts.CreateSubTenant(child.ID.String(), "Grandchild")
+	if err != nil {
+		t.Fatalf("CreateSubTenant failed: %v", err)
+	}
+
+	ancestors, err := ts.Ancestors(grandchild.ID.String())
+	if err != nil || len(ancestors) != 2 || ancestors[0].ID != reseller.ID || ancestors[1].ID != child.ID {
+		t.Errorf("Expected ancestors [Reseller Child], got %+v (%v)", ancestors, err)
+	}
+	descendants, err := ts.Descendants(reseller.ID.String())
+	if err != nil || len(descendants) != 2 || descendants[0].ID != child.ID {
+		t.Errorf("Expected descendants [Child Grandchild], got %+v (%v)", descendants, err)
+	}
+
+	if err := ts.MoveTenant(reseller.ID.String(), grandchild.ID.String()); !errors.Is(err, guardrail.ErrTenantCycle) {
+		t.Errorf("Expected ErrTenantCycle, got %v", err)
+	}
+	if err := ts.MoveTenant(child.ID.String(), ""); err != nil {
+		t.Fatalf("MoveTenant failed: %v", err)
+	}
+	if ancestors, _ := ts.Ancestors(grandchild.ID.String()); len(ancestors) != 1 || ancestors[0].ID != child.ID {
+		t.Errorf("Expected grandchild to move along with child, got %+v", ancestors)
+	}
+	if err := ts.MoveTenant(child.ID.String(), reseller.ID.String()); err != nil {
+		t.Fatalf("MoveTenant failed: %v", err)
+	}
+
+	// Suspending a parent suspends the subtree
+	issued, _ := ts.CreateApplicationKey(grandchild.ID.String(), "backend", nil)
+	app := fiber.New()
+	app.Get("/app", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	req := httptest.NewRequest("GET", "/app", nil)
+	req.Header.Set(guardrail.HeaderApplicationKey, issued.Key)
+	ts.SuspendTenant(child.ID.String())
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected 403 below a suspended tenant, got %d", resp.StatusCode)
+	}
+	ts.ActivateTenant(child.ID.String())
+}
+
+func TestInheritedTenantRoles(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true, EnableRBAC: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	reseller, _ := ts.CreateTenant("Reseller")
+	child, _ := ts.CreateSubTenant(reseller.ID.String(), "Child")
+	grandchild, _ := ts.CreateSubTenant(child.ID.String(), "Grandchild")
+	other, _ := ts.CreateTenant("Other")
+
+	auth, err := as.Register(guardrail.RegisterRequest{
+		Email:    "admin@reseller.test",
+		Password: "correct-horse-battery",
+		TenantID: reseller.ID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	ts.UpdateMemberRoles(reseller.ID.String(), auth.UserID, []string{"admin"})
+	login, _ := as.Login(guardrail.LoginRequest{Email: "admin@reseller.test", Password: "correct-horse-battery"})
+
+	app := fiber.New()
+	app.Get("/admin", gr.ProtectWithRole("admin"), func(c *fiber.Ctx) error {
+		tenantID, _ := guardrail.GetTenantID(c)
+		return c.SendString(tenantID)
+	})
+	status := func(tenantID string) int {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+		req.Header.Set(guardrail.HeaderTenantID, tenantID)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if got := status(grandchild.ID.String()); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 without inheritance, got %d", got)
+	}
+	if _, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: auth.AccessToken, TenantID: child.ID.String()}); !errors.Is(err, guardrail.ErrNotTenantMember) {
+		t.Errorf("Expected ErrNotTenantMember without inheritance, got %v", err)
+	}
+
+	if err := ts.SetMemberInheritance(reseller.ID.String(), auth.UserID, true); err != nil {
+		t.Fatalf("SetMemberInheritance failed: %v", err)
+	}
+	if got := status(grandchild.ID.String()); got != fiber.StatusOK {
+		t.Errorf("Expected 200 with inherited admin role, got %d", got)
+	}
+	if got := status(other.ID.String()); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 for an unrelated tenant, got %d", got)
+	}
+	switched, err := as.SwitchTenant(guardrail.SwitchTenantRequest{AccessToken: auth.AccessToken, TenantID: child.ID.String()})
+	if err != nil || switched.Role != "admin" {
+		t.Errorf("Expected switch into child as admin, got %+v (%v)", switched, err)
+	}
+
+	// A suspended membership in the descendant itself overrides inheritance
+	ts.AddMember(child.ID.String(), auth.UserID, []string{"viewer"})
+	ts.SetMemberStatus(child.ID.String(), auth.UserID, guardrail.MembershipStatusSuspended)
+	if got := status(child.ID.String()); got != fiber.StatusForbidden {
+		t.Errorf("Expected 403 with suspended own membership, got %d", got)
+	}
+}
+
+func TestDeletedParentTenant(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	parent, _ := ts.CreateTenant("Reseller")
+	child, _ := ts.CreateSubTenant(parent.ID.String(), "Child")
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: child.ID.String()}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	issued, _ := ts.CreateApplicationKey(child.ID.String(), "backend", nil)
+
+	if err := ts.DeleteTenant(parent.ID.String()); err != nil {
+		t.Fatalf("DeleteTenant failed: %v", err)
+	}
+
+	// Deleting a parent takes the subtree down like a suspension
+	login := guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery", TenantID: child.ID.String()}
+	if _, err := as.Login(login); !errors.Is(err, guardrail.ErrTenantSuspended) {
+		t.Errorf("Expected ErrTenantSuspended below a deleted tenant, got %v", err)
+	}
+	app := fiber.New()
+	app.Get("/app", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	req := httptest.NewRequest("GET", "/app", nil)
+	req.Header.Set(guardrail.HeaderApplicationKey, issued.Key)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected 403 below a deleted tenant, got %d", resp.StatusCode)
+	}
+}
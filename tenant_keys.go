@@ -0,0 +1,430 @@
+package guardrail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// tenantTokenConfigCacheTTL bounds how long per-tenant token configuration is
+// cached in Redis. Changes made through TenantService invalidate it immediately.
+const tenantTokenConfigCacheTTL = 5 * time.Minute
+
+// minSigningSecretLength is the shortest tenant-supplied HMAC secret accepted
+const minSigningSecretLength = 32
+
+// ErrSigningKeyNotFound is returned when a signing key does not exist
+var ErrSigningKeyNotFound = errors.New("signing key not found")
+
+// TenantTokenSettings overrides token lifetimes for a single tenant.
+// Zero values inherit the global Config.
+type TenantTokenSettings struct {
+	AccessTokenExpiry  time.Duration
+	RefreshTokenExpiry time.Duration
+}
+
+// TenantSigningKey is HMAC key material owned by a single tenant. Tokens
+// signed with it carry its KID in the JWT header.
+type TenantSigningKey struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	TenantID  uuid.UUID `gorm:"type:uuid;index;not null"`
+	KID       string    `gorm:"column:kid;type:varchar(64);uniqueIndex;not null"`
+	Secret    string    `gorm:"not null" json:"-"` // Encrypted with the KID as associated data
+	IsPrimary bool      // The primary key signs new tokens; other keys only verify
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName specifies the table name for TenantSigningKey model
+func (TenantSigningKey) TableName() string {
+	return "tenant_signing_keys"
+}
+
+// BeforeCreate assigns the key ID
+func (k *TenantSigningKey) BeforeCreate(tx *gorm.DB) error {
+	if k.ID == uuid.Nil {
+		k.ID = uuid.New()
+	}
+	return nil
+}
+
+// tenantTokenConfig is the resolved token configuration of a tenant
+type tenantTokenConfig struct {
+	PrimaryKID         string        `json:"primary_kid,omitempty"`
+	AccessTokenExpiry  time.Duration `json:"access_token_expiry"`
+	RefreshTokenExpiry time.Duration `json:"refresh_token_expiry"`
+}
+
+// cachedSigningKey is the Redis representation of a signing key. The secret
+// stays encrypted.
+type cachedSigningKey struct {
+	TenantID string `json:"tenant_id"`
+	Secret   string `json:"secret"`
+}
+
+// SetTokenSettings overrides token lifetimes for a tenant
+func (ts *TenantService) SetTokenSettings(tenantID string, settings TenantTokenSettings) error {
+	if settings.AccessTokenExpiry < 0 || settings.RefreshTokenExpiry < 0 {
+		return fmt.Errorf("token expiry cannot be negative")
+	}
+
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	err = ts.gr.db.Model(tenant).Updates(map[string]interface{}{
+		"token_access_token_expiry":  settings.AccessTokenExpiry,
+		"token_refresh_token_expiry": settings.RefreshTokenExpiry,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update token settings: %w", err)
+	}
+
+	ts.gr.invalidateTenantTokenConfig(tenant.ID.String())
+	return nil
+}
+
+// CreateSigningKey adds a signing key for a tenant and makes it primary.
+// An empty secret generates one. Previous keys keep verifying existing tokens
+// until they are revoked.
+func (ts *TenantService) CreateSigningKey(tenantID, secret string) (*TenantSigningKey, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		if secret, err = generateSigningSecret(); err != nil {
+			return nil, err
+		}
+	} else if len(secret) < minSigningSecretLength {
+		return nil, fmt.Errorf("signing secret must be at least %d characters", minSigningSecretLength)
+	}
+
+	kid := "tk_" + uuid.New().String()
+	sealed, err := ts.gr.encryptSecret([]byte(secret), kid)
+	if err != nil {
+		return nil, err
+	}
+	key := TenantSigningKey{
+		ID:        uuid.New(),
+		TenantID:  tenant.ID,
+		KID:       kid,
+		Secret:    sealed,
+		IsPrimary: true,
+	}
+
+	err = ts.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TenantSigningKey{}).Where("tenant_id = ?", tenant.ID).Update("is_primary", false).Error; err != nil {
+			return err
+		}
+		return tx.Create(&key).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing key: %w", err)
+	}
+
+	ts.gr.invalidateTenantTokenConfig(tenant.ID.String())
+	return &key, nil
+}
+
+// ListSigningKeys returns the signing keys of a tenant
+func (ts *TenantService) ListSigningKeys(tenantID string) ([]TenantSigningKey, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+
+	var keys []TenantSigningKey
+	if err := ts.gr.db.Where("tenant_id = ?", id).Order("created_at").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RevokeSigningKey deletes a signing key. Tokens signed with it stop verifying
+// immediately. Revoking the primary key makes the tenant fall back to the
+// newest remaining key, or to the global JWTSecret if none is left.
+func (ts *TenantService) RevokeSigningKey(kid string) error {
+	var key TenantSigningKey
+	if err := ts.gr.db.Where("kid = ?", kid).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSigningKeyNotFound
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	err := ts.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&key).Error; err != nil {
+			return err
+		}
+		if !key.IsPrimary {
+			return nil
+		}
+
+		var next TenantSigningKey
+		err := tx.Where("tenant_id = ?", key.TenantID).Order("created_at DESC").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.Model(&next).Update("is_primary", true).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke signing key: %w", err)
+	}
+
+	ts.gr.invalidateTenantTokenConfig(key.TenantID.String())
+	if ts.gr.redis != nil {
+		ts.gr.redis.Del(context.Background(), "tenant_signing_key:"+kid)
+	}
+	return nil
+}
+
+// tenantTokenConfig resolves the token configuration of a tenant, applying
+// global defaults for anything the tenant does not override
+func (gr *GuardRail) tenantTokenConfig(tenantID string) (*tenantTokenConfig, error) {
+	ctx := context.Background()
+	cacheKey := "tenant_token_config:" + tenantID
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var cfg tenantTokenConfig
+			if json.Unmarshal([]byte(val), &cfg) == nil {
+				return &cfg, nil
+			}
+		}
+	}
+
+	cfg := &tenantTokenConfig{
+		AccessTokenExpiry:  gr.config.AccessTokenExpiry,
+		RefreshTokenExpiry: gr.config.RefreshTokenExpiry,
+	}
+
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return cfg, nil
+	}
+
+	var tenant Tenant
+	err = gr.db.Select("id", "token_access_token_expiry", "token_refresh_token_expiry").Where("id = ?", id).First(&tenant).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if tenant.TokenSettings.AccessTokenExpiry > 0 {
+		cfg.AccessTokenExpiry = tenant.TokenSettings.AccessTokenExpiry
+	}
+	if tenant.TokenSettings.RefreshTokenExpiry > 0 {
+		cfg.RefreshTokenExpiry = tenant.TokenSettings.RefreshTokenExpiry
+	}
+
+	var key TenantSigningKey
+	err = gr.db.Select("kid").Where("tenant_id = ? AND is_primary = ?", id, true).First(&key).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	cfg.PrimaryKID = key.KID
+
+	if gr.redis != nil {
+		if data, err := json.Marshal(cfg); err == nil {
+			gr.redis.Set(ctx, cacheKey, data, tenantTokenConfigCacheTTL)
+		}
+	}
+
+	return cfg, nil
+}
+
+// tenantSigningKey looks up a signing key by KID and returns its tenant and
+// decrypted secret
+func (gr *GuardRail) tenantSigningKey(kid string) (string, []byte, error) {
+	key, err := gr.cachedSigningKey(kid)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := gr.decryptSecret(key.Secret, kid)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decrypt signing key: %w", err)
+	}
+	return key.TenantID, secret, nil
+}
+
+// cachedSigningKey loads a signing key through the Redis cache
+func (gr *GuardRail) cachedSigningKey(kid string) (*cachedSigningKey, error) {
+	ctx := context.Background()
+	cacheKey := "tenant_signing_key:" + kid
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var key cachedSigningKey
+			if json.Unmarshal([]byte(val), &key) == nil {
+				return &key, nil
+			}
+		}
+	}
+
+	var key TenantSigningKey
+	if err := gr.db.Where("kid = ?", kid).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSigningKeyNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	cached := &cachedSigningKey{TenantID: key.TenantID.String(), Secret: key.Secret}
+	if gr.redis != nil {
+		if data, err := json.Marshal(cached); err == nil {
+			gr.redis.Set(ctx, cacheKey, data, tenantTokenConfigCacheTTL)
+		}
+	}
+
+	return cached, nil
+}
+
+// migrateSigningKeySecrets encrypts signing key secrets stored in plaintext
+// by earlier versions
+func (gr *GuardRail) migrateSigningKeySecrets() error {
+	var keys []TenantSigningKey
+	if err := gr.db.Unscoped().Where("secret NOT LIKE ?", encryptedSecretPrefix+"%").Find(&keys).Error; err != nil {
+		return err
+	}
+	for _, key := range keys {
+		sealed, err := gr.encryptSecret([]byte(key.Secret), key.KID)
+		if err != nil {
+			return err
+		}
+		if err := gr.db.Model(&TenantSigningKey{}).Unscoped().Where("id = ?", key.ID).Update("secret", sealed).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signToken signs claims with the tenant's primary key when it has one,
+// falling back to the global JWTSecret
+func (gr *GuardRail) signToken(claims jwt.MapClaims, cfg *tenantTokenConfig) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if cfg == nil || cfg.PrimaryKID == "" {
+		return token.SignedString(gr.jwtSecret)
+	}
+
+	_, secret, err := gr.tenantSigningKey(cfg.PrimaryKID)
+	if err != nil {
+		return "", err
+	}
+	token.Header["kid"] = cfg.PrimaryKID
+	return token.SignedString(secret)
+}
+
+// signingKey is the jwt.Keyfunc used for verification. A kid header selects a
+// tenant key, which must belong to the tenant named in the claims. Without a
+// kid, the tenant's primary key is used if it has one, else the global secret.
+func (gr *GuardRail) signingKey(token *jwt.Token) (interface{}, error) {
+	// Validate the signing method
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	tenantID, _ := claims["tenant_id"].(string)
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && gr.config.EnableMultiTenant && tenantID != "" {
+		cfg, err := gr.tenantTokenConfig(tenantID)
+		if err != nil {
+			return nil, err
+		}
+		kid = cfg.PrimaryKID
+	}
+
+	if kid == "" {
+		return gr.jwtSecret, nil
+	}
+
+	keyTenant, secret, err := gr.tenantSigningKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if keyTenant != tenantID {
+		return nil, fmt.Errorf("signing key does not belong to token tenant")
+	}
+	// Whoever holds a tenant's key can sign any user_id, so it only counts
+	// for members of that tenant
+	if err := gr.checkTokenMember(claims, tenantID); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// checkTokenMember fails unless the token's user is an active member of tenantID
+func (gr *GuardRail) checkTokenMember(claims jwt.MapClaims, tenantID string) error {
+	userID, _ := claims["user_id"].(string)
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user_id in token: %w", err)
+	}
+	tid, err := uuid.Parse(tenantID)
+	if err != nil {
+		return fmt.Errorf("invalid tenant_id in token: %w", err)
+	}
+
+	var user User
+	if err := gr.db.Where("id = ? AND is_active = true", uid).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotTenantMember
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+	_, err = gr.tenantRoles(user, tid)
+	return err
+}
+
+// checkTenantTokenAge enforces the tenant's current lifetimes at verification
+// time, so shortening them also applies to tokens that were already issued
+func (gr *GuardRail) checkTenantTokenAge(claims jwt.MapClaims) error {
+	tenantID, _ := claims["tenant_id"].(string)
+	iat, ok := claims["iat"].(float64)
+	if !gr.config.EnableMultiTenant || tenantID == "" || !ok {
+		return nil
+	}
+
+	cfg, err := gr.tenantTokenConfig(tenantID)
+	if err != nil {
+		return err
+	}
+
+	maxAge := cfg.AccessTokenExpiry
+	if claims["type"] == "refresh" {
+		maxAge = cfg.RefreshTokenExpiry
+	}
+	if time.Since(time.Unix(int64(iat), 0)) > maxAge {
+		return fmt.Errorf("token exceeds tenant lifetime")
+	}
+	return nil
+}
+
+// invalidateTenantTokenConfig drops the cached token configuration of a tenant
+func (gr *GuardRail) invalidateTenantTokenConfig(tenantID string) {
+	if gr.redis != nil {
+		gr.redis.Del(context.Background(), "tenant_token_config:"+tenantID)
+	}
+}
+
+func generateSigningSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate signing secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,160 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TenantSource identifies the credential that established the request tenant
+type TenantSource string
+
+const (
+	TenantSourceApplicationKey TenantSource = "application_key"
+	TenantSourceToken          TenantSource = "token"
+	// TenantSourceHeader is a descendant tenant selected with X-Tenant-Id
+	TenantSourceHeader TenantSource = "header"
+)
+
+// HeaderTenantID selects a descendant of the token's tenant
+const HeaderTenantID = "X-Tenant-Id"
+
+// ProtectTenant returns middleware that requires both an application key and a
+// JWT, and only lets the request through when they belong to the same tenant.
+// Usage: app.Get("/orders", gr.ProtectTenant(), handler)
+func (gr *GuardRail) ProtectTenant() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if gr.config.EnableMultiTenant {
+			if err := gr.applicationKeyStage(c); err != nil {
+				return gr.respondError(c, err)
+			}
+		}
+		if err := gr.tokenStage(c); err != nil {
+			return gr.respondError(c, err)
+		}
+		return c.Next()
+	}
+}
+
+// bindTenant records the tenant established by a credential. The first
+// credential sets the tenant; any later credential must name the same one,
+// so ApplicationKeyMiddleware and Protect can never silently overwrite each other.
+// The one exception is a tenant hierarchy: when one credential names a
+// descendant of the other's tenant, the request is bound to the descendant
+// and the user's roles there are looked up, which requires inherited rights.
+func (gr *GuardRail) bindTenant(c *fiber.Ctx, tenantID string, source TenantSource) error {
+	bound := tenantID
+	if current, ok := GetTenantID(c); ok && current != tenantID {
+		descendant, err := gr.descendantTenant(current, tenantID)
+		if err != nil {
+			return fmt.Errorf("tenant hierarchy lookup failed: %w", err)
+		}
+		if descendant == "" {
+			sources, _ := GetTenantSources(c)
+			log.Printf("Tenant mismatch: %s from %v, %s from %s", current, sources, tenantID, source)
+			return reject(fiber.StatusForbidden, gr.config.ErrorMessages.TenantMismatch)
+		}
+		bound = descendant
+	}
+
+	if err := gr.checkTenantActive(tenantID); err != nil {
+		return gr.tenantRejection(err)
+	}
+	if err := gr.checkClientIP(c, bound); err != nil {
+		return err
+	}
+
+	sources, _ := GetTenantSources(c)
+	c.Locals("tenant_id", bound)
+	c.Locals("tenant_sources", append(sources, source))
+	c.SetUserContext(WithTenant(c.UserContext(), bound))
+
+	return gr.bindDescendantRoles(c)
+}
+
+// descendantTenant returns whichever of two tenants lies below the other,
+// or "" when they are unrelated
+func (gr *GuardRail) descendantTenant(a, b string) (string, error) {
+	if below, err := gr.isDescendantTenant(a, b); err != nil || below {
+		return b, err
+	}
+	if below, err := gr.isDescendantTenant(b, a); err != nil || below {
+		return a, err
+	}
+	return "", nil
+}
+
+// bindDescendantRoles replaces the token's roles with the roles the user
+// holds in the bound tenant when that is not the tenant the token was issued for
+func (gr *GuardRail) bindDescendantRoles(c *fiber.Ctx) error {
+	claims, ok := GetClaims(c)
+	if !ok {
+		return nil
+	}
+	bound, _ := GetTenantID(c)
+	if tokenTenant, _ := claims["tenant_id"].(string); tokenTenant == "" || tokenTenant == bound {
+		return nil
+	}
+
+	userID, _ := GetUserID(c)
+	var user User
+	if err := gr.db.Where("id = ? AND is_active = true", userID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden)
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	boundID, err := uuid.Parse(bound)
+	if err != nil {
+		return reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden)
+	}
+	roles, err := gr.tenantRoles(user, boundID)
+	if errors.Is(err, ErrNotTenantMember) {
+		return reject(fiber.StatusForbidden, gr.config.ErrorMessages.Forbidden)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Locals("role", primaryRole(roles))
+	c.Locals("roles", roles)
+	return nil
+}
+
+// tenantRejection maps a failed tenant status check to a rejection
+func (gr *GuardRail) tenantRejection(err error) error {
+	if errors.Is(err, ErrTenantSuspended) || errors.Is(err, ErrTenantNotFound) {
+		return reject(fiber.StatusForbidden, gr.config.ErrorMessages.TenantSuspended)
+	}
+	return fmt.Errorf("tenant status check failed: %w", err)
+}
+
+// DB returns the database handle bound to the request context, so
+// TenantScopedModel queries are limited to the request tenant. Inside
+// TenantTransaction it is the request transaction.
+// Usage: gr.DB(c).Find(&orders)
+func (gr *GuardRail) DB(c *fiber.Ctx) *gorm.DB {
+	if tx, ok := GetDB(c); ok {
+		return tx
+	}
+	return gr.db.WithContext(c.UserContext())
+}
+
+// GetTenantID returns the authoritative tenant of the request. When both an
+// application key and a JWT were presented, they are guaranteed to agree.
+func GetTenantID(c *fiber.Ctx) (string, bool) {
+	tenantID, ok := c.Locals("tenant_id").(string)
+	return tenantID, ok
+}
+
+// GetTenantSources returns the credentials that established the request tenant,
+// in the order they were checked
+func GetTenantSources(c *fiber.Ctx) ([]TenantSource, bool) {
+	sources, ok := c.Locals("tenant_sources").([]TenantSource)
+	return sources, ok
+}
@@ -0,0 +1,223 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// TenantScopedModel is implemented by models whose rows belong to a tenant.
+// Queries, updates and deletes on these models run through a *gorm.DB carrying
+// a request context are automatically limited to the request tenant, and
+// creates get the tenant column filled in.
+//
+//	func (Order) TenantColumn() string { return "tenant_id" }
+//	gr.DB(c).Find(&orders) // only the request tenant's orders
+type TenantScopedModel interface {
+	TenantColumn() string
+}
+
+var (
+	// ErrMissingTenantScope is returned when a tenant-scoped model is queried
+	// without a tenant in the context and without an explicit bypass
+	ErrMissingTenantScope = errors.New("tenant-scoped query without tenant in context")
+	// ErrTenantScopeViolation is returned when creating a row for another tenant
+	ErrTenantScopeViolation = errors.New("row belongs to a different tenant than the context")
+	// ErrTenantScopeBypassReason is returned when a bypass has no reason to audit
+	ErrTenantScopeBypassReason = errors.New("tenant scope bypass requires a reason")
+)
+
+type tenantContextKey struct{}
+
+type tenantScopeBypassKey struct{}
+
+// WithTenant returns a context that scopes tenant-scoped models to tenantID.
+// The middleware does this for every request with a tenant, see GuardRail.DB.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant set by WithTenant
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// WithoutTenantScope returns a context that disables automatic tenant scoping,
+// for cross-tenant work like reporting or support tooling. Every statement run
+// with it is reported to the AuditHook together with reason.
+func WithoutTenantScope(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, tenantScopeBypassKey{}, reason)
+}
+
+func tenantScopeBypass(ctx context.Context) (string, bool) {
+	reason, ok := ctx.Value(tenantScopeBypassKey{}).(string)
+	return reason, ok
+}
+
+// tenantScopePlugin registers the GORM callbacks enforcing TenantScopedModel
+type tenantScopePlugin struct {
+	gr *GuardRail
+}
+
+func (p *tenantScopePlugin) Name() string {
+	return "guardrail:tenant_scope"
+}
+
+func (p *tenantScopePlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register(p.Name(), p.assignTenant); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("gorm:query").Register(p.Name(), p.scopeRead); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register(p.Name(), p.scopeRead); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register(p.Name(), p.scopeWrite); err != nil {
+		return err
+	}
+	return callbacks.Delete().Before("gorm:delete").Register(p.Name(), p.scopeWrite)
+}
+
+// scopeRead adds the tenant condition to queries
+func (p *tenantScopePlugin) scopeRead(db *gorm.DB) {
+	if tenantID, column, ok := p.resolve(db); ok {
+		addTenantCondition(db, tenantID, column)
+	}
+}
+
+// scopeWrite adds the tenant condition to updates and deletes
+func (p *tenantScopePlugin) scopeWrite(db *gorm.DB) {
+	tenantID, column, ok := p.resolve(db)
+	if !ok {
+		return
+	}
+
+	// Keep GORM's protection against unconditional updates and deletes; the
+	// tenant condition alone must not turn them into tenant-wide ones
+	if _, hasWhere := db.Statement.Clauses["WHERE"]; !hasWhere && !db.AllowGlobalUpdate && !hasPrimaryKeyValue(db.Statement) {
+		db.AddError(gorm.ErrMissingWhereClause)
+		return
+	}
+
+	addTenantCondition(db, tenantID, column)
+}
+
+func addTenantCondition(db *gorm.DB, tenantID, column string) {
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: column}, Value: tenantID},
+	}})
+}
+
+// assignTenant fills the tenant column of new rows and refuses rows that
+// already name another tenant
+func (p *tenantScopePlugin) assignTenant(db *gorm.DB) {
+	tenantID, column, ok := p.resolve(db)
+	if !ok {
+		return
+	}
+
+	field := db.Statement.Schema.LookUpField(column)
+	if field == nil {
+		db.AddError(fmt.Errorf("tenant column %q not found on %s", column, db.Statement.Schema.Name))
+		return
+	}
+
+	ctx := db.Statement.Context
+	assign := func(row reflect.Value) {
+		if value, zero := field.ValueOf(ctx, row); !zero {
+			if fmt.Sprint(value) != tenantID {
+				db.AddError(ErrTenantScopeViolation)
+			}
+			return
+		}
+		if err := field.Set(ctx, row, tenantID); err != nil {
+			db.AddError(err)
+		}
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			assign(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		assign(rv)
+	}
+}
+
+// resolve returns the tenant and column to scope the statement with. It
+// reports false when the statement needs no scoping, either because the model
+// does not opt in, the statement failed already, or scoping was bypassed.
+func (p *tenantScopePlugin) resolve(db *gorm.DB) (string, string, bool) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return "", "", false
+	}
+	column, ok := tenantColumn(db.Statement.Schema)
+	if !ok {
+		return "", "", false
+	}
+
+	ctx := db.Statement.Context
+	if reason, bypassed := tenantScopeBypass(ctx); bypassed {
+		if reason == "" {
+			db.AddError(ErrTenantScopeBypassReason)
+			return "", "", false
+		}
+		tenantID, _ := TenantFromContext(ctx)
+		p.gr.audit(AuditEvent{
+			Action:   AuditTenantScopeBypass,
+			TenantID: tenantID,
+			Reason:   reason,
+			Metadata: map[string]string{"table": db.Statement.Table},
+		})
+		return "", "", false
+	}
+
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		db.AddError(ErrMissingTenantScope)
+		return "", "", false
+	}
+	return tenantID, column, true
+}
+
+// tenantColumn reports the tenant column of models implementing TenantScopedModel
+func tenantColumn(s *schema.Schema) (string, bool) {
+	model, ok := reflect.New(s.ModelType).Interface().(TenantScopedModel)
+	if !ok {
+		return "", false
+	}
+	return model.TenantColumn(), true
+}
+
+// hasPrimaryKeyValue reports whether the statement targets rows by primary
+// key, which GORM turns into a condition itself
+func hasPrimaryKeyValue(stmt *gorm.Statement) bool {
+	field := stmt.Schema.PrioritizedPrimaryField
+	if field == nil {
+		return false
+	}
+
+	rv := stmt.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if _, zero := field.ValueOf(stmt.Context, reflect.Indirect(rv.Index(i))); !zero {
+				return true
+			}
+		}
+	case reflect.Struct:
+		_, zero := field.ValueOf(stmt.Context, rv)
+		return !zero
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package guardrail_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	guardrail "github.com/vviveksharma/auth"
+	"gorm.io/gorm"
+)
+
+type scopedNote struct {
+	ID       uint
+	TenantID string
+	Body     string
+}
+
+func (scopedNote) TenantColumn() string { return "tenant_id" }
+
+func TestTenantScoping(t *testing.T) {
+	var audits []guardrail.AuditEvent
+	_, db := newTestGuardRail(t, guardrail.Config{
+		EnableMultiTenant: true,
+		AuditHook:         func(e guardrail.AuditEvent) { audits = append(audits, e) },
+	})
+	if err := db.AutoMigrate(&scopedNote{}); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+
+	tenantA, tenantB := uuid.NewString(), uuid.NewString()
+	ctxA := guardrail.WithTenant(context.Background(), tenantA)
+	ctxB := guardrail.WithTenant(context.Background(), tenantB)
+
+	if err := db.WithContext(ctxA).Create(&scopedNote{Body: "a"}).Error; err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := db.WithContext(ctxB).Create(&[]scopedNote{{Body: "b1"}, {Body: "b2"}}).Error; err != nil {
+		t.Fatalf("batch Create failed: %v", err)
+	}
+	if err := db.WithContext(ctxA).Create(&scopedNote{TenantID: tenantB, Body: "x"}).Error; !errors.Is(err, guardrail.ErrTenantScopeViolation) {
+		t.Errorf("Expected ErrTenantScopeViolation, got %v", err)
+	}
+
+	var notes []scopedNote
+	if err := db.WithContext(ctxA).Find(&notes).Error; err != nil || len(notes) != 1 || notes[0].Body != "a" {
+		t.Errorf("Expected only tenant A's note, got %+v (%v)", notes, err)
+	}
+
+	var count int64
+	db.WithContext(ctxB).Model(&scopedNote{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 notes for tenant B, got %d", count)
+	}
+
+	// Writes from the wrong tenant don't touch the row
+	res := db.WithContext(ctxB).Model(&scopedNote{ID: notes[0].ID}).Update("body", "hijacked")
+	if res.Error != nil || res.RowsAffected != 0 {
+		t.Errorf("Expected cross-tenant update to affect nothing, got %d rows (%v)", res.RowsAffected, res.Error)
+	}
+	res = db.WithContext(ctxB).Delete(&scopedNote{}, notes[0].ID)
+	if res.Error != nil || res.RowsAffected != 0 {
+		t.Errorf("Expected cross-tenant delete to affect nothing, got %d rows (%v)", res.RowsAffected, res.Error)
+	}
+	if err := db.WithContext(ctxB).Model(&scopedNote{}).Update("body", "all").Error; !errors.Is(err, gorm.ErrMissingWhereClause) {
+		t.Errorf("Expected ErrMissingWhereClause for unconditional update, got %v", err)
+	}
+
+	if err := db.Find(&notes).Error; !errors.Is(err, guardrail.ErrMissingTenantScope) {
+		t.Errorf("Expected ErrMissingTenantScope without tenant, got %v", err)
+	}
+	if err := db.WithContext(guardrail.WithoutTenantScope(context.Background(), "")).Find(&notes).Error; !errors.Is(err, guardrail.ErrTenantScopeBypassReason) {
+		t.Errorf("Expected ErrTenantScopeBypassReason, got %v", err)
+	}
+
+	bypass := guardrail.WithoutTenantScope(context.Background(), "nightly report")
+	if err := db.WithContext(bypass).Find(&notes).Error; err != nil || len(notes) != 3 {
+		t.Errorf("Expected all 3 notes with bypass, got %d (%v)", len(notes), err)
+	}
+	if len(audits) != 1 || audits[0].Action != guardrail.AuditTenantScopeBypass || audits[0].Reason != "nightly report" {
+		t.Errorf("Expected one audited bypass, got %+v", audits)
+	}
+
+	// Models that don't opt in are untouched
+	var users []guardrail.User
+	if err := db.Find(&users).Error; err != nil {
+		t.Errorf("Expected unscoped model to query freely, got %v", err)
+	}
+}
+
+func TestTenantScopedRequest(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true})
+	if err := db.AutoMigrate(&scopedNote{}); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+	ts := gr.NewTenantService()
+	acme, _ := ts.CreateTenant("Acme")
+	globex, _ := ts.CreateTenant("Globex")
+
+	db.WithContext(guardrail.WithTenant(context.Background(), acme.ID.String())).Create(&scopedNote{Body: "acme"})
+	db.WithContext(guardrail.WithTenant(context.Background(), globex.ID.String())).Create(&scopedNote{Body: "globex"})
+
+	issued, err := ts.CreateApplicationKey(globex.ID.String(), "backend", nil)
+	if err != nil {
+		t.Fatalf("CreateApplicationKey failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/notes", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error {
+		var notes []scopedNote
+		if err := gr.DB(c).Find(&notes).Error; err != nil {
+			return err
+		}
+		body := ""
+		for _, n := range notes {
+			body += n.Body
+		}
+		return c.SendString(body)
+	})
+
+	req := httptest.NewRequest("GET", "/notes", nil)
+	req.Header.Set(guardrail.HeaderApplicationKey, issued.Key)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "globex" {
+		t.Errorf("Expected only globex notes, got %q", body)
+	}
+}
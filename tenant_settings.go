@@ -0,0 +1,299 @@
+package guardrail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// LoginMethod is a way users can authenticate
+type LoginMethod string
+
+const (
+	LoginMethodPassword LoginMethod = "password"
+	LoginMethodSSO      LoginMethod = "sso"
+	LoginMethodPasskey  LoginMethod = "passkey"
+)
+
+var (
+	// ErrLoginMethodNotAllowed is returned when a tenant disabled the login method used
+	ErrLoginMethodNotAllowed = errors.New("login method is not allowed for this tenant")
+	// ErrIPNotAllowed is returned when the client IP is outside the tenant's allowlist
+	ErrIPNotAllowed = errors.New("ip address is not allowed for this tenant")
+	// ErrMFARequired is returned when a tenant requires MFA the account can't provide
+	ErrMFARequired = errors.New("multi-factor authentication is required")
+	// ErrSessionExpired is returned when a session outlived its maximum lifetime
+	ErrSessionExpired = errors.New("session has expired, please login again")
+	// ErrSelfRegistrationDisabled is returned by Register for invitation-only tenants
+	ErrSelfRegistrationDisabled = errors.New("registration requires an invitation for this tenant")
+)
+
+// tenantSettingsCacheTTL bounds how long resolved settings are cached.
+// Changes made through TenantService invalidate the entry immediately.
+const tenantSettingsCacheTTL = 5 * time.Minute
+
+// TenantSettings holds a tenant's overrides of the global Config. Nil fields
+// inherit from the parent tenant, and at the root from Config.
+type TenantSettings struct {
+	TenantID       uuid.UUID       `gorm:"type:uuid;primary_key" json:"tenant_id"`
+	PasswordPolicy *PasswordPolicy `gorm:"serializer:json" json:"password_policy,omitempty"`
+	RequireMFA     *bool           `json:"require_mfa,omitempty"`
+	// Empty list means every method; nil inherits
+	AllowedLoginMethods []LoginMethod `gorm:"serializer:json" json:"allowed_login_methods,omitempty"`
+	// Maximum time from login until the user must sign in again, 0 for no limit
+	SessionLifetime *time.Duration `json:"session_lifetime,omitempty"`
+	// IPs or CIDR ranges allowed to use the tenant. Empty list means any; nil inherits
+	IPAllowlist []string `gorm:"serializer:json" json:"ip_allowlist,omitempty"`
+	// Whether Register may add users without an invitation
+	AllowSelfRegistration *bool `json:"allow_self_registration,omitempty"`
+	// Selects the quota of RateLimit rules that list this plan in Plans
+	Plan      *string   `json:"plan,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for TenantSettings model
+func (TenantSettings) TableName() string {
+	return "tenant_settings"
+}
+
+// EffectiveSettings are the settings that apply to a tenant after inheritance
+type EffectiveSettings struct {
+	PasswordPolicy        PasswordPolicy `json:"password_policy"`
+	RequireMFA            bool           `json:"require_mfa"`
+	AllowedLoginMethods   []LoginMethod  `json:"allowed_login_methods"`
+	SessionLifetime       time.Duration  `json:"session_lifetime"`
+	IPAllowlist           []string       `json:"ip_allowlist"`
+	AllowSelfRegistration bool           `json:"allow_self_registration"`
+	Plan                  string         `json:"plan"`
+}
+
+// AllowsLoginMethod reports whether users may authenticate with method
+func (s EffectiveSettings) AllowsLoginMethod(method LoginMethod) bool {
+	if len(s.AllowedLoginMethods) == 0 {
+		return true
+	}
+	for _, m := range s.AllowedLoginMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether a client IP is inside the allowlist
+func (s EffectiveSettings) AllowsIP(ip string) bool {
+	if len(s.IPAllowlist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range s.IPAllowlist {
+		if _, network, err := parseIPRange(entry); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSettings returns the overrides stored for a tenant. Tenants without
+// overrides get an empty TenantSettings.
+func (ts *TenantService) GetSettings(tenantID string) (*TenantSettings, error) {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings TenantSettings
+	if err := ts.gr.db.Where("tenant_id = ?", tenant.ID).First(&settings).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &TenantSettings{TenantID: tenant.ID}, nil
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &settings, nil
+}
+
+// UpdateSettings replaces the overrides of a tenant
+func (ts *TenantService) UpdateSettings(tenantID string, settings TenantSettings) error {
+	tenant, err := ts.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+	if err := validateTenantSettings(settings); err != nil {
+		return err
+	}
+
+	settings.TenantID = tenant.ID
+	if err := ts.gr.db.Save(&settings).Error; err != nil {
+		return fmt.Errorf("failed to update tenant settings: %w", err)
+	}
+
+	ts.gr.invalidateTenantSubtree(tenant)
+	return nil
+}
+
+// EffectiveSettings returns the settings that apply to a tenant
+func (ts *TenantService) EffectiveSettings(tenantID string) (*EffectiveSettings, error) {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant_id: %w", err)
+	}
+	return ts.gr.effectiveSettings(id)
+}
+
+// globalSettings are the settings from Config, used without multi-tenancy
+// and as the root of tenant inheritance
+func (gr *GuardRail) globalSettings() *EffectiveSettings {
+	return &EffectiveSettings{
+		PasswordPolicy:        gr.config.PasswordPolicy,
+		RequireMFA:            gr.config.RequireMFA,
+		AllowedLoginMethods:   gr.config.AllowedLoginMethods,
+		SessionLifetime:       gr.config.SessionLifetime,
+		IPAllowlist:           gr.config.IPAllowlist,
+		AllowSelfRegistration: gr.config.AllowSelfRegistration,
+	}
+}
+
+// effectiveSettings resolves the settings of a tenant by applying the
+// overrides of its ancestors and itself on top of Config
+func (gr *GuardRail) effectiveSettings(tenantID uuid.UUID) (*EffectiveSettings, error) {
+	if !gr.config.EnableMultiTenant || tenantID == uuid.Nil {
+		return gr.globalSettings(), nil
+	}
+
+	ctx := context.Background()
+	cacheKey := "tenant_settings:" + tenantID.String()
+
+	if gr.redis != nil {
+		if val, err := gr.redis.Get(ctx, cacheKey).Result(); err == nil {
+			var cached EffectiveSettings
+			if json.Unmarshal([]byte(val), &cached) == nil {
+				return &cached, nil
+			}
+		}
+	}
+
+	ancestors, err := gr.tenantAncestorIDs(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	chain := append(append([]string{}, ancestors...), tenantID.String())
+
+	var overrides []TenantSettings
+	if err := gr.db.Where("tenant_id IN ?", chain).Find(&overrides).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	byTenant := make(map[string]TenantSettings, len(overrides))
+	for _, o := range overrides {
+		byTenant[o.TenantID.String()] = o
+	}
+
+	settings := gr.globalSettings()
+	for _, id := range chain {
+		o, ok := byTenant[id]
+		if !ok {
+			continue
+		}
+		if o.PasswordPolicy != nil {
+			settings.PasswordPolicy = o.PasswordPolicy.inherit(settings.PasswordPolicy)
+		}
+		if o.RequireMFA != nil {
+			settings.RequireMFA = *o.RequireMFA
+		}
+		if o.AllowedLoginMethods != nil {
+			settings.AllowedLoginMethods = o.AllowedLoginMethods
+		}
+		if o.SessionLifetime != nil {
+			settings.SessionLifetime = *o.SessionLifetime
+		}
+		if o.IPAllowlist != nil {
+			settings.IPAllowlist = o.IPAllowlist
+		}
+		if o.AllowSelfRegistration != nil {
+			settings.AllowSelfRegistration = *o.AllowSelfRegistration
+		}
+		if o.Plan != nil {
+			settings.Plan = *o.Plan
+		}
+	}
+
+	if gr.redis != nil {
+		if data, err := json.Marshal(settings); err == nil {
+			gr.redis.Set(ctx, cacheKey, data, tenantSettingsCacheTTL)
+		}
+	}
+
+	return settings, nil
+}
+
+// checkClientIP rejects requests from outside the bound tenant's allowlist
+func (gr *GuardRail) checkClientIP(c *fiber.Ctx, tenantID string) error {
+	id, err := uuid.Parse(tenantID)
+	if err != nil {
+		return nil
+	}
+	settings, err := gr.effectiveSettings(id)
+	if err != nil {
+		return err
+	}
+	if !settings.AllowsIP(c.IP()) {
+		return reject(fiber.StatusForbidden, gr.config.ErrorMessages.IPNotAllowed)
+	}
+	return nil
+}
+
+func validateTenantSettings(settings TenantSettings) error {
+	if p := settings.PasswordPolicy; p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	if settings.SessionLifetime != nil && *settings.SessionLifetime < 0 {
+		return fmt.Errorf("session lifetime cannot be negative")
+	}
+	for _, m := range settings.AllowedLoginMethods {
+		if !validLoginMethod(m) {
+			return fmt.Errorf("unknown login method: %s", m)
+		}
+	}
+	for _, entry := range settings.IPAllowlist {
+		if _, _, err := parseIPRange(entry); err != nil {
+			return fmt.Errorf("invalid ip allowlist entry %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+func validLoginMethod(method LoginMethod) bool {
+	switch method {
+	case LoginMethodPassword, LoginMethodSSO, LoginMethodPasskey:
+		return true
+	}
+	return false
+}
+
+// parseIPRange parses a CIDR range or a single IP address
+func parseIPRange(entry string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("not an ip address")
+		}
+		bits := 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 32
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	return net.ParseCIDR(entry)
+}
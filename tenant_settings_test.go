@@ -0,0 +1,123 @@
+package guardrail_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestTenantSettings(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	parent, _ := ts.CreateTenant("Parent")
+	child, _ := ts.CreateSubTenant(parent.ID.String(), "Child")
+
+	// Config defaults apply until a tenant overrides them
+	_, err := as.Register(guardrail.RegisterRequest{Email: "a@example.test", Password: "short", TenantID: child.ID.String()})
+	var policyErr *guardrail.PasswordPolicyError
+	if !errors.As(err, &policyErr) || policyErr.Violations[0].Rule != "min_length" {
+		t.Errorf("Expected min_length violation from Config, got %v", err)
+	}
+
+	// Overrides on the parent flow down, zero lengths keep the inherited value
+	err = ts.UpdateSettings(parent.ID.String(), guardrail.TenantSettings{
+		PasswordPolicy: &guardrail.PasswordPolicy{RequireDigit: true},
+	})
+	if err != nil {
+		t.Fatalf("UpdateSettings failed: %v", err)
+	}
+	effective, err := ts.EffectiveSettings(child.ID.String())
+	if err != nil || effective.PasswordPolicy.MinLength != 8 || !effective.PasswordPolicy.RequireDigit {
+		t.Errorf("Expected inherited policy, got %+v (%v)", effective, err)
+	}
+	_, err = as.Register(guardrail.RegisterRequest{Email: "a@example.test", Password: "no-digits-here", TenantID: child.ID.String()})
+	if !errors.As(err, &policyErr) || policyErr.Violations[0].Rule != "require_digit" {
+		t.Errorf("Expected require_digit violation, got %v", err)
+	}
+	if _, err := as.Register(guardrail.RegisterRequest{Email: "a@example.test", Password: "with-digit-1", TenantID: child.ID.String()}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	login := guardrail.LoginRequest{Email: "a@example.test", Password: "with-digit-1", IPAddress: "10.1.2.3"}
+
+	ts.UpdateSettings(child.ID.String(), guardrail.TenantSettings{AllowedLoginMethods: []guardrail.LoginMethod{guardrail.LoginMethodSSO}})
+	if _, err := as.Login(login); !errors.Is(err, guardrail.ErrLoginMethodNotAllowed) {
+		t.Errorf("Expected ErrLoginMethodNotAllowed for SSO-only tenant, got %v", err)
+	}
+
+	requireMFA := true
+	ts.UpdateSettings(child.ID.String(), guardrail.TenantSettings{RequireMFA: &requireMFA})
+	if resp, err := as.Login(login); err != nil || !resp.MFAEnrollmentRequired || resp.AccessToken != "" {
+		t.Errorf("Expected MFA enrollment before tokens, got %+v, %v", resp, err)
+	}
+
+	if err := ts.UpdateSettings(child.ID.String(), guardrail.TenantSettings{IPAllowlist: []string{"not-an-ip"}}); err == nil {
+		t.Error("Expected invalid allowlist entry to be rejected")
+	}
+	ts.UpdateSettings(child.ID.String(), guardrail.TenantSettings{IPAllowlist: []string{"10.0.0.0/8"}})
+	if _, err := as.Login(guardrail.LoginRequest{Email: login.Email, Password: login.Password, IPAddress: "192.168.1.1"}); !errors.Is(err, guardrail.ErrIPNotAllowed) {
+		t.Errorf("Expected ErrIPNotAllowed, got %v", err)
+	}
+	auth, err := as.Login(login)
+	if err != nil {
+		t.Fatalf("Login from allowed IP failed: %v", err)
+	}
+
+	// The middleware enforces the allowlist on every request
+	app := fiber.New()
+	app.Get("/me", gr.Protect(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	req := httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+auth.AccessToken)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected 403 from outside the allowlist, got %d", resp.StatusCode)
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	tenant, _ := ts.CreateTenant("Acme")
+	lifetime := time.Hour
+	ts.UpdateSettings(tenant.ID.String(), guardrail.TenantSettings{SessionLifetime: &lifetime})
+
+	auth, err := as.Register(guardrail.RegisterRequest{Email: "a@example.test", Password: "correct-horse-battery", TenantID: tenant.ID.String()})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	refreshed, err := as.RefreshToken(auth.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(refreshed.RefreshToken, claims); err != nil {
+		t.Fatalf("ParseUnverified failed: %v", err)
+	}
+	if exp := int64(claims["exp"].(float64)); exp > time.Now().Add(lifetime).Unix() {
+		t.Errorf("Expected refresh token to end with the session, exp %d", exp)
+	}
+
+	lifetime = time.Nanosecond
+	ts.UpdateSettings(tenant.ID.String(), guardrail.TenantSettings{SessionLifetime: &lifetime})
+	if _, err := as.RefreshToken(refreshed.RefreshToken); !errors.Is(err, guardrail.ErrSessionExpired) {
+		t.Errorf("Expected ErrSessionExpired, got %v", err)
+	}
+}
+
+func TestSettingsConfigValidation(t *testing.T) {
+	_, db := newTestGuardRail(t, guardrail.Config{})
+	_, err := guardrail.New(guardrail.Config{DB: db, JWTSecret: "secret", IPAllowlist: []string{"nope"}})
+	var cfgErr *guardrail.ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Errorf("Expected ConfigError for invalid IPAllowlist, got %v", err)
+	}
+}
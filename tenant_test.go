@@ -0,0 +1,328 @@
+package guardrail_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	guardrail "github.com/vviveksharma/auth"
+)
+
+func TestTenantService(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+
+	tenant, err := ts.CreateTenant("Acme")
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+	if !tenant.IsActive() {
+		t.Errorf("Expected new tenant to be active, got %q", tenant.Status)
+	}
+
+	renamed, err := ts.RenameTenant(tenant.ID.String(), "Acme Corp")
+	if err != nil {
+		t.Fatalf("RenameTenant failed: %v", err)
+	}
+	if renamed.Name != "Acme Corp" {
+		t.Errorf("Expected name %q, got %q", "Acme Corp", renamed.Name)
+	}
+
+	if err := ts.SuspendTenant(tenant.ID.String()); err != nil {
+		t.Fatalf("SuspendTenant failed: %v", err)
+	}
+	got, _ := ts.GetTenant(tenant.ID.String())
+	if got.Status != guardrail.TenantStatusSuspended || got.SuspendedAt == nil {
+		t.Errorf("Expected suspended tenant, got %+v", got)
+	}
+
+	if err := ts.ActivateTenant(tenant.ID.String()); err != nil {
+		t.Fatalf("ActivateTenant failed: %v", err)
+	}
+
+	if err := ts.DeleteTenant(tenant.ID.String()); err != nil {
+		t.Fatalf("DeleteTenant failed: %v", err)
+	}
+	if _, err := ts.GetTenant(tenant.ID.String()); err != guardrail.ErrTenantNotFound {
+		t.Errorf("Expected ErrTenantNotFound after delete, got %v", err)
+	}
+}
+
+func TestSuspendedTenantIsRejected(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+
+	tenant, err := ts.CreateTenant("Acme")
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+
+	auth, err := gr.NewAuthService().Register(guardrail.RegisterRequest{
+		Email:    "user@acme.test",
+		Password: "correct-horse-battery",
+		TenantID: tenant.ID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	issued, err := ts.CreateApplicationKey(tenant.ID.String(), "backend", nil)
+	if err != nil {
+		t.Fatalf("CreateApplicationKey failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/jwt", gr.Protect(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Get("/app", gr.ApplicationKeyMiddleware(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	do := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+auth.AccessToken)
+		req.Header.Set(guardrail.HeaderApplicationKey, issued.Key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := do("/jwt"); code != fiber.StatusOK {
+		t.Errorf("Expected 200 for active tenant token, got %d", code)
+	}
+	if code := do("/app"); code != fiber.StatusOK {
+		t.Errorf("Expected 200 for active tenant key, got %d", code)
+	}
+
+	if err := ts.SuspendTenant(tenant.ID.String()); err != nil {
+		t.Fatalf("SuspendTenant failed: %v", err)
+	}
+
+	if code := do("/jwt"); code != fiber.StatusForbidden {
+		t.Errorf("Expected 403 for suspended tenant token, got %d", code)
+	}
+	if code := do("/app"); code != fiber.StatusForbidden {
+		t.Errorf("Expected 403 for suspended tenant key, got %d", code)
+	}
+}
+
+func TestTenantCrossCheck(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+
+	tenantA, _ := ts.CreateTenant("Tenant A")
+	tenantB, _ := ts.CreateTenant("Tenant B")
+
+	auth, err := gr.NewAuthService().Register(guardrail.RegisterRequest{
+		Email:    "user@a.test",
+		Password: "correct-horse-battery",
+		TenantID: tenantA.ID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	keyA, _ := ts.CreateApplicationKey(tenantA.ID.String(), "a", nil)
+	keyB, _ := ts.CreateApplicationKey(tenantB.ID.String(), "b", nil)
+
+	handler := func(c *fiber.Ctx) error {
+		tenantID, _ := guardrail.GetTenantID(c)
+		return c.SendString(tenantID)
+	}
+
+	app := fiber.New()
+	app.Get("/combined", gr.ProtectTenant(), handler)
+	app.Get("/chained", gr.ApplicationKeyMiddleware(), gr.Protect(), handler)
+
+	do := func(path, key string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+auth.AccessToken)
+		req.Header.Set(guardrail.HeaderApplicationKey, key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/combined", "/chained"} {
+		if code := do(path, keyA.Key); code != fiber.StatusOK {
+			t.Errorf("%s: expected 200 for matching tenants, got %d", path, code)
+		}
+		if code := do(path, keyB.Key); code != fiber.StatusForbidden {
+			t.Errorf("%s: expected 403 for mismatched tenants, got %d", path, code)
+		}
+	}
+}
+
+func TestProtectWithRoleRunsHandlerOnce(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableRBAC: true})
+
+	auth, err := gr.NewAuthService().Register(guardrail.RegisterRequest{
+		Email:    "user@example.test",
+		Password: "correct-horse-battery",
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	calls := 0
+	app := fiber.New()
+	app.Get("/admin", gr.ProtectWithRole("admin"), func(c *fiber.Ctx) error {
+		calls++
+		return c.SendString("ok")
+	})
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.Header.Set("Authorization", "Bearer "+auth.AccessToken)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected 403 for non-admin, got %d", resp.StatusCode)
+	}
+	if calls != 0 {
+		t.Errorf("Expected handler not to run for non-admin, ran %d times", calls)
+	}
+}
+
+func TestTenantSigningKeysAndTokenSettings(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	tenant, _ := ts.CreateTenant("Enterprise")
+	req := guardrail.RegisterRequest{
+		Email:    "user@enterprise.test",
+		Password: "correct-horse-battery",
+		TenantID: tenant.ID.String(),
+	}
+	globalAuth, err := as.Register(req)
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/", gr.Protect(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	status := func(token string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(r)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	key, err := ts.CreateSigningKey(tenant.ID.String(), "")
+	if err != nil {
+		t.Fatalf("CreateSigningKey failed: %v", err)
+	}
+	if err := ts.SetTokenSettings(tenant.ID.String(), guardrail.TenantTokenSettings{AccessTokenExpiry: 2 * time.Minute}); err != nil {
+		t.Fatalf("SetTokenSettings failed: %v", err)
+	}
+
+	login := guardrail.LoginRequest{Email: req.Email, Password: req.Password, TenantID: req.TenantID}
+	tenantAuth, err := as.Login(login)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(tenantAuth.AccessToken, jwt.MapClaims{})
+	if parsed.Header["kid"] != key.KID {
+		t.Errorf("Expected kid %q, got %v", key.KID, parsed.Header["kid"])
+	}
+	if until := time.Until(tenantAuth.ExpiresAt); until > 2*time.Minute || until < time.Minute {
+		t.Errorf("Expected tenant access expiry of 2 minutes, got %v", until)
+	}
+
+	if code := status(tenantAuth.AccessToken); code != fiber.StatusOK {
+		t.Errorf("Expected tenant-signed token to verify, got %d", code)
+	}
+	if code := status(globalAuth.AccessToken); code != fiber.StatusUnauthorized {
+		t.Errorf("Expected global-signed token to be rejected once the tenant has a key, got %d", code)
+	}
+	if _, err := as.RefreshToken(tenantAuth.RefreshToken); err != nil {
+		t.Errorf("Expected refresh with tenant-signed token to work, got %v", err)
+	}
+
+	// Secrets are stored encrypted, and older plaintext ones get encrypted
+	var stored guardrail.TenantSigningKey
+	db.Where("kid = ?", key.KID).First(&stored)
+	if !strings.HasPrefix(stored.Secret, "v1:") {
+		t.Errorf("Expected an encrypted secret, got %q", stored.Secret)
+	}
+	legacySecret := strings.Repeat("legacy-secret-", 3)
+	db.Model(&guardrail.TenantSigningKey{}).Where("tenant_id = ?", tenant.ID).Update("is_primary", false)
+	db.Create(&guardrail.TenantSigningKey{TenantID: tenant.ID, KID: "tk_legacy", Secret: legacySecret, IsPrimary: true})
+	if err := gr.AutoMigrate(); err != nil {
+		t.Fatalf("AutoMigrate failed: %v", err)
+	}
+	db.Where("kid = ?", "tk_legacy").First(&stored)
+	if !strings.HasPrefix(stored.Secret, "v1:") {
+		t.Errorf("Expected the legacy secret to be encrypted, got %q", stored.Secret)
+	}
+	legacyAuth, err := as.Login(login)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if _, err := jwt.Parse(legacyAuth.AccessToken, func(*jwt.Token) (interface{}, error) { return []byte(legacySecret), nil }); err != nil {
+		t.Errorf("Expected the migrated key to keep its secret, got %v", err)
+	}
+	if err := ts.RevokeSigningKey("tk_legacy"); err != nil {
+		t.Fatalf("RevokeSigningKey failed: %v", err)
+	}
+
+	if err := ts.RevokeSigningKey(key.KID); err != nil {
+		t.Fatalf("RevokeSigningKey failed: %v", err)
+	}
+	if code := status(tenantAuth.AccessToken); code != fiber.StatusUnauthorized {
+		t.Errorf("Expected token to be rejected after key revocation, got %d", code)
+	}
+	if code := status(globalAuth.AccessToken); code != fiber.StatusOK {
+		t.Errorf("Expected fallback to global secret after revoking the only key, got %d", code)
+	}
+}
+
+func TestTenantSigningKeyScope(t *testing.T) {
+	gr, _ := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true, AllowSelfRegistration: true})
+	ts := gr.NewTenantService()
+	as := gr.NewAuthService()
+
+	acme, _ := ts.CreateTenant("Acme")
+	globex, _ := ts.CreateTenant("Globex")
+	secret := strings.Repeat("acme-brings-its-own-", 2)
+	key, err := ts.CreateSigningKey(acme.ID.String(), secret)
+	if err != nil {
+		t.Fatalf("CreateSigningKey failed: %v", err)
+	}
+	victim, err := as.Register(guardrail.RegisterRequest{Email: "ceo@globex.test", Password: "correct-horse-battery", TenantID: globex.ID.String()})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/", gr.Protect(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	// Acme's key can't vouch for someone outside Acme
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":   victim.UserID,
+		"tenant_id": acme.ID.String(),
+		"roles":     []string{"admin"},
+		"type":      "access",
+		"sv":        0,
+		"iat":       time.Now().Unix(),
+		"auth_time": time.Now().Unix(),
+		"exp":       time.Now().Add(time.Minute).Unix(),
+	})
+	forged.Header["kid"] = key.KID
+	token, _ := forged.SignedString([]byte(secret))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if resp, err := app.Test(r); err != nil || resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("Expected a token for a non-member to be rejected, got %v, %v", resp.StatusCode, err)
+	}
+}
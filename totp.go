@@ -0,0 +1,292 @@
+package guardrail
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters, the ones every authenticator app supports (RFC 6238)
+const (
+	totpSecretBytes = 20
+	totpDigits      = 6
+	totpPeriod      = 30 * time.Second
+	// Codes from one step before or after are accepted for clock drift
+	totpSkew = 1
+)
+
+var (
+	// ErrTOTPAlreadyEnrolled is returned when enrolling a user whose TOTP is already confirmed
+	ErrTOTPAlreadyEnrolled = errors.New("totp is already enabled for this user")
+	// ErrTOTPNotEnrolled is returned when the user has no TOTP enrollment to act on
+	ErrTOTPNotEnrolled = errors.New("totp is not enabled for this user")
+	// ErrInvalidMFACode is returned for wrong, expired or reused codes
+	ErrInvalidMFACode = errors.New("invalid verification code")
+)
+
+// TOTPFactor is a user's authenticator app
+type TOTPFactor struct {
+	ID     uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex"`
+	// Encrypted with the user ID as associated data, see encryptSecret
+	Secret string `gorm:"not null"`
+	// Nil until the first code confirmed the enrollment
+	ConfirmedAt *time.Time
+	// Time step of the last accepted code, which can't be used again
+	LastUsedStep int64 `gorm:"not null;default:0"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// TableName specifies the table name for TOTPFactor model
+func (TOTPFactor) TableName() string {
+	return "totp_factors"
+}
+
+// BeforeCreate assigns the factor ID
+func (f *TOTPFactor) BeforeCreate(tx *gorm.DB) error {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return nil
+}
+
+// TOTPEnrollment is what the user needs to set up their authenticator app.
+// Show URI as a QR code, with Secret for manual entry.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// EnrollTOTP starts TOTP enrollment and returns a new secret. Nothing changes
+// at login until ConfirmTOTP accepted a code generated from it; enrolling
+// again before that replaces the secret. userID must come from an
+// authenticated request, e.g. GetUserID(c), and the current password is
+// checked so a stolen session alone can't put its own app on the account.
+func (as *AuthService) EnrollTOTP(userID, currentPassword string) (*TOTPEnrollment, error) {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return nil, err
+	}
+	return as.startTOTPEnrollment(user)
+}
+
+// EnrollTOTPForLogin starts TOTP enrollment for a login that returned
+// MFAEnrollmentRequired, using its MFAToken. VerifyMFA with a code from the
+// app then confirms it and completes the login.
+func (as *AuthService) EnrollTOTPForLogin(mfaToken string) (*TOTPEnrollment, error) {
+	challenge, err := as.gr.findMFAChallenge(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if !challenge.Enrollment {
+		return nil, ErrTOTPAlreadyEnrolled
+	}
+	user, err := as.activeUser(challenge.UserID.String())
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	return as.startTOTPEnrollment(user)
+}
+
+// startTOTPEnrollment stores a new unconfirmed secret for user
+func (as *AuthService) startTOTPEnrollment(user *User) (*TOTPEnrollment, error) {
+	var existing TOTPFactor
+	err := as.gr.db.Where("user_id = ?", user.ID).First(&existing).Error
+	if err == nil && existing.ConfirmedAt != nil {
+		return nil, ErrTOTPAlreadyEnrolled
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	raw := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	encrypted, err := as.gr.encryptSecret(raw, user.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&TOTPFactor{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&TOTPFactor{UserID: user.ID, Secret: encrypted}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll totp: %w", err)
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(as.gr.config.MFAIssuer, user.Email, secret)}, nil
+}
+
+// ConfirmTOTP completes enrollment with a code from the authenticator app,
+// which only EnrollTOTP revealed. From then on Login asks for a code after
+// the password.
+func (as *AuthService) ConfirmTOTP(userID, code string) error {
+	user, err := as.activeUser(userID)
+	if err != nil {
+		return err
+	}
+	ok, err := as.gr.confirmTOTP(*user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// confirmTOTP checks a code against a user's unconfirmed factor and confirms it
+func (gr *GuardRail) confirmTOTP(user User, code string) (bool, error) {
+	var factor TOTPFactor
+	if err := gr.db.Where("user_id = ?", user.ID).First(&factor).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, ErrTOTPNotEnrolled
+		}
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	if factor.ConfirmedAt != nil {
+		return false, ErrTOTPAlreadyEnrolled
+	}
+
+	ok, err := gr.useTOTPCode(&factor, code, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := gr.db.Model(&factor).Update("confirmed_at", time.Now()).Error; err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+
+	gr.audit(AuditEvent{
+		Action:   AuditMFAEnrolled,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"method": string(MFAMethodTOTP)},
+	})
+	return true, nil
+}
+
+// DisableTOTP removes a user's authenticator app after checking their
+// password, so a stolen session alone can't turn MFA off. Recovery codes go
+// too when it was the last second factor.
+func (as *AuthService) DisableTOTP(userID, currentPassword string) error {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("user_id = ?", user.ID).Delete(&TOTPFactor{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTOTPNotEnrolled
+		}
+		return dropOrphanedRecoveryCodes(tx, user.ID)
+	})
+	if errors.Is(err, ErrTOTPNotEnrolled) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditMFADisabled,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"method": string(MFAMethodTOTP)},
+	})
+	return nil
+}
+
+// verifyTOTP checks a code against a user's confirmed factor
+func (gr *GuardRail) verifyTOTP(user User, code string) (bool, error) {
+	var factor TOTPFactor
+	if err := gr.db.Where("user_id = ? AND confirmed_at IS NOT NULL", user.ID).First(&factor).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return gr.useTOTPCode(&factor, code, time.Now())
+}
+
+// useTOTPCode checks a code and records its time step, so each code works
+// only once even when two requests race
+func (gr *GuardRail) useTOTPCode(factor *TOTPFactor, code string, now time.Time) (bool, error) {
+	secret, err := gr.decryptSecret(factor.Secret, factor.UserID.String())
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt totp secret: %w", err)
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), now)
+	if !ok || step <= factor.LastUsedStep {
+		return false, nil
+	}
+
+	result := gr.db.Model(&TOTPFactor{}).
+		Where("id = ? AND last_used_step < ?", factor.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return false, fmt.Errorf("database error: %w", result.Error)
+	}
+	factor.LastUsedStep = step
+	return result.RowsAffected == 1, nil
+}
+
+// matchTOTP returns the time step a code belongs to, if it is valid now
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(hotp(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp computes the code for a counter value (RFC 4226)
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpURI builds the otpauth:// URI authenticator apps read from QR codes
+func totpURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
@@ -0,0 +1,350 @@
+package guardrail
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ImportFormat selects how ImportUsers reads its input
+type ImportFormat string
+
+const (
+	// ImportFormatJSON is a JSON array or newline-delimited JSON of ImportUser
+	ImportFormatJSON ImportFormat = "json"
+	// ImportFormatCSV has a header row naming ImportUser's JSON fields,
+	// unknown columns are ignored
+	ImportFormatCSV ImportFormat = "csv"
+	// ImportFormatFirebase is the output of `firebase auth:export --format=json`
+	ImportFormatFirebase ImportFormat = "firebase"
+)
+
+// AlgorithmFirebaseScrypt marks an ImportUser hash and salt exported from Firebase
+const AlgorithmFirebaseScrypt = "firebase-scrypt"
+
+// maxImportErrors bounds the errors kept in an ImportResult
+const maxImportErrors = 1000
+
+// ImportUser is one account to import. PasswordHash is kept as-is in one of
+// the formats verifyPassword understands (Argon2id PHC, bcrypt, scrypt,
+// PBKDF2-SHA256, Django PBKDF2) and upgraded to Argon2id at the next login.
+// Firebase hashes need Algorithm "firebase-scrypt" and their Salt. Users
+// without a hash have to reset their password.
+type ImportUser struct {
+	Email         string `json:"email"`
+	PasswordHash  string `json:"password_hash"`
+	Salt          string `json:"salt"`
+	Algorithm     string `json:"algorithm"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Role          string `json:"role"`
+	TenantID      string `json:"tenant_id"`
+	EmailVerified bool   `json:"email_verified"`
+	// Disabled accounts are skipped rather than imported as active
+	Disabled bool `json:"disabled"`
+}
+
+// ImportOptions are defaults for imported users
+type ImportOptions struct {
+	TenantID string // For records without a tenant_id
+	Role     string // For records without a role (default: "user")
+}
+
+// ImportError describes a record that could not be imported. Record counts
+// from 1 in input order.
+type ImportError struct {
+	Record  int    `json:"record"`
+	Email   string `json:"email,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportResult summarizes an import
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"` // Disabled accounts
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors,omitempty"` // The first 1000 failures
+}
+
+// firebaseUser is a user in a Firebase auth export
+type firebaseUser struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	PasswordHash  string `json:"passwordHash"`
+	Salt          string `json:"salt"`
+	DisplayName   string `json:"displayName"`
+	Disabled      bool   `json:"disabled"`
+}
+
+// errSkipImport marks a record that is left out on purpose
+var errSkipImport = errors.New("skipped")
+
+// ImportUsers streams users with existing password hashes into the database,
+// e.g. exports from Auth0, Firebase or another app. Records fail on their
+// own (invalid, duplicate email, unknown hash format) without stopping the
+// import; an error is only returned for unreadable input or a cancelled
+// ctx, along with the result so far.
+func (as *AuthService) ImportUsers(ctx context.Context, r io.Reader, format ImportFormat, opts ImportOptions) (*ImportResult, error) {
+	result := &ImportResult{}
+	record := 0
+	add := func(u ImportUser) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record++
+		switch err := as.importUser(u, opts); {
+		case err == nil:
+			result.Imported++
+		case errors.Is(err, errSkipImport):
+			result.Skipped++
+		default:
+			result.Failed++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, ImportError{Record: record, Email: u.Email, Message: err.Error()})
+			}
+		}
+		return nil
+	}
+
+	var err error
+	switch format {
+	case ImportFormatJSON:
+		err = readImportJSON(r, add)
+	case ImportFormatCSV:
+		err = readImportCSV(r, add)
+	case ImportFormatFirebase:
+		err = readImportFirebase(r, add)
+	default:
+		err = fmt.Errorf("unknown import format %q", format)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditUsersImported,
+		TenantID: opts.TenantID,
+		Metadata: map[string]string{
+			"format":   string(format),
+			"imported": strconv.Itoa(result.Imported),
+			"failed":   strconv.Itoa(result.Failed),
+		},
+	})
+	return result, err
+}
+
+// importUser validates and stores one record
+func (as *AuthService) importUser(u ImportUser, opts ImportOptions) error {
+	if u.Disabled {
+		return errSkipImport
+	}
+	email := normalizeEmail(u.Email)
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("a valid email is required")
+	}
+
+	hash := u.PasswordHash
+	if u.Algorithm == AlgorithmFirebaseScrypt && hash != "" {
+		hash = hashPrefixFirebaseScrypt + u.Salt + "$" + hash
+	} else if u.Algorithm != "" {
+		return fmt.Errorf("unknown algorithm %q", u.Algorithm)
+	}
+	if hash != "" {
+		if err := checkImportedHash(hash); err != nil {
+			return err
+		}
+	}
+
+	tenantID := u.TenantID
+	if tenantID == "" {
+		tenantID = opts.TenantID
+	}
+	var tenantUUID uuid.UUID
+	if as.gr.config.EnableMultiTenant {
+		var err error
+		if tenantUUID, err = uuid.Parse(tenantID); err != nil {
+			return fmt.Errorf("invalid tenant_id: %w", err)
+		}
+	}
+
+	role := u.Role
+	if role == "" {
+		role = opts.Role
+	}
+	if role == "" {
+		role = "user"
+	}
+
+	user := User{
+		Email:     email,
+		Password:  hash,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		TenantID:  tenantUUID,
+	}
+	if u.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	return as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if taken, err := as.gr.emailTaken(tx, email, tenantUUID); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		} else if taken {
+			return ErrEmailTaken
+		}
+		return as.insertAccount(tx, &user, []string{role})
+	})
+}
+
+// readImportJSON reads a JSON array or newline-delimited JSON objects
+func readImportJSON(r io.Reader, add func(ImportUser) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+
+	dec := json.NewDecoder(br)
+	if b, _ := br.Peek(1); b[0] == '[' {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for dec.More() {
+		var u ImportUser
+		if err := dec.Decode(&u); err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+		if err := add(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImportCSV reads a CSV file whose header names ImportUser's JSON fields
+func readImportCSV(r io.Reader, add func(ImportUser) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid csv: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return fmt.Errorf("invalid csv: no email column")
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid csv: %w", err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		verified, _ := strconv.ParseBool(field("email_verified"))
+		disabled, _ := strconv.ParseBool(field("disabled"))
+		err = add(ImportUser{
+			Email:         field("email"),
+			PasswordHash:  field("password_hash"),
+			Salt:          field("salt"),
+			Algorithm:     field("algorithm"),
+			FirstName:     field("first_name"),
+			LastName:      field("last_name"),
+			Role:          field("role"),
+			TenantID:      field("tenant_id"),
+			EmailVerified: verified,
+			Disabled:      disabled,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readImportFirebase reads {"users": [...]} one user at a time
+func readImportFirebase(r io.Reader, add func(ImportUser) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("invalid firebase export: expected an object")
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("invalid firebase export: %w", err)
+		}
+		if key != "users" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("invalid firebase export: %w", err)
+			}
+			continue
+		}
+
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return fmt.Errorf("invalid firebase export: users must be an array")
+		}
+		for dec.More() {
+			var fu firebaseUser
+			if err := dec.Decode(&fu); err != nil {
+				return fmt.Errorf("invalid firebase export: %w", err)
+			}
+			if err := add(fu.importUser()); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("invalid firebase export: %w", err)
+		}
+	}
+	return nil
+}
+
+// importUser converts a Firebase user
+func (fu firebaseUser) importUser() ImportUser {
+	first, last, _ := strings.Cut(strings.TrimSpace(fu.DisplayName), " ")
+	u := ImportUser{
+		Email:         fu.Email,
+		FirstName:     first,
+		LastName:      last,
+		EmailVerified: fu.EmailVerified,
+		Disabled:      fu.Disabled,
+	}
+	if fu.PasswordHash != "" {
+		u.PasswordHash, u.Salt, u.Algorithm = fu.PasswordHash, fu.Salt, AlgorithmFirebaseScrypt
+	}
+	return u
+}
@@ -0,0 +1,176 @@
+package guardrail_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Example parameters and account from Firebase's scrypt documentation
+var firebaseTestParams = &guardrail.FirebaseScryptParams{
+	SignerKey:     "jxspr8Ki0RYycVU8zykbdLGjFQ3McFUH0uiiTvC8pVMXAn210wjLNmdZJzxUECKbm0QsEmYUSDzZvpjeJ9WmXA==",
+	SaltSeparator: "Bw==",
+	Rounds:        8,
+	MemCost:       14,
+}
+
+func TestImportLegacyHashes(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{FirebaseScrypt: firebaseTestParams})
+	as := gr.NewAuthService()
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("bcrypt-password"), bcrypt.MinCost)
+	salt := []byte("sixteen byte salt")
+	scryptKey, _ := scrypt.Key([]byte("scrypt-password"), salt, 1<<4, 8, 1, 32)
+	pbkdf2Key := pbkdf2.Key([]byte("pbkdf2-password"), salt, 1000, 32, sha256.New)
+	djangoKey := pbkdf2.Key([]byte("django-password"), []byte("djangosalt"), 1000, 32, sha256.New)
+
+	input := `[
+		{"email": "bcrypt@example.test", "password_hash": "` + string(bcryptHash) + `", "email_verified": true},
+		{"email": "scrypt@example.test", "password_hash": "$scrypt$ln=4,r=8,p=1$` + b64(salt) + `$` + b64(scryptKey) + `"},
+		{"email": "pbkdf2@example.test", "password_hash": "$pbkdf2-sha256$i=1000$` + b64(salt) + `$` + b64(pbkdf2Key) + `"},
+		{"email": "django@example.test", "password_hash": "pbkdf2_sha256$1000$djangosalt$` + base64.StdEncoding.EncodeToString(djangoKey) + `"},
+		{"email": "firebase@example.test", "password_hash": "lSrfV15cpx95/sZS2W9c9Kp6i/LVgQNDNC/qzrCnh1SAyZvqmZqAjTdn3aoItz+VHjoZilo78198JAdRuid5lQ==", "salt": "42xEC+ixf3L2lw==", "algorithm": "firebase-scrypt"},
+		{"email": "md5@example.test", "password_hash": "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{"email": "BCRYPT@example.test", "password_hash": "` + string(bcryptHash) + `"}
+	]`
+	result, err := as.ImportUsers(context.Background(), strings.NewReader(input), guardrail.ImportFormatJSON, guardrail.ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportUsers failed: %v", err)
+	}
+	if result.Imported != 5 || result.Failed != 2 || result.Errors[0].Record != 6 || result.Errors[1].Record != 7 {
+		t.Fatalf("Unexpected import result: %+v", result)
+	}
+
+	for email, password := range map[string]string{
+		"bcrypt@example.test":   "bcrypt-password",
+		"scrypt@example.test":   "scrypt-password",
+		"pbkdf2@example.test":   "pbkdf2-password",
+		"django@example.test":   "django-password",
+		"firebase@example.test": "user1password",
+	} {
+		if _, err := as.Login(guardrail.LoginRequest{Email: email, Password: "wrong-password"}); err == nil {
+			t.Errorf("Expected wrong password to be rejected for %s", email)
+		}
+		if _, err := as.Login(guardrail.LoginRequest{Email: email, Password: password}); err != nil {
+			t.Errorf("Login for %s failed: %v", email, err)
+			continue
+		}
+
+		// Converted to Argon2id on the first login, same password keeps working
+		var user guardrail.User
+		db.Where("email = ?", email).First(&user)
+		if !strings.HasPrefix(user.Password, "$argon2id$") {
+			t.Errorf("Expected %s to be rehashed, got %q", email, user.Password)
+		}
+		if _, err := as.Login(guardrail.LoginRequest{Email: email, Password: password}); err != nil {
+			t.Errorf("Login for %s after rehash failed: %v", email, err)
+		}
+	}
+
+	var verified guardrail.User
+	db.Where("email = ?", "bcrypt@example.test").First(&verified)
+	if verified.EmailVerifiedAt == nil {
+		t.Error("Expected email_verified to be imported")
+	}
+}
+
+func TestImportFormats(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{EnableMultiTenant: true})
+	tenant, _ := gr.NewTenantService().CreateTenant("Acme")
+	as := gr.NewAuthService()
+	ctx := context.Background()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("bcrypt-password"), bcrypt.MinCost)
+	opts := guardrail.ImportOptions{TenantID: tenant.ID.String()}
+
+	csvInput := "Email,Password_Hash,First_Name,Role,Extra\n" +
+		"csv@example.test," + string(hash) + ",Ada,admin,ignored\n" +
+		"nohash@example.test,,Bob,,\n"
+	result, err := as.ImportUsers(ctx, strings.NewReader(csvInput), guardrail.ImportFormatCSV, opts)
+	if err != nil || result.Imported != 2 {
+		t.Fatalf("CSV import = %+v, %v", result, err)
+	}
+
+	ndjson := `{"email": "ndjson@example.test", "password_hash": "` + string(hash) + `"}
+{"email": "not-an-email"}
+`
+	result, err = as.ImportUsers(ctx, strings.NewReader(ndjson), guardrail.ImportFormatJSON, opts)
+	if err != nil || result.Imported != 1 || result.Failed != 1 {
+		t.Fatalf("NDJSON import = %+v, %v", result, err)
+	}
+
+	firebase := `{"users": [
+		{"localId": "a", "email": "fb@example.test", "displayName": "Grace Hopper", "emailVerified": true, "passwordHash": "abc=", "salt": "def="},
+		{"localId": "b", "email": "disabled@example.test", "disabled": true}
+	]}`
+	result, err = as.ImportUsers(ctx, strings.NewReader(firebase), guardrail.ImportFormatFirebase, opts)
+	if err != nil || result.Imported != 1 || result.Skipped != 1 {
+		t.Fatalf("Firebase import = %+v, %v", result, err)
+	}
+
+	var admin guardrail.User
+	db.Where("email = ?", "csv@example.test").First(&admin)
+	if admin.FirstName != "Ada" || admin.Role != "admin" || admin.TenantID != tenant.ID {
+		t.Errorf("Unexpected CSV user: %+v", admin)
+	}
+	var grace guardrail.User
+	db.Where("email = ?", "fb@example.test").First(&grace)
+	if grace.FirstName != "Grace" || grace.LastName != "Hopper" || !strings.HasPrefix(grace.Password, "$firebase-scrypt$def=$") {
+		t.Errorf("Unexpected Firebase user: %+v", grace)
+	}
+	resp, err := as.Login(guardrail.LoginRequest{Email: "csv@example.test", Password: "bcrypt-password"})
+	if err != nil || resp.Role != "admin" || resp.TenantID != tenant.ID.String() {
+		t.Errorf("Expected imported admin to log into Acme, got %+v, %v", resp, err)
+	}
+
+	if _, err := as.ImportUsers(ctx, strings.NewReader(`[{"email": 1}`), guardrail.ImportFormatJSON, opts); err == nil {
+		t.Error("Expected malformed JSON to stop the import")
+	}
+}
+
+func TestImportHashLimits(t *testing.T) {
+	gr, db := newTestGuardRail(t, guardrail.Config{Lockout: guardrail.LockoutPolicy{MaxFailures: 100}})
+	as := gr.NewAuthService()
+	ctx := context.Background()
+	b64 := base64.RawStdEncoding.EncodeToString
+	salt, key := b64([]byte("sixteen byte salt")), b64(make([]byte, 32))
+
+	// Each of these would take minutes or gigabytes to check at login
+	expensive := []string{
+		"$argon2id$v=19$m=4194304,t=1,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1000,p=4$" + salt + "$" + key,
+		"$2a$31$" + strings.Repeat("a", 53),
+		"$scrypt$ln=24,r=8,p=1$" + salt + "$" + key,
+		"$scrypt$ln=14,r=8,p=1000$" + salt + "$" + key,
+		"$pbkdf2-sha256$i=1000000000$" + salt + "$" + key,
+		"pbkdf2_sha256$1000000000$djangosalt$" + key,
+		"$pbkdf2-sha256$i=1000$" + salt + "$" + b64(make([]byte, 4096)),
+	}
+	var input strings.Builder
+	for i, hash := range expensive {
+		input.WriteString(`{"email": "user` + strconv.Itoa(i) + `@example.test", "password_hash": "` + hash + `"}` + "\n")
+	}
+	result, err := as.ImportUsers(ctx, strings.NewReader(input.String()), guardrail.ImportFormatJSON, guardrail.ImportOptions{})
+	if err != nil || result.Imported != 0 || result.Failed != len(expensive) {
+		t.Fatalf("Expected every hash to be refused, got %+v, %v", result, err)
+	}
+
+	// Hashes that got into the table some other way are refused at login too
+	if _, err := as.ImportUsers(ctx, strings.NewReader(`{"email": "ada@example.test"}`), guardrail.ImportFormatJSON, guardrail.ImportOptions{}); err != nil {
+		t.Fatalf("ImportUsers failed: %v", err)
+	}
+	for _, hash := range expensive {
+		db.Model(&guardrail.User{}).Where("email = ?", "ada@example.test").Update("password", hash)
+		if _, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "password"}); err == nil {
+			t.Errorf("Expected login against %q to fail", hash)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// errInvalidUserToken is returned for unknown, expired or used user tokens;
+// each flow maps it to its own exported error
+var errInvalidUserToken = errors.New("token is invalid or has expired")
+
+// UserToken is a single-use token emailed to a user, e.g. to verify their
+// address. Only a hash of the token is stored.
+type UserToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	Purpose   string    `gorm:"type:varchar(40);not null;index"`
+	TokenHash string    `gorm:"type:varchar(64);uniqueIndex"`
+	// Address the token was sent to
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for UserToken model
+func (UserToken) TableName() string {
+	return "user_tokens"
+}
+
+// BeforeCreate assigns the token ID
+func (t *UserToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// issueUserToken creates a token for a user, to be sent to email, voiding
+// any unused token they hold for the same purpose
+func (gr *GuardRail) issueUserToken(db *gorm.DB, user User, email, purpose string, ttl time.Duration) (string, *UserToken, error) {
+	token, hash, err := gr.newSignedToken(purpose)
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: hash,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := gr.voidUserTokens(tx, user.ID, purpose); err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &record, nil
+}
+
+// findUserToken looks up a token that can still be redeemed
+func (gr *GuardRail) findUserToken(db *gorm.DB, purpose, token string) (*UserToken, error) {
+	hash, ok := gr.verifySignedToken(purpose, token)
+	if !ok {
+		return nil, errInvalidUserToken
+	}
+
+	var record UserToken
+	if err := db.Where("token_hash = ? AND purpose = ?", hash, purpose).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errInvalidUserToken
+		}
+		return nil, err
+	}
+	if record.UsedAt != nil || !time.Now().Before(record.ExpiresAt) {
+		return nil, errInvalidUserToken
+	}
+	return &record, nil
+}
+
+// consumeUserToken redeems a token, at most once even under concurrent use
+func (gr *GuardRail) consumeUserToken(db *gorm.DB, purpose, token string) (*UserToken, error) {
+	record, err := gr.findUserToken(db, purpose, token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res := db.Model(&UserToken{}).Where("id = ? AND used_at IS NULL", record.ID).Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errInvalidUserToken
+	}
+
+	record.UsedAt = &now
+	return record, nil
+}
+
+// voidUserTokens marks every unused token of a user for a purpose as used
+func (gr *GuardRail) voidUserTokens(db *gorm.DB, userID uuid.UUID, purpose string) error {
+	return db.Model(&UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", time.Now()).Error
+}
+
+// recentlyIssued reports whether a user got a token for a purpose within
+// Config.EmailResendInterval, to keep their inbox from being flooded
+func (gr *GuardRail) recentlyIssued(userID uuid.UUID, purpose string) (bool, error) {
+	var recent int64
+	err := gr.db.Model(&UserToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, time.Now().Add(-gr.config.EmailResendInterval)).
+		Count(&recent).Error
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return recent > 0, nil
+}
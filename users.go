@@ -0,0 +1,115 @@
+package guardrail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// EmailScope controls where user email addresses must be unique
+type EmailScope string
+
+const (
+	// EmailScopeGlobal allows each email address once across all tenants
+	EmailScopeGlobal EmailScope = "global"
+	// EmailScopeTenant allows the same email address once per tenant
+	EmailScopeTenant EmailScope = "tenant"
+)
+
+// Index names used for email uniqueness. idx_users_email matches the name
+// GORM generated for the original uniqueIndex tag, so existing databases keep it.
+const (
+	userEmailIndex       = "idx_users_email"
+	userTenantEmailIndex = "idx_users_tenant_email"
+)
+
+// ErrEmailTaken is returned when an email address is already registered
+// within the uniqueness scope
+var ErrEmailTaken = errors.New("user with this email already exists")
+
+// normalizeEmail trims and lowercases an email address so lookups and
+// uniqueness checks are case-insensitive
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// tenantScoped reports whether users are partitioned by tenant
+func (gr *GuardRail) tenantScoped() bool {
+	return gr.config.EnableMultiTenant && gr.config.EmailUniqueness == EmailScopeTenant
+}
+
+// userByEmail finds a user by email. With tenant-scoped
+// uniqueness the tenant is part of the key; otherwise it only narrows the match.
+func (gr *GuardRail) userByEmail(db *gorm.DB, email string, tenantID uuid.UUID) (*User, error) {
+	query := db.Where("email = ?", normalizeEmail(email))
+	if gr.config.EnableMultiTenant && tenantID != uuid.Nil {
+		query = query.Where("tenant_id = ?", tenantID)
+	}
+
+	var user User
+	if err := query.First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// emailTaken reports whether an email address is already registered within
+// the configured uniqueness scope
+func (gr *GuardRail) emailTaken(db *gorm.DB, email string, tenantID uuid.UUID) (bool, error) {
+	query := db.Model(&User{}).Where("email = ?", normalizeEmail(email))
+	if gr.tenantScoped() {
+		query = query.Where("tenant_id = ?", tenantID)
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// migrateUserEmailIndex normalizes stored emails and creates the unique
+// index matching the configured scope, dropping the one for the other scope.
+// It refuses to touch the data if normalizing would create duplicates.
+func migrateUserEmailIndex(db *gorm.DB, scope EmailScope) error {
+	groupBy := "LOWER(TRIM(email))"
+	if scope == EmailScopeTenant {
+		groupBy = "tenant_id, " + groupBy
+	}
+
+	var duplicates int64
+	err := db.Table("(?) AS dup", db.Model(&User{}).Unscoped().Select("1").Group(groupBy).Having("COUNT(*) > 1")).Count(&duplicates).Error
+	if err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		return fmt.Errorf("%d email addresses are registered more than once within the %s scope; resolve them before migrating", duplicates, scope)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email))").Error; err != nil {
+			return err
+		}
+
+		m := tx.Migrator()
+		keep, drop := userEmailIndex, userTenantEmailIndex
+		columns := "email"
+		if scope == EmailScopeTenant {
+			keep, drop = userTenantEmailIndex, userEmailIndex
+			columns = "tenant_id, email"
+		}
+
+		if m.HasIndex(&User{}, drop) {
+			if err := m.DropIndex(&User{}, drop); err != nil {
+				return err
+			}
+		}
+		if !m.HasIndex(&User{}, keep) {
+			return tx.Exec("CREATE UNIQUE INDEX " + keep + " ON users (" + columns + ")").Error
+		}
+		return nil
+	})
+}
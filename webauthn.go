@@ -0,0 +1,689 @@
+package guardrail
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserVerification is whether the authenticator must check the user's PIN or biometrics
+type UserVerification string
+
+const (
+	UserVerificationRequired    UserVerification = "required"
+	UserVerificationPreferred   UserVerification = "preferred"
+	UserVerificationDiscouraged UserVerification = "discouraged"
+)
+
+// AttestationPolicy decides which authenticators may register passkeys
+type AttestationPolicy string
+
+const (
+	// AttestationAny accepts every authenticator and doesn't ask for attestation
+	AttestationAny AttestationPolicy = "any"
+	// AttestationVerified requires a valid attestation statement, which can
+	// be self-signed, so it proves little about the authenticator model
+	AttestationVerified AttestationPolicy = "verified"
+	// AttestationTrusted requires attestation signed by a certificate that
+	// chains to WebAuthnConfig.AttestationRoots
+	AttestationTrusted AttestationPolicy = "trusted"
+)
+
+// WebAuthn ceremonies a challenge can be used for
+const (
+	webAuthnCeremonyRegistration = "registration"
+	webAuthnCeremonyLogin        = "login"
+	webAuthnCeremonyMFA          = "mfa"
+)
+
+// webAuthnChallengeBytes is the amount of randomness in ceremony challenges
+const webAuthnChallengeBytes = 32
+
+// Authentication method reference for passkeys
+const amrHardwareKey = "hwk"
+
+var (
+	// ErrPasskeysDisabled is returned when WebAuthnConfig.RPID is not set
+	ErrPasskeysDisabled = errors.New("passkeys are not enabled")
+	// ErrInvalidPasskey is returned when a passkey response fails verification
+	ErrInvalidPasskey = errors.New("passkey verification failed")
+	// ErrAttestationRejected is returned when an authenticator doesn't meet the attestation policy
+	ErrAttestationRejected = errors.New("authenticator is not allowed")
+	// ErrPasskeyNotFound is returned when a managed passkey does not exist
+	ErrPasskeyNotFound = errors.New("passkey not found")
+)
+
+// WebAuthnConfig enables passkeys
+type WebAuthnConfig struct {
+	// Domain passkeys are bound to, e.g. "example.com". Passkeys are off without it.
+	RPID string
+	// Name the browser shows (default: MFAIssuer)
+	RPName string
+	// Origins ceremonies may run on, e.g. "https://app.example.com"
+	Origins []string
+	// Default: UserVerificationPreferred
+	UserVerification UserVerification
+	// Default: AttestationAny
+	Attestation      AttestationPolicy
+	AttestationRoots *x509.CertPool
+	// Authenticator models allowed to register, empty for any. Only
+	// meaningful with AttestationTrusted, otherwise the model is self-reported.
+	AllowedAAGUIDs []string
+	// How long the browser and the user have for a ceremony (default: 5 minutes)
+	Timeout time.Duration
+}
+
+// Credential is a passkey registered by a user
+type Credential struct {
+	ID     uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	UserID uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	// Chosen by the user to tell their passkeys apart
+	Name string `json:"name"`
+	// Base64url ID assigned by the authenticator
+	CredentialID string `gorm:"not null;uniqueIndex" json:"credential_id"`
+	// COSE_Key from registration
+	PublicKey []byte `gorm:"not null" json:"-"`
+	Algorithm int    `json:"algorithm"`
+	// Signature counter last reported, 0 for authenticators without one
+	SignCount  uint32   `gorm:"not null;default:0" json:"sign_count"`
+	AAGUID     string   `json:"aaguid"`
+	Transports []string `gorm:"serializer:json" json:"transports,omitempty"`
+	// Attestation format and whether it chained to a trusted root
+	AttestationFormat  string `json:"attestation_format"`
+	AttestationTrusted bool   `json:"attestation_trusted"`
+	// Synced passkeys are backup eligible
+	BackupEligible bool       `json:"backup_eligible"`
+	BackedUp       bool       `json:"backed_up"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for Credential model
+func (Credential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// BeforeCreate assigns the credential ID
+func (c *Credential) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// WebAuthnChallenge is a ceremony waiting for the browser's response
+type WebAuthnChallenge struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	Challenge string    `gorm:"not null;uniqueIndex"`
+	Ceremony  string    `gorm:"type:varchar(20);not null"`
+	// Nil for passwordless login, where the passkey tells who the user is
+	UserID *uuid.UUID `gorm:"type:uuid"`
+	// Tenant requested for passwordless login
+	TenantID  uuid.UUID `gorm:"type:uuid"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for WebAuthnChallenge model
+func (WebAuthnChallenge) TableName() string {
+	return "webauthn_challenges"
+}
+
+// BeforeCreate assigns the challenge ID
+func (c *WebAuthnChallenge) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// PasskeyCreationOptions is passed to navigator.credentials.create(), e.g.
+// through PublicKeyCredential.parseCreationOptionsFromJSON()
+type PasskeyCreationOptions struct {
+	Challenge              string                        `json:"challenge"`
+	RP                     PasskeyRelyingParty           `json:"rp"`
+	User                   PasskeyUser                   `json:"user"`
+	PubKeyCredParams       []PasskeyParameter            `json:"pubKeyCredParams"`
+	Timeout                int64                         `json:"timeout"`
+	ExcludeCredentials     []PasskeyDescriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection PasskeyAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                        `json:"attestation"`
+}
+
+// PasskeyRequestOptions is passed to navigator.credentials.get(), e.g.
+// through PublicKeyCredential.parseRequestOptionsFromJSON()
+type PasskeyRequestOptions struct {
+	Challenge        string              `json:"challenge"`
+	Timeout          int64               `json:"timeout"`
+	RPID             string              `json:"rpId"`
+	AllowCredentials []PasskeyDescriptor `json:"allowCredentials"`
+	UserVerification UserVerification    `json:"userVerification"`
+}
+
+type PasskeyRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type PasskeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type PasskeyParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type PasskeyDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type PasskeyAuthenticatorSelection struct {
+	ResidentKey      string           `json:"residentKey"`
+	UserVerification UserVerification `json:"userVerification"`
+}
+
+// PasskeyRegistration is the browser's response to creation options, as
+// produced by PublicKeyCredential.toJSON()
+type PasskeyRegistration struct {
+	ID       string                     `json:"id"`
+	RawID    string                     `json:"rawId"`
+	Type     string                     `json:"type"`
+	Response PasskeyAttestationResponse `json:"response"`
+}
+
+type PasskeyAttestationResponse struct {
+	ClientDataJSON    string   `json:"clientDataJSON"`
+	AttestationObject string   `json:"attestationObject"`
+	Transports        []string `json:"transports,omitempty"`
+}
+
+// PasskeyAssertion is the browser's response to request options, as
+// produced by PublicKeyCredential.toJSON()
+type PasskeyAssertion struct {
+	ID       string                   `json:"id"`
+	RawID    string                   `json:"rawId"`
+	Type     string                   `json:"type"`
+	Response PasskeyAssertionResponse `json:"response"`
+}
+
+type PasskeyAssertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// PasskeyLoginRequest completes a passwordless login
+type PasskeyLoginRequest struct {
+	Assertion PasskeyAssertion `json:"assertion"`
+	// Client IP, set by the handler (e.g. c.IP())
+	IPAddress string `json:"-"`
+}
+
+// BeginPasskeyRegistration returns the options for adding a passkey to a
+// user's account. userID must come from an authenticated request, and the
+// current password is checked so a stolen session alone can't add a way in.
+func (as *AuthService) BeginPasskeyRegistration(userID, currentPassword string) (*PasskeyCreationOptions, error) {
+	if as.gr.config.WebAuthn.RPID == "" {
+		return nil, ErrPasskeysDisabled
+	}
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := as.gr.newWebAuthnChallenge(webAuthnCeremonyRegistration, &user.ID, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := as.gr.passkeyDescriptors(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	config := as.gr.config.WebAuthn
+	conveyance := "none"
+	if config.Attestation != AttestationAny {
+		conveyance = "direct"
+	}
+	params := make([]PasskeyParameter, len(supportedCOSEAlgorithms))
+	for i, alg := range supportedCOSEAlgorithms {
+		params[i] = PasskeyParameter{Type: "public-key", Alg: alg}
+	}
+	displayName := user.Email
+	if name := user.FirstName + " " + user.LastName; user.FirstName != "" || user.LastName != "" {
+		displayName = name
+	}
+
+	return &PasskeyCreationOptions{
+		Challenge: challenge,
+		RP:        PasskeyRelyingParty{ID: config.RPID, Name: config.RPName},
+		User: PasskeyUser{
+			ID:          base64.RawURLEncoding.EncodeToString(user.ID[:]),
+			Name:        user.Email,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams:   params,
+		Timeout:            config.Timeout.Milliseconds(),
+		ExcludeCredentials: existing,
+		AuthenticatorSelection: PasskeyAuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: config.UserVerification,
+		},
+		Attestation: conveyance,
+	}, nil
+}
+
+// FinishPasskeyRegistration verifies the browser's response and stores the
+// new passkey under name. The challenge must come from
+// BeginPasskeyRegistration for the same user.
+func (as *AuthService) FinishPasskeyRegistration(userID, name string, registration PasskeyRegistration) (*Credential, error) {
+	if as.gr.config.WebAuthn.RPID == "" {
+		return nil, ErrPasskeysDisabled
+	}
+	user, err := as.activeUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rawClientData, err := decodeWebAuthnField(registration.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	clientData, err := as.gr.parseClientData(rawClientData, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := as.gr.consumeWebAuthnChallenge(webAuthnCeremonyRegistration, clientData.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID == nil || *challenge.UserID != user.ID {
+		return nil, fmt.Errorf("%w: challenge belongs to another user", ErrInvalidPasskey)
+	}
+
+	attestationObject, err := decodeWebAuthnField(registration.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	authData, attestation, err := as.gr.verifyAttestation(attestationObject, clientDataHash[:])
+	if err != nil {
+		return nil, err
+	}
+	rawID, err := decodeWebAuthnField(registration.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if string(rawID) != string(authData.CredentialID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidPasskey)
+	}
+	_, alg, _ := parseCOSEKey(authData.PublicKey)
+
+	credential := Credential{
+		UserID:             user.ID,
+		Name:               name,
+		CredentialID:       base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:          authData.PublicKey,
+		Algorithm:          alg,
+		SignCount:          authData.SignCount,
+		AAGUID:             authData.AAGUID.String(),
+		Transports:         registration.Response.Transports,
+		AttestationFormat:  attestation.Format,
+		AttestationTrusted: attestation.Trusted,
+		BackupEligible:     authData.has(authDataBackupEligible),
+		BackedUp:           authData.has(authDataBackedUp),
+	}
+	var count int64
+	if err := as.gr.db.Model(&Credential{}).Where("credential_id = ?", credential.CredentialID).Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: passkey is already registered", ErrInvalidPasskey)
+	}
+	if err := as.gr.db.Create(&credential).Error; err != nil {
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditPasskeyAdded,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"credential_id": credential.ID.String(), "aaguid": credential.AAGUID},
+	})
+	return &credential, nil
+}
+
+// BeginPasskeyLogin returns the options for a passwordless login. The
+// browser offers every passkey the user has for the site, so no email is
+// needed. tenantID is the tenant to login to, "" for the home tenant.
+func (as *AuthService) BeginPasskeyLogin(tenantID string) (*PasskeyRequestOptions, error) {
+	if as.gr.config.WebAuthn.RPID == "" {
+		return nil, ErrPasskeysDisabled
+	}
+	var tid uuid.UUID
+	if tenantID != "" {
+		var err error
+		if tid, err = uuid.Parse(tenantID); err != nil {
+			return nil, fmt.Errorf("invalid tenant_id: %w", err)
+		}
+	}
+
+	challenge, err := as.gr.newWebAuthnChallenge(webAuthnCeremonyLogin, nil, tid)
+	if err != nil {
+		return nil, err
+	}
+	// Without a password the passkey has to stand for two factors
+	options := as.gr.passkeyRequestOptions(challenge, []PasskeyDescriptor{})
+	options.UserVerification = UserVerificationRequired
+	return options, nil
+}
+
+// FinishPasskeyLogin verifies a passkey and starts a session for its owner.
+// The authenticator must have verified the user (PIN, biometrics), which
+// makes the passkey multi-factor on its own, so no MFA step follows.
+func (as *AuthService) FinishPasskeyLogin(req PasskeyLoginRequest) (*AuthResponse, error) {
+	if as.gr.config.WebAuthn.RPID == "" {
+		return nil, ErrPasskeysDisabled
+	}
+	credential, challenge, _, err := as.gr.verifyAssertion(req.Assertion, webAuthnCeremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := as.gr.db.Where("id = ? AND is_active = true", credential.UserID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: account is not active", ErrInvalidPasskey)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	tenantID := challenge.TenantID
+	if as.gr.config.EnableMultiTenant && tenantID == uuid.Nil {
+		tenantID = user.TenantID
+	}
+	return as.startSession(user, tenantID, LoginMethodPasskey, req.IPAddress, "", []string{amrHardwareKey, amrMultiFactor})
+}
+
+// BeginPasskeyMFA returns the options for using a passkey as the second
+// factor of a login that returned MFARequired
+func (as *AuthService) BeginPasskeyMFA(mfaToken string) (*PasskeyRequestOptions, error) {
+	if as.gr.config.WebAuthn.RPID == "" {
+		return nil, ErrPasskeysDisabled
+	}
+	mfaChallenge, err := as.gr.findMFAChallenge(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := as.gr.passkeyDescriptors(mfaChallenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := as.gr.newWebAuthnChallenge(webAuthnCeremonyMFA, &mfaChallenge.UserID, mfaChallenge.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	return as.gr.passkeyRequestOptions(challenge, allowed), nil
+}
+
+// verifyPasskeyFactor checks a passkey used as the second factor of user's login
+func (gr *GuardRail) verifyPasskeyFactor(user User, assertion *PasskeyAssertion) (bool, error) {
+	if gr.config.WebAuthn.RPID == "" {
+		return false, ErrPasskeysDisabled
+	}
+	if assertion == nil {
+		return false, nil
+	}
+	credential, _, _, err := gr.verifyAssertion(*assertion, webAuthnCeremonyMFA)
+	if errors.Is(err, ErrInvalidPasskey) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return credential.UserID == user.ID, nil
+}
+
+// ListPasskeys returns a user's passkeys
+func (as *AuthService) ListPasskeys(userID string) ([]Credential, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+
+	var credentials []Credential
+	if err := as.gr.db.Where("user_id = ?", uid).Order("created_at").Find(&credentials).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return credentials, nil
+}
+
+// RenamePasskey changes the name of one of a user's passkeys
+func (as *AuthService) RenamePasskey(userID, passkeyID, name string) error {
+	credential, err := as.getPasskey(userID, passkeyID)
+	if err != nil {
+		return err
+	}
+	if err := as.gr.db.Model(credential).Update("name", name).Error; err != nil {
+		return fmt.Errorf("failed to rename passkey: %w", err)
+	}
+	return nil
+}
+
+// DeletePasskey removes one of a user's passkeys after checking their
+// password, like DisableTOTP, and recovery codes with the last second factor
+func (as *AuthService) DeletePasskey(userID, passkeyID, currentPassword string) error {
+	user, err := as.credentialOwner(userID, currentPassword)
+	if err != nil {
+		return err
+	}
+	credential, err := as.getPasskey(userID, passkeyID)
+	if err != nil {
+		return err
+	}
+	err = as.gr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(credential).Error; err != nil {
+			return err
+		}
+		return dropOrphanedRecoveryCodes(tx, user.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+
+	as.gr.audit(AuditEvent{
+		Action:   AuditPasskeyRemoved,
+		TenantID: user.TenantID.String(),
+		UserID:   user.ID.String(),
+		Metadata: map[string]string{"credential_id": credential.ID.String()},
+	})
+	return nil
+}
+
+func (as *AuthService) getPasskey(userID, passkeyID string) (*Credential, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id: %w", err)
+	}
+	id, err := uuid.Parse(passkeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey id: %w", err)
+	}
+
+	var credential Credential
+	if err := as.gr.db.Where("id = ? AND user_id = ?", id, uid).First(&credential).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPasskeyNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &credential, nil
+}
+
+// verifyAssertion checks the browser's response to request options and
+// records the new signature counter. The challenge is used up either way.
+func (gr *GuardRail) verifyAssertion(assertion PasskeyAssertion, ceremony string) (*Credential, *WebAuthnChallenge, *authenticatorData, error) {
+	rawClientData, err := decodeWebAuthnField(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	clientData, err := gr.parseClientData(rawClientData, "webauthn.get")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	challenge, err := gr.consumeWebAuthnChallenge(ceremony, clientData.Challenge)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rawID, err := decodeWebAuthnField(assertion.RawID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var credential Credential
+	if err := gr.db.Where("credential_id = ?", base64.RawURLEncoding.EncodeToString(rawID)).First(&credential).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, fmt.Errorf("%w: unknown passkey", ErrInvalidPasskey)
+		}
+		return nil, nil, nil, fmt.Errorf("database error: %w", err)
+	}
+	if challenge.UserID != nil && *challenge.UserID != credential.UserID {
+		return nil, nil, nil, fmt.Errorf("%w: passkey belongs to another user", ErrInvalidPasskey)
+	}
+	if assertion.Response.UserHandle != "" {
+		handle, err := decodeWebAuthnField(assertion.Response.UserHandle)
+		if err != nil || string(handle) != string(credential.UserID[:]) {
+			return nil, nil, nil, fmt.Errorf("%w: user handle mismatch", ErrInvalidPasskey)
+		}
+	}
+
+	rawAuthData, err := decodeWebAuthnField(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	authData, err := gr.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ceremony == webAuthnCeremonyLogin && !authData.has(authDataUserVerified) {
+		return nil, nil, nil, fmt.Errorf("%w: passwordless login requires user verification", ErrInvalidPasskey)
+	}
+	signature, err := decodeWebAuthnField(assertion.Response.Signature)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, alg, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid stored passkey: %w", err)
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if !verifyWebAuthnSignature(key, alg, append(rawAuthData, clientDataHash[:]...), signature) {
+		return nil, nil, nil, fmt.Errorf("%w: invalid signature", ErrInvalidPasskey)
+	}
+
+	// A counter that doesn't move forward means a second copy of the key is in use
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		gr.audit(AuditEvent{
+			Action:   AuditPasskeyCloned,
+			UserID:   credential.UserID.String(),
+			Metadata: map[string]string{"credential_id": credential.ID.String()},
+		})
+		return nil, nil, nil, fmt.Errorf("%w: signature counter went backwards", ErrInvalidPasskey)
+	}
+	now := time.Now()
+	res := gr.db.Model(&Credential{}).
+		Where("id = ? AND sign_count = ?", credential.ID, credential.SignCount).
+		Updates(map[string]interface{}{"sign_count": authData.SignCount, "backed_up": authData.has(authDataBackedUp), "last_used_at": now})
+	if res.Error != nil {
+		return nil, nil, nil, fmt.Errorf("database error: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil, nil, fmt.Errorf("%w: passkey used concurrently", ErrInvalidPasskey)
+	}
+	credential.SignCount = authData.SignCount
+	credential.LastUsedAt = &now
+
+	return &credential, challenge, authData, nil
+}
+
+// newWebAuthnChallenge stores a random challenge for a ceremony
+func (gr *GuardRail) newWebAuthnChallenge(ceremony string, userID *uuid.UUID, tenantID uuid.UUID) (string, error) {
+	buf := make([]byte, webAuthnChallengeBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	challenge := WebAuthnChallenge{
+		Challenge: base64.RawURLEncoding.EncodeToString(buf),
+		Ceremony:  ceremony,
+		UserID:    userID,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(gr.config.WebAuthn.Timeout),
+	}
+	if err := gr.db.Create(&challenge).Error; err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return challenge.Challenge, nil
+}
+
+// consumeWebAuthnChallenge marks an open challenge of a ceremony as used
+func (gr *GuardRail) consumeWebAuthnChallenge(ceremony, value string) (*WebAuthnChallenge, error) {
+	var challenge WebAuthnChallenge
+	err := gr.db.Where("challenge = ? AND ceremony = ? AND used_at IS NULL AND expires_at > ?", value, ceremony, time.Now()).
+		First(&challenge).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: unknown or expired challenge", ErrInvalidPasskey)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	res := gr.db.Model(&WebAuthnChallenge{}).Where("id = ? AND used_at IS NULL", challenge.ID).Update("used_at", time.Now())
+	if res.Error != nil {
+		return nil, fmt.Errorf("database error: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: challenge already used", ErrInvalidPasskey)
+	}
+	return &challenge, nil
+}
+
+// passkeyDescriptors lists a user's passkeys for allow and exclude lists
+func (gr *GuardRail) passkeyDescriptors(userID uuid.UUID) ([]PasskeyDescriptor, error) {
+	var credentials []Credential
+	if err := gr.db.Select("credential_id", "transports").Where("user_id = ?", userID).Find(&credentials).Error; err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	descriptors := make([]PasskeyDescriptor, len(credentials))
+	for i, c := range credentials {
+		descriptors[i] = PasskeyDescriptor{Type: "public-key", ID: c.CredentialID, Transports: c.Transports}
+	}
+	return descriptors, nil
+}
+
+func (gr *GuardRail) passkeyRequestOptions(challenge string, allowed []PasskeyDescriptor) *PasskeyRequestOptions {
+	config := gr.config.WebAuthn
+	return &PasskeyRequestOptions{
+		Challenge:        challenge,
+		Timeout:          config.Timeout.Milliseconds(),
+		RPID:             config.RPID,
+		AllowCredentials: allowed,
+		UserVerification: config.UserVerification,
+	}
+}
@@ -0,0 +1,339 @@
+package guardrail_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	guardrail "github.com/vviveksharma/auth"
+)
+
+// cborMap keeps map entries in order so the encoding is canonical
+type cborMap [][2]interface{}
+
+// cborEncode encodes the few types the software authenticator needs
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, -1-v)
+		}
+		return head(0, v)
+	case []byte:
+		return append(head(2, len(v)), v...)
+	case string:
+		return append(head(3, len(v)), v...)
+	case cborMap:
+		out := head(5, len(v))
+		for _, entry := range v {
+			out = append(out, cborEncode(entry[0])...)
+			out = append(out, cborEncode(entry[1])...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("cborEncode: unsupported %T", v))
+}
+
+// softAuthenticator is an in-memory passkey for a single site
+type softAuthenticator struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	id        []byte
+	rpID      string
+	origin    string
+	signCount uint32
+	// Only test the user's presence, like a security key without a PIN
+	skipUV bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{t: t, key: key, id: id, rpID: "example.test", origin: "https://example.test"}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	raw, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return raw
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(0x01) // user present
+	if !a.skipUV {
+		flags |= 0x04
+	}
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		pub, _ := a.key.PublicKey.Bytes()
+		data = append(data, cborEncode(cborMap{{1, 2}, {3, -7}, {-1, 1}, {-2, pub[1:33]}, {-3, pub[33:]}})...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) sign(authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("Failed to sign: %v", err)
+	}
+	return sig
+}
+
+// register answers creation options with "none" or "packed" self attestation
+func (a *softAuthenticator) register(options *guardrail.PasskeyCreationOptions, format string) guardrail.PasskeyRegistration {
+	clientData := a.clientData("webauthn.create", options.Challenge)
+	authData := a.authData(true)
+	statement := cborMap{}
+	if format == "packed" {
+		statement = cborMap{{"alg", -7}, {"sig", a.sign(authData, clientData)}}
+	}
+	object := cborEncode(cborMap{{"fmt", format}, {"attStmt", statement}, {"authData", authData}})
+
+	enc := base64.RawURLEncoding
+	return guardrail.PasskeyRegistration{
+		ID:    enc.EncodeToString(a.id),
+		RawID: enc.EncodeToString(a.id),
+		Type:  "public-key",
+		Response: guardrail.PasskeyAttestationResponse{
+			ClientDataJSON:    enc.EncodeToString(clientData),
+			AttestationObject: enc.EncodeToString(object),
+			Transports:        []string{"internal"},
+		},
+	}
+}
+
+// assert answers request options, advancing the signature counter
+func (a *softAuthenticator) assert(options *guardrail.PasskeyRequestOptions) guardrail.PasskeyAssertion {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	authData := a.authData(false)
+
+	enc := base64.RawURLEncoding
+	return guardrail.PasskeyAssertion{
+		ID:    enc.EncodeToString(a.id),
+		RawID: enc.EncodeToString(a.id),
+		Type:  "public-key",
+		Response: guardrail.PasskeyAssertionResponse{
+			ClientDataJSON:    enc.EncodeToString(clientData),
+			AuthenticatorData: enc.EncodeToString(authData),
+			Signature:         enc.EncodeToString(a.sign(authData, clientData)),
+		},
+	}
+}
+
+func newPasskeyTestGuardRail(t *testing.T, policy guardrail.AttestationPolicy) *guardrail.AuthService {
+	gr, _ := newTestGuardRail(t, guardrail.Config{WebAuthn: guardrail.WebAuthnConfig{
+		RPID:        "example.test",
+		Origins:     []string{"https://example.test"},
+		Attestation: policy,
+	}})
+	return gr.NewAuthService()
+}
+
+func registerPasskey(t *testing.T, as *guardrail.AuthService, userID string, authenticator *softAuthenticator, format string) (*guardrail.Credential, error) {
+	t.Helper()
+	options, err := as.BeginPasskeyRegistration(userID, "correct-horse-battery")
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration failed: %v", err)
+	}
+	return as.FinishPasskeyRegistration(userID, "Laptop", authenticator.register(options, format))
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	as := newPasskeyTestGuardRail(t, "")
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// A session alone can't add a passkey
+	if _, err := as.BeginPasskeyRegistration(user.UserID, ""); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+
+	authenticator := newSoftAuthenticator(t)
+	credential, err := registerPasskey(t, as, user.UserID, authenticator, "none")
+	if err != nil {
+		t.Fatalf("FinishPasskeyRegistration failed: %v", err)
+	}
+	if credential.AttestationFormat != "none" || credential.SignCount != 0 || fmt.Sprint(credential.Transports) != "[internal]" {
+		t.Errorf("Unexpected credential %+v", credential)
+	}
+	if _, err := registerPasskey(t, as, user.UserID, authenticator, "none"); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected registering a passkey twice to fail, got %v", err)
+	}
+
+	options, err := as.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin failed: %v", err)
+	}
+	assertion := authenticator.assert(options)
+	resp, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: assertion})
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin failed: %v", err)
+	}
+	if claims := tokenClaims(t, resp.AccessToken); resp.UserID != user.UserID || claims["acr"] != "aal2" || fmt.Sprint(claims["amr"]) != "[hwk mfa]" {
+		t.Errorf("Expected a multi-factor session for the user, got %+v with %v", resp, claims)
+	}
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: assertion}); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected a replayed assertion to fail, got %v", err)
+	}
+
+	// Without a password the authenticator has to verify the user
+	options, _ = as.BeginPasskeyLogin("")
+	if options.UserVerification != guardrail.UserVerificationRequired {
+		t.Errorf("Expected passwordless login to require user verification, got %q", options.UserVerification)
+	}
+	authenticator.skipUV = true
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: authenticator.assert(options)}); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected a passkey without user verification to fail, got %v", err)
+	}
+	authenticator.skipUV = false
+
+	// Another origin, e.g. a phishing site relaying the challenge
+	options, _ = as.BeginPasskeyLogin("")
+	authenticator.origin = "https://example.test.evil"
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: authenticator.assert(options)}); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected a foreign origin to fail, got %v", err)
+	}
+	authenticator.origin = "https://example.test"
+
+	// A cloned authenticator falls behind the stored counter
+	clone := *authenticator
+	options, _ = as.BeginPasskeyLogin("")
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: authenticator.assert(options)}); err != nil {
+		t.Fatalf("FinishPasskeyLogin failed: %v", err)
+	}
+	options, _ = as.BeginPasskeyLogin("")
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: clone.assert(options)}); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected a lower signature counter to fail, got %v", err)
+	}
+
+	passkeys, err := as.ListPasskeys(user.UserID)
+	if err != nil || len(passkeys) != 1 || passkeys[0].SignCount != authenticator.signCount || passkeys[0].LastUsedAt == nil {
+		t.Fatalf("Unexpected passkeys %+v, %v", passkeys, err)
+	}
+	if err := as.RenamePasskey(user.UserID, passkeys[0].ID.String(), "Phone"); err != nil {
+		t.Fatalf("RenamePasskey failed: %v", err)
+	}
+	if passkeys, _ := as.ListPasskeys(user.UserID); passkeys[0].Name != "Phone" {
+		t.Errorf("Expected the new name, got %q", passkeys[0].Name)
+	}
+	other, _ := as.Register(guardrail.RegisterRequest{Email: "bob@example.test", Password: "correct-horse-battery"})
+	if err := as.DeletePasskey(other.UserID, passkeys[0].ID.String(), "correct-horse-battery"); !errors.Is(err, guardrail.ErrPasskeyNotFound) {
+		t.Errorf("Expected another user's passkey to be out of reach, got %v", err)
+	}
+	if err := as.DeletePasskey(user.UserID, passkeys[0].ID.String(), "wrong-password"); !errors.Is(err, guardrail.ErrInvalidCurrentPassword) {
+		t.Errorf("Expected ErrInvalidCurrentPassword, got %v", err)
+	}
+	if _, err := as.GenerateRecoveryCodes(user.UserID, "correct-horse-battery"); err != nil {
+		t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+	}
+	if err := as.DeletePasskey(user.UserID, passkeys[0].ID.String(), "correct-horse-battery"); err != nil {
+		t.Fatalf("DeletePasskey failed: %v", err)
+	}
+	if remaining, _ := as.RecoveryCodesRemaining(user.UserID); remaining != 0 {
+		t.Errorf("Expected recovery codes to go with the last passkey, %d left", remaining)
+	}
+	options, _ = as.BeginPasskeyLogin("")
+	if _, err := as.FinishPasskeyLogin(guardrail.PasskeyLoginRequest{Assertion: authenticator.assert(options)}); !errors.Is(err, guardrail.ErrInvalidPasskey) {
+		t.Errorf("Expected a deleted passkey to fail, got %v", err)
+	}
+}
+
+func TestPasskeyMFA(t *testing.T) {
+	as := newPasskeyTestGuardRail(t, "")
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	authenticator := newSoftAuthenticator(t)
+	if _, err := registerPasskey(t, as, user.UserID, authenticator, "none"); err != nil {
+		t.Fatalf("FinishPasskeyRegistration failed: %v", err)
+	}
+
+	login, err := as.Login(guardrail.LoginRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil || !login.MFARequired || fmt.Sprint(login.MFAMethods) != "[passkey]" {
+		t.Fatalf("Expected a passkey challenge, got %+v, %v", login, err)
+	}
+	options, err := as.BeginPasskeyMFA(login.MFAToken)
+	if err != nil || len(options.AllowCredentials) != 1 {
+		t.Fatalf("Expected options for the user's passkey, got %+v, %v", options, err)
+	}
+
+	// Signed by a key the user never registered
+	stranger := newSoftAuthenticator(t)
+	stranger.id = authenticator.id
+	req := guardrail.VerifyMFARequest{MFAToken: login.MFAToken, Method: guardrail.MFAMethodPasskey}
+	assertion := stranger.assert(options)
+	req.Assertion = &assertion
+	if _, err := as.VerifyMFA(req); !errors.Is(err, guardrail.ErrInvalidMFACode) {
+		t.Errorf("Expected ErrInvalidMFACode, got %v", err)
+	}
+
+	// Presence is enough next to the password
+	options, _ = as.BeginPasskeyMFA(login.MFAToken)
+	authenticator.skipUV = true
+	assertion = authenticator.assert(options)
+	req.Assertion = &assertion
+	resp, err := as.VerifyMFA(req)
+	if err != nil {
+		t.Fatalf("VerifyMFA failed: %v", err)
+	}
+	if claims := tokenClaims(t, resp.AccessToken); fmt.Sprint(claims["amr"]) != "[pwd hwk mfa]" {
+		t.Errorf("Unexpected amr %v", claims["amr"])
+	}
+}
+
+func TestPasskeyAttestationPolicy(t *testing.T) {
+	as := newPasskeyTestGuardRail(t, guardrail.AttestationVerified)
+	user, err := as.Register(guardrail.RegisterRequest{Email: "ada@example.test", Password: "correct-horse-battery"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	options, err := as.BeginPasskeyRegistration(user.UserID, "correct-horse-battery")
+	if err != nil || options.Attestation != "direct" || options.RP.ID != "example.test" {
+		t.Fatalf("Unexpected options %+v, %v", options, err)
+	}
+	authenticator := newSoftAuthenticator(t)
+	if _, err := registerPasskey(t, as, user.UserID, authenticator, "none"); !errors.Is(err, guardrail.ErrAttestationRejected) {
+		t.Errorf("Expected ErrAttestationRejected, got %v", err)
+	}
+	credential, err := registerPasskey(t, as, user.UserID, authenticator, "packed")
+	if err != nil || credential.AttestationFormat != "packed" || credential.AttestationTrusted {
+		t.Errorf("Expected an untrusted packed attestation, got %+v, %v", credential, err)
+	}
+}
@@ -0,0 +1,310 @@
+package guardrail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/google/uuid"
+)
+
+// COSE algorithm identifiers GuardRail accepts, in order of preference
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var supportedCOSEAlgorithms = []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// Authenticator data flags
+const (
+	authDataUserPresent    = 0x01
+	authDataUserVerified   = 0x04
+	authDataBackupEligible = 0x08
+	authDataBackedUp       = 0x10
+	authDataAttested       = 0x40
+)
+
+// clientData is the part of clientDataJSON checked by the relying party
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authData of a ceremony
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// Only present when registering
+	AAGUID       uuid.UUID
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (d authenticatorData) has(flag byte) bool {
+	return d.Flags&flag != 0
+}
+
+// parseClientData decodes clientDataJSON and checks the ceremony type and origin
+func (gr *GuardRail) parseClientData(raw []byte, ceremony string) (*clientData, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%w: malformed client data", ErrInvalidPasskey)
+	}
+	if data.Type != ceremony {
+		return nil, fmt.Errorf("%w: unexpected ceremony %q", ErrInvalidPasskey, data.Type)
+	}
+	if !containsString(gr.config.WebAuthn.Origins, data.Origin) {
+		return nil, fmt.Errorf("%w: origin %q is not allowed", ErrInvalidPasskey, data.Origin)
+	}
+	return &data, nil
+}
+
+// parseAuthenticatorData decodes authData and checks the relying party and
+// the user presence and verification flags
+func (gr *GuardRail) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidPasskey)
+	}
+	data := &authenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(gr.config.WebAuthn.RPID))
+	if !bytes.Equal(data.RPIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: wrong relying party", ErrInvalidPasskey)
+	}
+	if !data.has(authDataUserPresent) {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidPasskey)
+	}
+	if gr.config.WebAuthn.UserVerification == UserVerificationRequired && !data.has(authDataUserVerified) {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidPasskey)
+	}
+
+	if data.has(authDataAttested) {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidPasskey)
+		}
+		copy(data.AAGUID[:], rest[:16])
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: invalid credential id", ErrInvalidPasskey)
+		}
+		data.CredentialID = rest[:idLength]
+
+		_, after, err := decodeCBOR(rest[idLength:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid public key: %v", ErrInvalidPasskey, err)
+		}
+		data.PublicKey = rest[idLength : len(rest)-len(after)]
+	}
+	return data, nil
+}
+
+// parseCOSEKey converts a COSE_Key (RFC 9053) into a public key and its algorithm
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("public key is not a map")
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, 0, err
+		}
+		return pub, coseAlgES256, nil
+
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), coseAlgEdDSA, nil
+
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, coseAlgRS256, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// verifyWebAuthnSignature checks a signature made with one of the supported algorithms
+func verifyWebAuthnSignature(key crypto.PublicKey, alg int, data, signature []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return alg == coseAlgES256 && ecdsa.VerifyASN1(k, digest[:], signature)
+	case ed25519.PublicKey:
+		return alg == coseAlgEdDSA && ed25519.Verify(k, data, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return alg == coseAlgRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// attestationResult is what an attestation statement proved
+type attestationResult struct {
+	Format string
+	// The statement was signed by a certificate chaining to AttestationRoots
+	Trusted bool
+}
+
+// verifyAttestation checks an attestation object against the attestation
+// policy and returns the parsed authenticator data
+func (gr *GuardRail) verifyAttestation(attestationObject, clientDataHash []byte) (*authenticatorData, *attestationResult, error) {
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid attestation object", ErrInvalidPasskey)
+	}
+	object, _ := decoded.(map[interface{}]interface{})
+	format, _ := object["fmt"].(string)
+	rawAuthData, _ := object["authData"].([]byte)
+	statement, _ := object["attStmt"].(map[interface{}]interface{})
+	if format == "" || rawAuthData == nil || statement == nil {
+		return nil, nil, fmt.Errorf("%w: incomplete attestation object", ErrInvalidPasskey)
+	}
+
+	authData, err := gr.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !authData.has(authDataAttested) {
+		return nil, nil, fmt.Errorf("%w: no credential in attestation", ErrInvalidPasskey)
+	}
+	credentialKey, credentialAlg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+	}
+
+	result := &attestationResult{Format: format}
+	policy := gr.config.WebAuthn.Attestation
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return nil, nil, fmt.Errorf("%w: none attestation with a statement", ErrInvalidPasskey)
+		}
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		signature, _ := statement["sig"].([]byte)
+		signed := append(append([]byte{}, rawAuthData...), clientDataHash...)
+
+		chain, hasChain := statement["x5c"].([]interface{})
+		if !hasChain {
+			// Self attestation, signed with the credential key itself
+			if int(alg) != credentialAlg || !verifyWebAuthnSignature(credentialKey, credentialAlg, signed, signature) {
+				return nil, nil, fmt.Errorf("%w: invalid self attestation", ErrInvalidPasskey)
+			}
+			break
+		}
+
+		certs, err := parseCertificateChain(chain)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+		}
+		if !verifyWebAuthnSignature(certs[0].PublicKey, int(alg), signed, signature) {
+			return nil, nil, fmt.Errorf("%w: invalid attestation signature", ErrInvalidPasskey)
+		}
+		if roots := gr.config.WebAuthn.AttestationRoots; roots != nil {
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			result.Trusted = err == nil
+		}
+	default:
+		// Other formats are accepted as unverified unless the policy asks for more
+		if policy != AttestationAny {
+			return nil, nil, fmt.Errorf("%w: unsupported attestation format %q", ErrAttestationRejected, format)
+		}
+	}
+
+	switch policy {
+	case AttestationVerified:
+		if format == "none" {
+			return nil, nil, fmt.Errorf("%w: authenticator sent no attestation", ErrAttestationRejected)
+		}
+	case AttestationTrusted:
+		if !result.Trusted {
+			return nil, nil, fmt.Errorf("%w: attestation is not from a trusted authenticator", ErrAttestationRejected)
+		}
+	}
+	if allowed := gr.config.WebAuthn.AllowedAAGUIDs; len(allowed) > 0 && !containsString(allowed, authData.AAGUID.String()) {
+		return nil, nil, fmt.Errorf("%w: authenticator model %s is not allowed", ErrAttestationRejected, authData.AAGUID)
+	}
+
+	return authData, result, nil
+}
+
+func parseCertificateChain(chain []interface{}) ([]*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, entry := range chain {
+		der, ok := entry.([]byte)
+		if !ok {
+			return nil, errors.New("invalid certificate chain")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// decodeWebAuthnField decodes a base64url field of a browser response,
+// tolerating padding and the standard alphabet
+func decodeWebAuthnField(value string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if decoded, err := enc.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: invalid base64", ErrInvalidPasskey)
+}